@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// DefaultBatchConcurrency is the number of ids of a batch processed concurrently when none is configured
+const DefaultBatchConcurrency = 10
+
+// MaxBatchSize is the maximum number of ids accepted in a single batch
+const MaxBatchSize = 500
+
+// BatchDataKeyResult - the data key of one id of a batch, or the error that prevented getting it
+type BatchDataKeyResult struct {
+	ID      string
+	Key     *string
+	Version int
+	Err     error
+}
+
+// GetPlaintextDataKeys retrieves the current version of the key assosicated with each of the given ids.
+// If create is true, keys are generated for ids that are not found in the store, like GetPlaintextDataKey does;
+// otherwise those ids get an IDNotFoundStoreError, like LookupPlaintextDataKey does.
+// A result is returned for every id, in the same order; a failure for one id does not fail the others.
+func (r *RKMS) GetPlaintextDataKeys(ctx context.Context, ids []string, create bool) []BatchDataKeyResult {
+	results := make([]BatchDataKeyResult, len(ids))
+
+	resultsByID := make(map[string]BatchDataKeyResult)
+	uniqueIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, seen := resultsByID[id]; seen {
+			continue
+		}
+
+		if err := ValidateID(id); err != nil {
+			resultsByID[id] = BatchDataKeyResult{ID: id, Err: err}
+			continue
+		}
+
+		resultsByID[id] = BatchDataKeyResult{ID: id}
+		uniqueIDs = append(uniqueIDs, id)
+	}
+
+	encryptedDataKeysByID, err := r.store.GetEncryptedDataKeysBatch(ctx, uniqueIDs)
+	if err != nil {
+		//fall back to reading every id on its own
+		logger.Errorf("failed to read a batch of ids from key/value store: %s", err)
+		encryptedDataKeysByID = nil
+	}
+
+	concurrency := r.batchConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, concurrency)
+
+	for _, id := range uniqueIDs {
+		wg.Add(1)
+		semaphore <- struct{}{}
+
+		go func(id string, encryptedDataKeys *EncryptedDataKeys) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			var plaintextDataKey *string
+			var version int
+			var err error
+			if encryptedDataKeys != nil {
+				plaintextDataKey, version, err = r.decryptDataKeyVersion(ctx, id, encryptedDataKeys, 0)
+			} else if create {
+				plaintextDataKey, version, err = r.getPlaintextDataKey(ctx, id, MaxNumberOfGetPlaintextDataKeyTries, nil)
+			} else {
+				plaintextDataKey, version, err = r.LookupPlaintextDataKey(ctx, id)
+			}
+
+			mutex.Lock()
+			resultsByID[id] = BatchDataKeyResult{id, plaintextDataKey, version, err}
+			mutex.Unlock()
+		}(id, encryptedDataKeysByID[id])
+	}
+
+	wg.Wait()
+
+	for i, id := range ids {
+		results[i] = resultsByID[id]
+	}
+
+	return results
+}
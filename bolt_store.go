@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultBoltLockTimeoutInSeconds is how long to wait for another process to release the database file when none is configured
+const DefaultBoltLockTimeoutInSeconds = 10
+
+var boltBucketName = []byte("encrypted_data_keys")
+
+// BoltStore - embedded bbolt implementation of the Store interface for single-node deployments.
+// Every id is kept as a JSON value (see jsonItem) in a single bucket. Each write is a transaction
+// that is fsynced to the file before it returns. Transactions cannot be interrupted, so a cancelled context
+// is only checked before each one starts.
+type BoltStore struct {
+	db *bolt.DB
+
+	// closed by Close to stop the periodic backups
+	done      chan struct{}
+	closeOnce sync.Once
+	backups   sync.WaitGroup
+}
+
+// NewBoltStore opens (or creates) the bbolt database file, and starts backing it up periodically if configured
+func NewBoltStore(boltConfig BoltConfig) (*BoltStore, error) {
+	if boltConfig.Path == "" {
+		return nil, fmt.Errorf("a bbolt database path is required")
+	}
+
+	lockTimeout := boltConfig.LockTimeoutInSeconds
+	if lockTimeout <= 0 {
+		lockTimeout = DefaultBoltLockTimeoutInSeconds
+	}
+
+	db, err := bolt.Open(boltConfig.Path, 0600, &bolt.Options{Timeout: time.Duration(lockTimeout) * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bbolt database %s: %s", boltConfig.Path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucketName)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &BoltStore{db: db, done: make(chan struct{})}
+	if boltConfig.BackupPath != "" && boltConfig.BackupIntervalInMinutes > 0 {
+		s.startBackups(boltConfig.BackupPath, time.Duration(boltConfig.BackupIntervalInMinutes)*time.Minute)
+	}
+
+	return s, nil
+}
+
+// Close stops the periodic backups, waiting for one in progress to finish, and releases the database file
+func (s *BoltStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.backups.Wait()
+
+	return s.db.Close()
+}
+
+// GetEncryptedDataKeys retrieves every version of the encrypted data keys for the given id
+func (s *BoltStore) GetEncryptedDataKeys(ctx context.Context, id string) (*EncryptedDataKeys, error) {
+	var encryptedDataKeys *EncryptedDataKeys
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		encryptedDataKeys, err = getBoltItem(tx, id)
+		return err
+	})
+
+	return encryptedDataKeys, err
+}
+
+// GetEncryptedDataKeysBatch retrieves every version of the encrypted data keys for each of the given ids
+// from a single read transaction
+func (s *BoltStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]*EncryptedDataKeys, error) {
+	encryptedDataKeysByID := make(map[string]*EncryptedDataKeys)
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			encryptedDataKeys, err := getBoltItem(tx, id)
+			if err != nil {
+				return err
+			}
+
+			if encryptedDataKeys != nil {
+				encryptedDataKeysByID[id] = encryptedDataKeys
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return encryptedDataKeysByID, nil
+}
+
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id as its first version
+// only if id does not exist in the store already
+func (s *BoltStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, keys map[string]string, incomplete bool, metadata DataKeyMetadata) error {
+	return s.update(ctx, id, func(encryptedDataKeys *EncryptedDataKeys) (*EncryptedDataKeys, error) {
+		if encryptedDataKeys != nil {
+			return nil, IDAlreadyExistsStoreError{ID: id}
+		}
+
+		return newEncryptedDataKeys(keys, incomplete, metadata), nil
+	})
+}
+
+// AddEncryptedDataKeysVersionConditionally adds the encrypted data keys for the given id as a new version
+// and makes it the current version, only if the current version of id is still version-1
+func (s *BoltStore) AddEncryptedDataKeysVersionConditionally(ctx context.Context, id string, version int, keys map[string]string, incomplete bool, metadata DataKeyMetadata) error {
+	return s.update(ctx, id, func(encryptedDataKeys *EncryptedDataKeys) (*EncryptedDataKeys, error) {
+		return encryptedDataKeys, addEncryptedDataKeysVersion(encryptedDataKeys, id, version, keys, incomplete, metadata)
+	})
+}
+
+// UpdateEncryptedDataKeysConditionally sets the encrypted data keys of the regions in keys for the given version of id,
+// only if the current encrypted data key of each of those regions still matches the one in previousKeys
+func (s *BoltStore) UpdateEncryptedDataKeysConditionally(ctx context.Context, id string, version int, previousKeys map[string]string, keys map[string]string, keyIDs map[string]string, complete bool) error {
+	return s.update(ctx, id, func(encryptedDataKeys *EncryptedDataKeys) (*EncryptedDataKeys, error) {
+		return encryptedDataKeys, updateEncryptedDataKeysVersion(encryptedDataKeys, id, version, previousKeys, keys, keyIDs, complete)
+	})
+}
+
+// update reads id, lets update change it and writes it back in a single read-write transaction,
+// so the condition checked by update cannot be invalidated by a concurrent writer
+func (s *BoltStore) update(ctx context.Context, id string, update func(*EncryptedDataKeys) (*EncryptedDataKeys, error)) error {
+	return s.write(ctx, func(tx *bolt.Tx) error {
+		encryptedDataKeys, err := getBoltItem(tx, id)
+		if err != nil {
+			return err
+		}
+
+		encryptedDataKeys, err = update(encryptedDataKeys)
+		if err != nil {
+			return err
+		}
+
+		value, err := marshalJSONItem(encryptedDataKeys)
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(boltBucketName).Put([]byte(id), value)
+	})
+}
+
+// ListIDs returns up to limit ids stored after the given cursor, along with the cursor to continue from.
+// Ids are listed in byte order and the cursor is the last id returned.
+func (s *BoltStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	var ids []string
+	nextCursor := ""
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucketName).Cursor()
+
+		k, _ := c.Seek([]byte(cursor))
+		if k != nil && cursor != "" && bytes.Equal(k, []byte(cursor)) {
+			k, _ = c.Next()
+		}
+
+		for ; k != nil; k, _ = c.Next() {
+			if limit > 0 && len(ids) == limit {
+				nextCursor = ids[len(ids)-1]
+				break
+			}
+			ids = append(ids, string(k))
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return ids, nextCursor, nil
+}
+
+// DeleteEncryptedDataKeys removes every version of the encrypted data keys for the given id
+func (s *BoltStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	return s.write(ctx, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucketName)
+		if bucket.Get([]byte(id)) == nil {
+			return IDNotFoundStoreError{ID: id}
+		}
+
+		return bucket.Delete([]byte(id))
+	})
+}
+
+// view runs f in a read-only transaction, unless ctx is done already
+func (s *BoltStore) view(ctx context.Context, f func(*bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return CancelledError{err}
+	}
+
+	return newBoltStoreError(ctx, s.db.View(f))
+}
+
+// write runs f in a read-write transaction, unless ctx is done already
+func (s *BoltStore) write(ctx context.Context, f func(*bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return CancelledError{err}
+	}
+
+	return newBoltStoreError(ctx, s.db.Update(f))
+}
+
+// newBoltStoreError wraps an error of bbolt or of decoding an item in a typed error,
+// and returns the errors of failed write conditions as they are
+func newBoltStoreError(ctx context.Context, err error) error {
+	switch err.(type) {
+	case nil, IDAlreadyExistsStoreError, IDNotFoundStoreError, ConditionalUpdateFailedStoreError:
+		return err
+	}
+
+	logger.Print(err)
+	return newStoreError(ctx, err)
+}
+
+// Backup writes a consistent copy of the database to w while the store keeps serving requests
+func (s *BoltStore) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+
+	return n, err
+}
+
+// BackupToFile writes a consistent copy of the database to path.
+// The copy is written to a temporary file first, so path always holds a complete backup.
+func (s *BoltStore) BackupToFile(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := s.Backup(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// startBackups backs the database up to path every interval until the store is closed
+func (s *BoltStore) startBackups(path string, interval time.Duration) {
+	s.backups.Add(1)
+	go s.backupPeriodically(path, interval)
+}
+
+func (s *BoltStore) backupPeriodically(path string, interval time.Duration) {
+	defer s.backups.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		if err := s.BackupToFile(path); err != nil {
+			logger.Errorf("failed to back up bbolt database to %s: %s", path, err)
+			continue
+		}
+
+		logger.Infof("backed up bbolt database to %s", path)
+	}
+}
+
+func getBoltItem(tx *bolt.Tx, id string) (*EncryptedDataKeys, error) {
+	value := tx.Bucket(boltBucketName).Get([]byte(id))
+	if value == nil {
+		return nil, nil
+	}
+
+	//value is only valid during the transaction, but unmarshalling copies it
+	return unmarshalJSONItem(value)
+}
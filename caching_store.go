@@ -0,0 +1,363 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// DefaultCacheMaxEntries is the number of ids kept in the cache when no maximum is configured
+const DefaultCacheMaxEntries = 10000
+
+// CacheStats - counters of the reads served by a CachingStore
+type CacheStats struct {
+	Hits         uint64
+	NegativeHits uint64
+	Misses       uint64
+	Evictions    uint64
+	Entries      int
+}
+
+// CachingStore - Store decorator that keeps the encrypted data keys read from or written to another store in memory.
+// At most maxEntries ids are kept; the least recently used one is evicted to make room for a new one.
+// Ids missing from the store are remembered too if negative caching is enabled.
+// Reads that fill the cache and writes of the same id are serialized, so a read that fetched an id before
+// it was written or deleted cannot cache the stale value once the write returned.
+type CachingStore struct {
+	store Store
+
+	idLocksMutex sync.Mutex
+	idLocks      map[string]*idLock
+
+	expiration         time.Duration
+	negativeExpiration time.Duration
+	maxEntries         int
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List //most recently used first
+
+	hits         uint64
+	negativeHits uint64
+	misses       uint64
+	evictions    uint64
+}
+
+// idLock is held while an id is read into the cache or written, by refs goroutines at most
+type idLock struct {
+	sync.Mutex
+	refs int
+}
+
+type cacheEntry struct {
+	id string
+
+	// encryptedDataKeys is nil for an id that is missing from the store
+	encryptedDataKeys *EncryptedDataKeys
+	expiresAt         time.Time
+}
+
+// NewCachingStore creates a new CachingStore instance in front of the given store,
+// and starts removing expired entries periodically if configured
+func NewCachingStore(store Store, cacheConfig CacheConfig) *CachingStore {
+	maxEntries := cacheConfig.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = DefaultCacheMaxEntries
+	}
+
+	s := &CachingStore{
+		store:              store,
+		idLocks:            make(map[string]*idLock),
+		expiration:         time.Duration(cacheConfig.ExpirationInMinutes) * time.Minute,
+		negativeExpiration: time.Duration(cacheConfig.NegativeExpirationInSeconds) * time.Second,
+		maxEntries:         maxEntries,
+		entries:            make(map[string]*list.Element),
+		lru:                list.New(),
+	}
+
+	if cacheConfig.CleanupIntervalInMinutes > 0 {
+		go s.cleanUpPeriodically(time.Duration(cacheConfig.CleanupIntervalInMinutes) * time.Minute)
+	}
+
+	return s
+}
+
+// GetEncryptedDataKeys retrieves every version of the encrypted data keys for the given id,
+// from the cache if it is there
+func (s *CachingStore) GetEncryptedDataKeys(ctx context.Context, id string) (*EncryptedDataKeys, error) {
+	if encryptedDataKeys, found := s.get(id); found {
+		return encryptedDataKeys, nil
+	}
+
+	unlock := s.lockIDs(id)
+	defer unlock()
+
+	//another read may have filled the cache meanwhile
+	if encryptedDataKeys, found := s.peek(id); found {
+		return encryptedDataKeys, nil
+	}
+
+	encryptedDataKeys, err := s.store.GetEncryptedDataKeys(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.set(id, encryptedDataKeys)
+	return encryptedDataKeys, nil
+}
+
+// GetEncryptedDataKeysBatch retrieves every version of the encrypted data keys for each of the given ids,
+// reading only the ids that are not in the cache from the store
+func (s *CachingStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]*EncryptedDataKeys, error) {
+	encryptedDataKeysByID := make(map[string]*EncryptedDataKeys)
+
+	var missedIDs []string
+	for _, id := range ids {
+		encryptedDataKeys, found := s.get(id)
+		if !found {
+			missedIDs = append(missedIDs, id)
+			continue
+		}
+
+		if encryptedDataKeys != nil {
+			encryptedDataKeysByID[id] = encryptedDataKeys
+		}
+	}
+
+	if len(missedIDs) == 0 {
+		return encryptedDataKeysByID, nil
+	}
+
+	unlock := s.lockIDs(missedIDs...)
+	defer unlock()
+
+	storedEncryptedDataKeysByID, err := s.store.GetEncryptedDataKeysBatch(ctx, missedIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range missedIDs {
+		encryptedDataKeys := storedEncryptedDataKeysByID[id]
+		s.set(id, encryptedDataKeys)
+		if encryptedDataKeys != nil {
+			encryptedDataKeysByID[id] = encryptedDataKeys
+		}
+	}
+
+	return encryptedDataKeysByID, nil
+}
+
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id as its first version
+// only if id does not exist in the store already
+func (s *CachingStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, keys map[string]string, incomplete bool, metadata DataKeyMetadata) error {
+	unlock := s.lockIDs(id)
+	defer unlock()
+
+	//a cached negative lookup must not outlive the write, whether it succeeds or not
+	s.delete(id)
+
+	if err := s.store.SetEncryptedDataKeysConditionally(ctx, id, keys, incomplete, metadata); err != nil {
+		return err
+	}
+
+	//the caller may still change keys, which must not change the cached value
+	s.set(id, newEncryptedDataKeys(copyKeys(keys), incomplete, copyMetadata(metadata)))
+	return nil
+}
+
+// AddEncryptedDataKeysVersionConditionally adds the encrypted data keys for the given id as a new version
+// and makes it the current version, only if the current version of id is still version-1
+func (s *CachingStore) AddEncryptedDataKeysVersionConditionally(ctx context.Context, id string, version int, keys map[string]string, incomplete bool, metadata DataKeyMetadata) error {
+	unlock := s.lockIDs(id)
+	defer unlock()
+
+	//the current version is about to change, so don't serve it from cache anymore
+	defer s.delete(id)
+	return s.store.AddEncryptedDataKeysVersionConditionally(ctx, id, version, keys, incomplete, metadata)
+}
+
+// UpdateEncryptedDataKeysConditionally sets the encrypted data keys of the regions in keys for the given version of id,
+// only if the current encrypted data key of each of those regions still matches the one in previousKeys
+func (s *CachingStore) UpdateEncryptedDataKeysConditionally(ctx context.Context, id string, version int, previousKeys map[string]string, keys map[string]string, keyIDs map[string]string, complete bool) error {
+	unlock := s.lockIDs(id)
+	defer unlock()
+
+	//the stored value is about to change, so don't serve it from cache anymore
+	defer s.delete(id)
+	return s.store.UpdateEncryptedDataKeysConditionally(ctx, id, version, previousKeys, keys, keyIDs, complete)
+}
+
+// ListIDs returns up to limit ids stored after the given cursor, along with the cursor to continue from.
+// Ids are always listed from the store.
+func (s *CachingStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	return s.store.ListIDs(ctx, cursor, limit)
+}
+
+// DeleteEncryptedDataKeys removes every version of the encrypted data keys for the given id
+func (s *CachingStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	unlock := s.lockIDs(id)
+	defer unlock()
+
+	//reads that fill the cache wait for the delete, so none of them can re-cache the deleted key
+	defer s.delete(id)
+	return s.store.DeleteEncryptedDataKeys(ctx, id)
+}
+
+// Stats returns the counters of the reads served so far, along with the number of cached ids
+func (s *CachingStore) Stats() CacheStats {
+	s.mutex.Lock()
+	entries := s.lru.Len()
+	s.mutex.Unlock()
+
+	return CacheStats{
+		Hits:         atomic.LoadUint64(&s.hits),
+		NegativeHits: atomic.LoadUint64(&s.negativeHits),
+		Misses:       atomic.LoadUint64(&s.misses),
+		Evictions:    atomic.LoadUint64(&s.evictions),
+		Entries:      entries,
+	}
+}
+
+// get returns the cached encrypted data keys of id, and whether id was found in the cache at all
+func (s *CachingStore) get(id string) (*EncryptedDataKeys, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	element, ok := s.entries[id]
+	if !ok {
+		atomic.AddUint64(&s.misses, 1)
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		s.remove(element)
+		atomic.AddUint64(&s.misses, 1)
+		return nil, false
+	}
+
+	s.lru.MoveToFront(element)
+	if entry.encryptedDataKeys == nil {
+		atomic.AddUint64(&s.negativeHits, 1)
+	} else {
+		atomic.AddUint64(&s.hits, 1)
+	}
+
+	return entry.encryptedDataKeys, true
+}
+
+// peek returns the cached encrypted data keys of id like get, without counting a hit or a miss
+func (s *CachingStore) peek(id string) (*EncryptedDataKeys, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	element, ok := s.entries[id]
+	if !ok || time.Now().After(element.Value.(*cacheEntry).expiresAt) {
+		return nil, false
+	}
+
+	return element.Value.(*cacheEntry).encryptedDataKeys, true
+}
+
+// lockIDs locks the given ids, in order so concurrent callers cannot deadlock, and returns the function unlocking them
+func (s *CachingStore) lockIDs(ids ...string) func() {
+	sortedIDs := append([]string{}, ids...)
+	sort.Strings(sortedIDs)
+
+	var locks []*idLock
+	var lockedIDs []string
+	for i, id := range sortedIDs {
+		if i > 0 && id == sortedIDs[i-1] {
+			continue
+		}
+
+		s.idLocksMutex.Lock()
+		lock, ok := s.idLocks[id]
+		if !ok {
+			lock = &idLock{}
+			s.idLocks[id] = lock
+		}
+		lock.refs++
+		s.idLocksMutex.Unlock()
+
+		lock.Lock()
+		locks = append(locks, lock)
+		lockedIDs = append(lockedIDs, id)
+	}
+
+	return func() {
+		for i, lock := range locks {
+			lock.Unlock()
+
+			s.idLocksMutex.Lock()
+			lock.refs--
+			if lock.refs == 0 {
+				delete(s.idLocks, lockedIDs[i])
+			}
+			s.idLocksMutex.Unlock()
+		}
+	}
+}
+
+// set caches the encrypted data keys of id, or that id is missing from the store if encryptedDataKeys is nil
+func (s *CachingStore) set(id string, encryptedDataKeys *EncryptedDataKeys) {
+	expiration := s.expiration
+	if encryptedDataKeys == nil {
+		expiration = s.negativeExpiration
+	}
+
+	if expiration <= 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry := &cacheEntry{id, encryptedDataKeys, time.Now().Add(expiration)}
+	if element, ok := s.entries[id]; ok {
+		element.Value = entry
+		s.lru.MoveToFront(element)
+		return
+	}
+
+	s.entries[id] = s.lru.PushFront(entry)
+	for s.lru.Len() > s.maxEntries {
+		s.remove(s.lru.Back())
+		atomic.AddUint64(&s.evictions, 1)
+	}
+}
+
+func (s *CachingStore) delete(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if element, ok := s.entries[id]; ok {
+		s.remove(element)
+	}
+}
+
+// remove must be called with the mutex held
+func (s *CachingStore) remove(element *list.Element) {
+	s.lru.Remove(element)
+	delete(s.entries, element.Value.(*cacheEntry).id)
+}
+
+func (s *CachingStore) cleanUpPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.mutex.Lock()
+		now := time.Now()
+		for _, element := range s.entries {
+			if now.After(element.Value.(*cacheEntry).expiresAt) {
+				s.remove(element)
+			}
+		}
+		s.mutex.Unlock()
+
+		logger.Debugf("cache stats: %+v", s.Stats())
+	}
+}
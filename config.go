@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"net/url"
 
+	"github.com/aws/aws-sdk-go/aws"
 	logger "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
@@ -11,6 +13,13 @@ import (
 type ServerConfig struct {
 	Port       string
 	APIVersion string `mapstructure:"api_version"`
+
+	// GRPCPort is the port the gRPC API is served on. The gRPC API is disabled if it is empty.
+	GRPCPort string `mapstructure:"grpc_port"`
+
+	// CreateMissingKeys makes key lookups create a key for an id that does not exist, unless a request says otherwise.
+	// If false, looking up an unknown id fails with a not found error and keys are only created explicitly.
+	CreateMissingKeys bool `mapstructure:"create_missing_keys"`
 }
 
 // LoggerConfig represents the configuration needed for logging
@@ -20,17 +29,221 @@ type LoggerConfig struct {
 
 // KMSConfig contains information for KMS services
 type KMSConfig struct {
+	// Regions and KeyIds configure an AWS KMS backend per region, named after the region.
+	// They are ignored if Backends is set.
 	Regions            []string
 	KeyIds             map[string]*string `mapstructure:"key_ids"`
 	DataKeySizeInBytes int64              `mapstructure:"data_key_size_in_bytes"`
+
+	// Backends are the key-wrapping backends data keys are encrypted with, in the order they are tried
+	Backends []WrappingBackendConfig `mapstructure:"backends"`
+
+	// MinimumRegionsForKeyCreation is the number of regions that must successfully encrypt
+	// a newly created data key for the creation to succeed. Zero means every region.
+	MinimumRegionsForKeyCreation int `mapstructure:"minimum_regions_for_key_creation"`
+
+	// BatchConcurrency is the number of ids of a batch request that are decrypted or created concurrently
+	BatchConcurrency int `mapstructure:"batch_concurrency"`
+}
+
+// WrappingBackendConfig describes a key-wrapping backend, configured by a [[kms.backends]] entry
+type WrappingBackendConfig struct {
+	// Name identifies the backend; encrypted data keys are stored under it, so it must not change
+	Name string `mapstructure:"name"`
+
+	// Type is the kind of backend; see the WrappingBackend constants
+	Type string `mapstructure:"type"`
+
+	// Region and KeyID are the region and key id (or alias) of an AWS KMS backend
+	Region string `mapstructure:"region"`
+	KeyID  string `mapstructure:"key_id"`
+
+	// MasterKeyFile or MasterKeyEnv is the file or environment variable a local backend loads its master keys from
+	// (see NewLocalKeyWrapper for their format)
+	MasterKeyFile string `mapstructure:"master_key_file"`
+	MasterKeyEnv  string `mapstructure:"master_key_env"`
+
+	// MasterKeyVersion is the version of the master key a local backend wraps new data keys with; 0 means the highest
+	MasterKeyVersion int `mapstructure:"master_key_version"`
+
+	// Address, Namespace, Mount and KeyName locate the Transit key of a Vault backend; Mount defaults to "transit"
+	Address   string `mapstructure:"address"`
+	Namespace string `mapstructure:"namespace"`
+	Mount     string `mapstructure:"mount"`
+	KeyName   string `mapstructure:"key_name"`
+
+	// AuthMethod is how a Vault backend authenticates: "token" (the default) with Token, or the VAULT_TOKEN
+	// environment variable if it is empty, or "approle" with RoleID and SecretID against AppRoleMount ("approle" by default)
+	AuthMethod   string `mapstructure:"auth_method"`
+	Token        string `mapstructure:"token"`
+	RoleID       string `mapstructure:"role_id"`
+	SecretID     string `mapstructure:"secret_id"`
+	AppRoleMount string `mapstructure:"approle_mount"`
+
+	// TLSCAFile, if set, is the CA bundle the server certificate of a Vault or webhook backend is verified with
+	TLSCAFile        string `mapstructure:"tls_ca_file"`
+	TimeoutInSeconds int    `mapstructure:"timeout_in_seconds"`
+
+	// ModulePath is the PKCS#11 module (shared library) of a PKCS#11 backend. Its token is the one labeled
+	// TokenLabel, or the one in Slot if TokenLabel is empty, and KeyLabel is the label of its AES key.
+	ModulePath string `mapstructure:"module_path"`
+	TokenLabel string `mapstructure:"token_label"`
+	Slot       uint   `mapstructure:"slot"`
+	KeyLabel   string `mapstructure:"key_label"`
+
+	// the user PIN of the token of a PKCS#11 backend is PIN, or read from PINFile or the environment variable PINEnv
+	PIN     string `mapstructure:"pin"`
+	PINFile string `mapstructure:"pin_file"`
+	PINEnv  string `mapstructure:"pin_env"`
+
+	// MaxSessions is the number of sessions a PKCS#11 backend opens with the token at most
+	MaxSessions int `mapstructure:"max_sessions"`
+
+	// GenerateURL, WrapURL and UnwrapURL are the endpoints of a webhook backend (see WebhookKeyWrapper);
+	// without GenerateURL, data keys are generated by RKMS and wrapped with WrapURL
+	GenerateURL string `mapstructure:"generate_url"`
+	WrapURL     string `mapstructure:"wrap_url"`
+	UnwrapURL   string `mapstructure:"unwrap_url"`
+
+	// TLSCertFile and TLSKeyFile, if set, are the client certificate and key a webhook backend authenticates with
+	TLSCertFile string `mapstructure:"tls_cert_file"`
+	TLSKeyFile  string `mapstructure:"tls_key_file"`
+
+	// MaxAttempts is how many times a webhook backend tries a call that failed temporarily, backing off
+	// RetryBackoffInMilliseconds before the first retry and twice as long before every following one
+	MaxAttempts                int `mapstructure:"max_attempts"`
+	RetryBackoffInMilliseconds int `mapstructure:"retry_backoff_in_milliseconds"`
+}
+
+// WrappingBackends returns the configured key-wrapping backends, or an AWS KMS backend
+// for each of Regions if none is configured
+func (c KMSConfig) WrappingBackends() []WrappingBackendConfig {
+	if len(c.Backends) > 0 {
+		return c.Backends
+	}
+
+	backends := make([]WrappingBackendConfig, len(c.Regions))
+	for i, region := range c.Regions {
+		backends[i] = WrappingBackendConfig{
+			Name:   region,
+			Type:   WrappingBackendAWSKMS,
+			Region: region,
+			KeyID:  aws.StringValue(c.KeyIds[region]),
+		}
+	}
+
+	return backends
+}
+
+// StoreConfig selects the key/value store used by RKMS
+type StoreConfig struct {
+	// Type is the kind of store; see the StoreType constants
+	Type string `mapstructure:"type"`
+
+	// MirrorType, if set, is the kind of a second store every write is mirrored to (see MirrorStore).
+	// It is configured by its own section, like the primary store.
+	MirrorType string `mapstructure:"mirror_type"`
+
+	// ReconcileIntervalInMinutes is how often ids missing from either store are copied over (0 disables it)
+	ReconcileIntervalInMinutes int `mapstructure:"reconcile_interval_in_minutes"`
 }
 
 // DynamoDBConfig contains information for DynamoDB used for RKMS
 type DynamoDBConfig struct {
-	Region               string `mapstructure:"region"`
-	TableName            string `mapstructure:"table_name"`
-	CacheExpiration      int    `mapstructure:"cache_expiration_in_minutes"`
-	CacheCleanupInterval int    `mapstructure:"cache_cleanup_internal_in_minutes"`
+	// Region is the primary replica of the table, which conditional writes go to
+	Region    string `mapstructure:"region"`
+	TableName string `mapstructure:"table_name"`
+
+	// CacheExpiration and CacheCleanupInterval are deprecated; the [cache] section is used instead
+	CacheExpiration      int `mapstructure:"cache_expiration_in_minutes"`
+	CacheCleanupInterval int `mapstructure:"cache_cleanup_internal_in_minutes"`
+
+	// ReplicaRegions are the other regions of a global table, in the order reads fail over to them
+	ReplicaRegions []string `mapstructure:"replica_regions"`
+
+	// FailoverWrites lets repairs and deletes fail over to the replicas too when the primary fails.
+	// Data keys and their new versions are only ever created in the primary, since global tables resolve
+	// concurrent writes in different regions with last writer wins and a created key could be silently replaced.
+	FailoverWrites bool `mapstructure:"failover_writes"`
+}
+
+// CacheConfig contains information for caching encrypted data keys in memory in front of the store
+type CacheConfig struct {
+	// ExpirationInMinutes is how long encrypted data keys are cached (0 disables caching)
+	ExpirationInMinutes int `mapstructure:"expiration_in_minutes"`
+
+	// NegativeExpirationInSeconds is how long ids missing from the store are remembered as missing (0 disables it)
+	NegativeExpirationInSeconds int `mapstructure:"negative_expiration_in_seconds"`
+
+	// MaxEntries is the number of ids cached before the least recently used ones are evicted
+	MaxEntries               int `mapstructure:"max_entries"`
+	CleanupIntervalInMinutes int `mapstructure:"cleanup_interval_in_minutes"`
+}
+
+// RedisConfig contains information for Redis used for RKMS
+type RedisConfig struct {
+	// Addresses is the host:port of a single server, of the sentinels if MasterName is set,
+	// or of the seed nodes of a cluster if there are several
+	Addresses  []string `mapstructure:"addresses"`
+	MasterName string   `mapstructure:"master_name"`
+	Password   string   `mapstructure:"password"`
+	DB         int      `mapstructure:"db"`
+
+	// KeyPrefix is prepended to every id to build its Redis key
+	KeyPrefix string `mapstructure:"key_prefix"`
+
+	TLS           bool   `mapstructure:"tls"`
+	TLSCAFile     string `mapstructure:"tls_ca_file"`
+	TLSServerName string `mapstructure:"tls_server_name"`
+}
+
+// SQLConfig contains information for the SQL database used for RKMS
+type SQLConfig struct {
+	// Driver is one of "postgres", "mysql" or "sqlite3"
+	Driver string `mapstructure:"driver"`
+
+	// DSN is the data source name passed to the driver, e.g. a connection URL or a file path for SQLite
+	DSN                string `mapstructure:"dsn"`
+	TableName          string `mapstructure:"table_name"`
+	MaxOpenConnections int    `mapstructure:"max_open_connections"`
+}
+
+// BoltConfig contains information for the embedded bbolt database used for RKMS
+type BoltConfig struct {
+	// Path is the database file; it is created if it does not exist
+	Path                 string `mapstructure:"path"`
+	LockTimeoutInSeconds int    `mapstructure:"lock_timeout_in_seconds"`
+
+	// BackupPath, if set, is where a copy of the database is written every BackupIntervalInMinutes
+	BackupPath              string `mapstructure:"backup_path"`
+	BackupIntervalInMinutes int    `mapstructure:"backup_interval_in_minutes"`
+}
+
+// ObjectStoreConfig contains information for the object storage used for RKMS
+type ObjectStoreConfig struct {
+	// Backend is "s3" for an S3-compatible bucket or "directory" for a local directory
+	Backend   string `mapstructure:"backend"`
+	Directory string `mapstructure:"directory"`
+
+	Bucket string `mapstructure:"bucket"`
+	Prefix string `mapstructure:"prefix"`
+	Region string `mapstructure:"region"`
+
+	// Endpoint and ForcePathStyle point the S3 client at another S3-compatible service, such as MinIO
+	Endpoint       string `mapstructure:"endpoint"`
+	ForcePathStyle bool   `mapstructure:"force_path_style"`
+
+	// AccessKeyID and SecretAccessKey are used instead of the default AWS credentials if set
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+}
+
+// RepairConfig contains information for repairing missing or corrupted encrypted data keys in the background
+type RepairConfig struct {
+	Enabled          bool `mapstructure:"enabled"`
+	Workers          int  `mapstructure:"workers"`
+	QueueSize        int  `mapstructure:"queue_size"`
+	TimeoutInSeconds int  `mapstructure:"timeout_in_seconds"`
 }
 
 // Configuration represents all the configuration information this application needss
@@ -38,7 +251,42 @@ type Configuration struct {
 	Server   ServerConfig
 	Logger   LoggerConfig
 	KMS      KMSConfig
+	Store    StoreConfig
+	Cache    CacheConfig
 	DynamoDB DynamoDBConfig
+	Redis    RedisConfig
+	SQL      SQLConfig
+	Bolt     BoltConfig
+	Repair   RepairConfig
+
+	// ObjectStore is configured by the [object_store] section
+	ObjectStore ObjectStoreConfig `mapstructure:"object_store"`
+}
+
+// redactedValue replaces secrets when a configuration is logged
+const redactedValue = "REDACTED"
+
+// redacted returns a copy of the configuration without its secrets, to be logged
+func (c Configuration) redacted() Configuration {
+	c.KMS.Backends = append([]WrappingBackendConfig{}, c.KMS.Backends...)
+	for i := range c.KMS.Backends {
+		backend := &c.KMS.Backends[i]
+		redact(&backend.Token)
+		redact(&backend.SecretID)
+		redact(&backend.PIN)
+	}
+
+	redact(&c.Redis.Password)
+	redact(&c.SQL.DSN) //may hold a password
+	redact(&c.ObjectStore.SecretAccessKey)
+	return c
+}
+
+// redact replaces the given secret, unless it is not set
+func redact(secret *string) {
+	if *secret != "" {
+		*secret = redactedValue
+	}
 }
 
 // LoadConfiguration loads config file into memory and creates a Configuration object out of the information
@@ -46,6 +294,8 @@ func LoadConfiguration() *Configuration {
 	viper.SetConfigName("config")
 	viper.AddConfigPath(".")
 	viper.SetConfigType("toml")
+	viper.SetDefault("server.create_missing_keys", true)
+	viper.SetDefault("store.type", StoreTypeDynamoDB)
 
 	if err := viper.ReadInConfig(); err != nil {
 		logger.Fatalf("fatal error while reading config file: %s", err)
@@ -53,16 +303,30 @@ func LoadConfiguration() *Configuration {
 
 	config := new(Configuration)
 	viper.Unmarshal(&config)
-	logger.Infof("loaded configuration: %+v\n", *config)
+	logger.Infof("loaded configuration: %+v\n", config.redacted())
+
+	if !viper.IsSet("cache") && config.DynamoDB.CacheExpiration > 0 {
+		logger.Warnln("cache settings under [dynamodb] are deprecated; move them to the [cache] section")
+		config.Cache.ExpirationInMinutes = config.DynamoDB.CacheExpiration
+		config.Cache.CleanupIntervalInMinutes = config.DynamoDB.CacheCleanupInterval
+	}
 
 	if err := verifyKMSConfig(config.KMS); err != nil {
 		logger.Fatal(err)
 	}
 
+	if err := verifyStoreConfig(config.Store); err != nil {
+		logger.Fatal(err)
+	}
+
 	return config
 }
 
 func verifyKMSConfig(kmsConfig KMSConfig) error {
+	if len(kmsConfig.Backends) > 0 {
+		return verifyWrappingBackendConfigs(kmsConfig)
+	}
+
 	if len(kmsConfig.Regions) < MinimumKMSRegions {
 		return fmt.Errorf("a minimmum of %d KMS regions is required", MinimumKMSRegions)
 	}
@@ -77,5 +341,105 @@ func verifyKMSConfig(kmsConfig KMSConfig) error {
 		}
 	}
 
+	if kmsConfig.MinimumRegionsForKeyCreation < 0 || kmsConfig.MinimumRegionsForKeyCreation > len(kmsConfig.Regions) {
+		return fmt.Errorf("minimum regions for key creation (%d) must be between 0 (all) and the number of KMS regions (%d)", kmsConfig.MinimumRegionsForKeyCreation, len(kmsConfig.Regions))
+	}
+
 	return nil
 }
+
+func verifyWrappingBackendConfigs(kmsConfig KMSConfig) error {
+	if len(kmsConfig.Backends) < MinimumKMSRegions {
+		return fmt.Errorf("a minimmum of %d key-wrapping backends is required", MinimumKMSRegions)
+	}
+
+	names := make(map[string]bool)
+	for _, backend := range kmsConfig.Backends {
+		if backend.Name == "" {
+			return fmt.Errorf("every key-wrapping backend needs a name")
+		}
+
+		if names[backend.Name] {
+			return fmt.Errorf("key-wrapping backend %s is configured more than once", backend.Name)
+		}
+		names[backend.Name] = true
+
+		switch backend.Type {
+		case WrappingBackendAWSKMS:
+			if backend.Region == "" || backend.KeyID == "" {
+				return fmt.Errorf("key-wrapping backend %s needs a region and a key_id", backend.Name)
+			}
+		case WrappingBackendLocal:
+			if (backend.MasterKeyFile == "") == (backend.MasterKeyEnv == "") {
+				return fmt.Errorf("key-wrapping backend %s needs either a master_key_file or a master_key_env", backend.Name)
+			}
+		case WrappingBackendVault:
+			if backend.Address == "" || backend.KeyName == "" {
+				return fmt.Errorf("key-wrapping backend %s needs an address and a key_name", backend.Name)
+			}
+		case WrappingBackendPKCS11:
+			if backend.ModulePath == "" || backend.KeyLabel == "" {
+				return fmt.Errorf("key-wrapping backend %s needs a module_path and a key_label", backend.Name)
+			}
+
+			if len(backend.KeyLabel) > 255 {
+				return fmt.Errorf("key_label of key-wrapping backend %s is longer than 255 bytes", backend.Name)
+			}
+
+			if (backend.PIN != "" && backend.PINFile != "") || (backend.PINFile != "" && backend.PINEnv != "") || (backend.PIN != "" && backend.PINEnv != "") {
+				return fmt.Errorf("key-wrapping backend %s needs only one of pin, pin_file and pin_env", backend.Name)
+			}
+		case WrappingBackendWebhook:
+			if backend.WrapURL == "" || backend.UnwrapURL == "" {
+				return fmt.Errorf("key-wrapping backend %s needs a wrap_url and an unwrap_url", backend.Name)
+			}
+
+			for _, rawURL := range []string{backend.GenerateURL, backend.WrapURL, backend.UnwrapURL} {
+				if u, err := url.Parse(rawURL); rawURL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+					return fmt.Errorf("%q of key-wrapping backend %s is not an http or https URL", rawURL, backend.Name)
+				}
+			}
+
+			if (backend.TLSCertFile == "") != (backend.TLSKeyFile == "") {
+				return fmt.Errorf("key-wrapping backend %s needs both a tls_cert_file and a tls_key_file", backend.Name)
+			}
+		default:
+			return fmt.Errorf("unknown type %q of key-wrapping backend %s", backend.Type, backend.Name)
+		}
+	}
+
+	if kmsConfig.MinimumRegionsForKeyCreation < 0 || kmsConfig.MinimumRegionsForKeyCreation > len(kmsConfig.Backends) {
+		return fmt.Errorf("minimum regions for key creation (%d) must be between 0 (all) and the number of key-wrapping backends (%d)", kmsConfig.MinimumRegionsForKeyCreation, len(kmsConfig.Backends))
+	}
+
+	return nil
+}
+
+func verifyStoreConfig(storeConfig StoreConfig) error {
+	if !isStoreType(storeConfig.Type) {
+		return fmt.Errorf("unknown store type %q", storeConfig.Type)
+	}
+
+	if storeConfig.MirrorType == "" {
+		return nil
+	}
+
+	if !isStoreType(storeConfig.MirrorType) {
+		return fmt.Errorf("unknown mirror store type %q", storeConfig.MirrorType)
+	}
+
+	if storeConfig.MirrorType == storeConfig.Type {
+		return fmt.Errorf("mirror store type must differ from store type %q", storeConfig.Type)
+	}
+
+	return nil
+}
+
+func isStoreType(storeType string) bool {
+	switch storeType {
+	case StoreTypeDynamoDB, StoreTypeMemory, StoreTypeRedis, StoreTypeSQL, StoreTypeBolt, StoreTypeObject:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+type decryptResponse struct {
+	ID        string `json:"id"`
+	Plaintext []byte `json:"plaintext"`
+}
+
+// ConstructDecryptResponse creates a server response for POST /decrypt endpoint
+func ConstructDecryptResponse(id string, plaintext []byte) string {
+	resp := decryptResponse{id, plaintext}
+	b, _ := json.Marshal(resp)
+	return string(b)
+}
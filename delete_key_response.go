@@ -0,0 +1,17 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+type deleteKeyResponse struct {
+	ID      string `json:"id"`
+	Deleted bool   `json:"deleted"`
+}
+
+// ConstructDeleteKeyResponse creates a server response for DELETE /key endpoint
+func ConstructDeleteKeyResponse(id string) string {
+	resp := deleteKeyResponse{id, true}
+	b, _ := json.Marshal(resp)
+	return string(b)
+}
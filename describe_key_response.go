@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type describeKeyVersion struct {
+	Version        int               `json:"version"`
+	Regions        []string          `json:"regions"`
+	Incomplete     bool              `json:"incomplete,omitempty"`
+	CreatedAt      *time.Time        `json:"created_at,omitempty"`
+	KeySizeInBytes int               `json:"key_size_in_bytes,omitempty"`
+	KMSKeyIDs      map[string]string `json:"kms_key_ids,omitempty"`
+}
+
+type describeKeyResponse struct {
+	ID             string               `json:"id"`
+	FormatVersion  int                  `json:"format_version"`
+	CurrentVersion int                  `json:"current_version"`
+	Versions       []describeKeyVersion `json:"versions"`
+}
+
+// ConstructDescribeKeyResponse creates a server response for GET /key/metadata endpoint
+func ConstructDescribeKeyResponse(description *DataKeyDescription) string {
+	resp := describeKeyResponse{
+		ID:             description.ID,
+		FormatVersion:  description.FormatVersion,
+		CurrentVersion: description.CurrentVersion,
+		Versions:       make([]describeKeyVersion, 0, len(description.Versions)),
+	}
+
+	for _, version := range description.Versions {
+		respVersion := describeKeyVersion{
+			Version:        version.Version,
+			Regions:        version.Regions,
+			Incomplete:     version.Incomplete,
+			KeySizeInBytes: version.Metadata.KeySizeInBytes,
+			KMSKeyIDs:      version.Metadata.KMSKeyIDs,
+		}
+
+		if !version.Metadata.CreatedAt.IsZero() {
+			createdAt := version.Metadata.CreatedAt
+			respVersion.CreatedAt = &createdAt
+		}
+
+		resp.Versions = append(resp.Versions, respVersion)
+	}
+
+	b, _ := json.Marshal(resp)
+	return string(b)
+}
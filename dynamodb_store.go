@@ -2,6 +2,11 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -9,45 +14,155 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
-	cache "github.com/patrickmn/go-cache"
 	logger "github.com/sirupsen/logrus"
 )
 
-// DynamoDBStore - a DynamoDB implementation of a key/value store for KMS-related data
+// DynamoDBStore - a DynamoDB implementation of a key/value store for KMS-related data.
+// The table may be a global table, in which case reads fail over across its replicas in order
+// and writes go to the primary replica (the first one) unless write failover is enabled.
 type DynamoDBStore struct {
-	tableName *string
-	client    *dynamodb.DynamoDB
-	keysCache *cache.Cache
+	tableName      *string
+	replicas       []dynamoDBReplica
+	failoverWrites bool
+
+	// ids whose item in an older format was already tried to be upgraded by this process
+	upgradeAttempts sync.Map
+}
+
+// dynamoDBReplica - a client for the table in one of the regions it is replicated to
+type dynamoDBReplica struct {
+	region string
+	client *dynamodb.DynamoDB
 }
 
 type item struct {
-	ID   string            `json:"id"`
-	Keys map[string]string `json:"keys"`
+	ID             string                 `json:"id"`
+	FormatVersion  int                    `json:"format_version,omitempty"`
+	CurrentVersion int                    `json:"current_version,omitempty"`
+	Versions       map[string]itemVersion `json:"versions,omitempty"`
+
+	// Keys and Incomplete hold the single data key of items written before data keys were versioned.
+	// Such items are upgraded to version 1 when they are read.
+	Keys       map[string]string `json:"keys,omitempty"`
+	Incomplete bool              `json:"incomplete,omitempty"`
 }
 
-// NewDynamoDBStore creates a new DynamoDBStore instance
+type itemVersion struct {
+	Keys       map[string]string `json:"keys"`
+	Incomplete bool              `json:"incomplete,omitempty"`
+
+	// the metadata of the version, missing from items in the legacy format.
+	// KMSKeyIDs is always written, so the key ids of repaired regions can be set in place.
+	CreatedAt      *time.Time        `json:"created_at,omitempty"`
+	KeySizeInBytes int               `json:"key_size_in_bytes,omitempty"`
+	KMSKeyIDs      map[string]string `json:"kms_key_ids"`
+}
+
+func newItemVersion(keys map[string]string, incomplete bool, metadata DataKeyMetadata) itemVersion {
+	version := itemVersion{
+		Keys:           keys,
+		Incomplete:     incomplete,
+		KeySizeInBytes: metadata.KeySizeInBytes,
+		KMSKeyIDs:      metadata.KMSKeyIDs,
+	}
+
+	if !metadata.CreatedAt.IsZero() {
+		createdAt := metadata.CreatedAt
+		version.CreatedAt = &createdAt
+	}
+
+	if version.KMSKeyIDs == nil {
+		version.KMSKeyIDs = make(map[string]string)
+	}
+
+	return version
+}
+
+// NewDynamoDBStore creates a new DynamoDBStore instance.
+// The configured region is the primary replica, followed by the replica regions in the configured order.
 func NewDynamoDBStore(dynamoDBConfig DynamoDBConfig) (*DynamoDBStore, error) {
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(dynamoDBConfig.Region),
-	})
+	regions := []string{dynamoDBConfig.Region}
+	for _, region := range dynamoDBConfig.ReplicaRegions {
+		if region != dynamoDBConfig.Region {
+			regions = append(regions, region)
+		}
+	}
 
-	if err != nil {
-		logger.Print(err)
-		return nil, err
+	replicas := make([]dynamoDBReplica, 0, len(regions))
+	for _, region := range regions {
+		sess, err := session.NewSession(&aws.Config{
+			Region: aws.String(region),
+		})
+
+		if err != nil {
+			logger.Print(err)
+			return nil, err
+		}
+
+		replicas = append(replicas, dynamoDBReplica{region, dynamodb.New(sess)})
 	}
 
-	client := dynamodb.New(sess)
-	keysCache := cache.New(time.Duration(dynamoDBConfig.CacheExpiration)*time.Minute, time.Duration(dynamoDBConfig.CacheCleanupInterval)*time.Minute)
-	return &DynamoDBStore{aws.String(dynamoDBConfig.TableName), client, keysCache}, nil
+	return &DynamoDBStore{tableName: aws.String(dynamoDBConfig.TableName), replicas: replicas, failoverWrites: dynamoDBConfig.FailoverWrites}, nil
+}
+
+// read calls the given DynamoDB operation on each replica in order until one of them answers
+func (s *DynamoDBStore) read(ctx context.Context, operation string, call func(*dynamodb.DynamoDB) error) error {
+	return s.failOver(ctx, operation, s.replicas, call)
 }
 
-// GetEncryptedDataKeys retrieves the encrypted data keys for the given id
-func (s *DynamoDBStore) GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error) {
-	//check if id is cached
-	if keys, found := s.keysCache.Get(id); found {
-		return *keys.(*map[string]string), nil
+// write calls the given DynamoDB operation on the primary replica,
+// and on the other replicas in order if it fails and write failover is enabled
+func (s *DynamoDBStore) write(ctx context.Context, operation string, call func(*dynamodb.DynamoDB) error) error {
+	if s.failoverWrites {
+		return s.failOver(ctx, operation, s.replicas, call)
 	}
 
+	return s.failOver(ctx, operation, s.replicas[:1], call)
+}
+
+// create calls the given DynamoDB operation that creates a data key on the primary replica only, even if write failover
+// is enabled: global tables resolve concurrent writes in different regions with last writer wins, so a data key
+// created in a replica could silently replace one created first in the primary, along with every ciphertext under it
+func (s *DynamoDBStore) create(ctx context.Context, operation string, call func(*dynamodb.DynamoDB) error) error {
+	return s.failOver(ctx, operation, s.replicas[:1], call)
+}
+
+func (s *DynamoDBStore) failOver(ctx context.Context, operation string, replicas []dynamoDBReplica, call func(*dynamodb.DynamoDB) error) error {
+	var err error
+	for i, replica := range replicas {
+		err = call(replica.client)
+		if !shouldFailOverDynamoDBReplica(ctx, err) {
+			return err
+		}
+
+		if i+1 < len(replicas) {
+			logger.Warnf("failed to %s in DynamoDB replica %s, failing over to %s: %s", operation, replica.region, replicas[i+1].region, err)
+		} else {
+			logger.Warnf("failed to %s in DynamoDB replica %s: %s", operation, replica.region, err)
+		}
+	}
+
+	return err
+}
+
+// shouldFailOverDynamoDBReplica reports whether the given error of a replica may not happen on another one
+func shouldFailOverDynamoDBReplica(ctx context.Context, err error) bool {
+	if err == nil || isCancelledError(ctx, err) {
+		return false
+	}
+
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case dynamodb.ErrCodeConditionalCheckFailedException, "ValidationException":
+			return false
+		}
+	}
+
+	return true
+}
+
+// GetEncryptedDataKeys retrieves every version of the encrypted data keys for the given id
+func (s *DynamoDBStore) GetEncryptedDataKeys(ctx context.Context, id string) (*EncryptedDataKeys, error) {
 	input := &dynamodb.GetItemInput{
 		TableName: s.tableName,
 		Key: map[string]*dynamodb.AttributeValue{
@@ -58,33 +173,282 @@ func (s *DynamoDBStore) GetEncryptedDataKeys(ctx context.Context, id string) (ma
 		ConsistentRead: aws.Bool(true),
 	}
 
-	result, err := s.client.GetItemWithContext(ctx, input)
+	var result *dynamodb.GetItemOutput
+	err := s.read(ctx, "get item", func(client *dynamodb.DynamoDB) error {
+		var err error
+		result, err = client.GetItemWithContext(ctx, input)
+		return err
+	})
 	if err != nil {
 		logger.Print(err)
-		return nil, err
+		return nil, newStoreError(ctx, err)
 	}
 
 	if result.Item == nil {
 		return nil, nil
 	}
 
+	return s.unmarshalEncryptedDataKeys(ctx, id, result.Item)
+}
+
+// MaxDynamoDBBatchGetItemKeys is the maximum number of keys DynamoDB accepts in a single BatchGetItem request
+const MaxDynamoDBBatchGetItemKeys = 100
+
+// MaxDynamoDBBatchGetItemTries is the number of attempts to read unprocessed keys of a BatchGetItem request before quitting
+const MaxDynamoDBBatchGetItemTries = 5
+
+// GetEncryptedDataKeysBatch retrieves every version of the encrypted data keys for each of the given ids
+// using BatchGetItem. Ids that do not exist in the store are left out of the returned map.
+func (s *DynamoDBStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]*EncryptedDataKeys, error) {
+	encryptedDataKeysByID := make(map[string]*EncryptedDataKeys)
+
+	var keys []map[string]*dynamodb.AttributeValue
+	for _, id := range ids {
+		keys = append(keys, map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		})
+	}
+
+	for start := 0; start < len(keys); start += MaxDynamoDBBatchGetItemKeys {
+		end := start + MaxDynamoDBBatchGetItemKeys
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		requestItems := map[string]*dynamodb.KeysAndAttributes{
+			*s.tableName: {
+				Keys:           keys[start:end],
+				ConsistentRead: aws.Bool(true),
+			},
+		}
+
+		for tries := 0; len(requestItems) > 0; tries++ {
+			if tries == MaxDynamoDBBatchGetItemTries {
+				//DynamoDB leaves keys unprocessed when the table's provisioned throughput is exceeded
+				return nil, ThrottledError{fmt.Errorf("failed to read every id from DynamoDB after %d tries", tries)}
+			}
+
+			if tries > 0 { //back off before retrying the unprocessed keys
+				select {
+				case <-time.After(time.Duration(50<<uint(tries)) * time.Millisecond):
+				case <-ctx.Done():
+					return nil, CancelledError{ctx.Err()}
+				}
+			}
+
+			input := &dynamodb.BatchGetItemInput{
+				RequestItems: requestItems,
+			}
+
+			var result *dynamodb.BatchGetItemOutput
+			err := s.read(ctx, "batch get items", func(client *dynamodb.DynamoDB) error {
+				var err error
+				result, err = client.BatchGetItemWithContext(ctx, input)
+				return err
+			})
+			if err != nil {
+				logger.Print(err)
+				return nil, newStoreError(ctx, err)
+			}
+
+			for _, marshalledItem := range result.Responses[*s.tableName] {
+				id := marshalledItem["id"]
+				if id == nil || id.S == nil {
+					continue
+				}
+
+				encryptedDataKeys, err := s.unmarshalEncryptedDataKeys(ctx, *id.S, marshalledItem)
+				if err != nil {
+					return nil, err
+				}
+
+				encryptedDataKeysByID[*id.S] = encryptedDataKeys
+			}
+
+			requestItems = result.UnprocessedKeys
+		}
+	}
+
+	return encryptedDataKeysByID, nil
+}
+
+// unmarshalEncryptedDataKeys converts a DynamoDB item into EncryptedDataKeys
+func (s *DynamoDBStore) unmarshalEncryptedDataKeys(ctx context.Context, id string, marshalledItem map[string]*dynamodb.AttributeValue) (*EncryptedDataKeys, error) {
 	item := item{}
-	err = dynamodbattribute.UnmarshalMap(result.Item, &item)
+	err := dynamodbattribute.UnmarshalMap(marshalledItem, &item)
 	if err != nil {
 		logger.Print(err)
 		return nil, err
 	}
 
-	s.keysCache.Set(id, &item.Keys, cache.DefaultExpiration)
-	return item.Keys, nil
+	formatVersion := item.FormatVersion
+	if formatVersion == 0 {
+		formatVersion = LegacyItemFormatVersion
+	}
+
+	if len(item.Versions) == 0 {
+		item, err = s.upgradeUnversionedItem(ctx, item)
+		if err != nil {
+			return nil, err
+		}
+	} else if item.FormatVersion == 0 {
+		s.upgradeLegacyItem(ctx, item)
+	}
+
+	encryptedDataKeys := &EncryptedDataKeys{
+		FormatVersion:  formatVersion,
+		CurrentVersion: item.CurrentVersion,
+		Versions:       make(map[int]EncryptedDataKeysVersion),
+	}
+	for versionName, version := range item.Versions {
+		versionNumber, err := strconv.Atoi(versionName)
+		if err != nil {
+			logger.Print(err)
+			return nil, err
+		}
+
+		metadata := DataKeyMetadata{KeySizeInBytes: version.KeySizeInBytes, KMSKeyIDs: version.KMSKeyIDs}
+		if version.CreatedAt != nil {
+			metadata.CreatedAt = *version.CreatedAt
+		}
+
+		encryptedDataKeys.Versions[versionNumber] = EncryptedDataKeysVersion{
+			Keys:       version.Keys,
+			Incomplete: version.Incomplete,
+			Metadata:   metadata,
+		}
+	}
+
+	return encryptedDataKeys, nil
+}
+
+// shouldUpgrade reports whether the item of id was not tried to be upgraded by this process yet.
+// Upgrades are tried at most once per id, so reads do not keep writing to items that fail to upgrade;
+// those are read in their older format until the process restarts.
+func (s *DynamoDBStore) shouldUpgrade(id string) bool {
+	_, tried := s.upgradeAttempts.LoadOrStore(id, true)
+	return !tried
+}
+
+// upgradeUnversionedItem moves the single data key of an item written before data keys were versioned to version 1,
+// and upgrades the item to the current format.
+// The returned item is always upgraded, but the item in the table only on the first read of id (see shouldUpgrade).
+func (s *DynamoDBStore) upgradeUnversionedItem(ctx context.Context, legacyItem item) (item, error) {
+	upgradedItem := item{
+		ID:             legacyItem.ID,
+		CurrentVersion: 1,
+		Versions: map[string]itemVersion{
+			"1": newItemVersion(legacyItem.Keys, legacyItem.Incomplete, DataKeyMetadata{}),
+		},
+	}
+
+	if !s.shouldUpgrade(legacyItem.ID) {
+		return upgradedItem, nil
+	}
+
+	versions, err := dynamodbattribute.Marshal(upgradedItem.Versions)
+	if err != nil {
+		logger.Print(err)
+		return upgradedItem, err
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: s.tableName,
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(legacyItem.ID),
+			},
+		},
+		UpdateExpression:         aws.String("SET versions = :versions, current_version = :version, format_version = :format REMOVE #keys, incomplete"),
+		ConditionExpression:      aws.String("attribute_exists(#keys) AND attribute_not_exists(versions)"),
+		ExpressionAttributeNames: map[string]*string{"#keys": aws.String("keys")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":versions": versions,
+			":version":  {N: aws.String("1")},
+			":format":   {N: aws.String(strconv.Itoa(CurrentItemFormatVersion))},
+		},
+	}
+
+	//the upgrade is best effort; another server may have upgraded the item meanwhile
+	err = s.write(ctx, "upgrade legacy item", func(client *dynamodb.DynamoDB) error {
+		_, err := client.UpdateItemWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		logger.Warnf("failed to upgrade legacy item for id %q: %s", legacyItem.ID, err)
+	}
+
+	return upgradedItem, nil
+}
+
+// upgradeLegacyItem upgrades an item in the legacy format to the current one, adding an empty map of KMS key ids
+// to each version so repairs can record theirs. Metadata that was never recorded stays missing.
+// The upgrade is best effort and only tried on the first read of id (see shouldUpgrade).
+func (s *DynamoDBStore) upgradeLegacyItem(ctx context.Context, legacyItem item) {
+	if !s.shouldUpgrade(legacyItem.ID) {
+		return
+	}
+
+	names := make(map[string]*string)
+	values := map[string]*dynamodb.AttributeValue{
+		":format": {N: aws.String(strconv.Itoa(CurrentItemFormatVersion))},
+		":empty":  {M: map[string]*dynamodb.AttributeValue{}},
+	}
+	updates := []string{"format_version = :format"}
+
+	versionNames := make([]string, 0, len(legacyItem.Versions))
+	for versionName := range legacyItem.Versions {
+		versionNames = append(versionNames, versionName)
+	}
+	sort.Strings(versionNames)
+
+	for i, versionName := range versionNames {
+		name := fmt.Sprintf("#v%d", i)
+		names[name] = aws.String(versionName)
+		updates = append(updates, fmt.Sprintf("versions.%s.kms_key_ids = if_not_exists(versions.%s.kms_key_ids, :empty)", name, name))
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: s.tableName,
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(legacyItem.ID),
+			},
+		},
+		UpdateExpression:          aws.String("SET " + strings.Join(updates, ", ")),
+		ConditionExpression:       aws.String("attribute_exists(versions) AND attribute_not_exists(format_version)"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}
+
+	err := s.write(ctx, "upgrade legacy item", func(client *dynamodb.DynamoDB) error {
+		_, err := client.UpdateItemWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		logger.Warnf("failed to upgrade legacy item for id %q: %s", legacyItem.ID, err)
+	}
 }
 
-// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id as its first version
 // only if id does not exist in the store already.
 // If the id already exists, an error is returned.
-func (s *DynamoDBStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, encryptedKeysMap map[string]string) error {
-	item := item{ID: id, Keys: encryptedKeysMap}
+func (s *DynamoDBStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, encryptedKeysMap map[string]string, incomplete bool, metadata DataKeyMetadata) error {
+	item := item{
+		ID:             id,
+		FormatVersion:  CurrentItemFormatVersion,
+		CurrentVersion: 1,
+		Versions: map[string]itemVersion{
+			"1": newItemVersion(encryptedKeysMap, incomplete, metadata),
+		},
+	}
 	marshalledItem, err := dynamodbattribute.MarshalMap(item)
+	if err != nil {
+		logger.Print(err)
+		return err
+	}
 
 	conditionExpression := "attribute_not_exists(id)"
 	input := &dynamodb.PutItemInput{
@@ -93,7 +457,10 @@ func (s *DynamoDBStore) SetEncryptedDataKeysConditionally(ctx context.Context, i
 		ConditionExpression: aws.String(conditionExpression),
 	}
 
-	_, err = s.client.PutItemWithContext(ctx, input)
+	err = s.create(ctx, "put item", func(client *dynamodb.DynamoDB) error {
+		_, err := client.PutItemWithContext(ctx, input)
+		return err
+	})
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok {
 			if awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
@@ -102,9 +469,228 @@ func (s *DynamoDBStore) SetEncryptedDataKeysConditionally(ctx context.Context, i
 		}
 
 		logger.Print(err)
+		return newStoreError(ctx, err)
+	}
+
+	return nil
+}
+
+// AddEncryptedDataKeysVersionConditionally adds the encrypted data keys for the given id as a new version
+// and makes it the current version, only if the current version of id is still version-1.
+func (s *DynamoDBStore) AddEncryptedDataKeysVersionConditionally(ctx context.Context, id string, version int, encryptedKeysMap map[string]string, incomplete bool, metadata DataKeyMetadata) error {
+	marshalledVersion, err := dynamodbattribute.Marshal(newItemVersion(encryptedKeysMap, incomplete, metadata))
+	if err != nil {
+		logger.Print(err)
+		return err
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: s.tableName,
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+		UpdateExpression:    aws.String("SET versions.#version = :version, current_version = :current, format_version = :format"),
+		ConditionExpression: aws.String("current_version = :previous"),
+		ExpressionAttributeNames: map[string]*string{
+			"#version": aws.String(strconv.Itoa(version)),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":version":  marshalledVersion,
+			":current":  {N: aws.String(strconv.Itoa(version))},
+			":previous": {N: aws.String(strconv.Itoa(version - 1))},
+			":format":   {N: aws.String(strconv.Itoa(CurrentItemFormatVersion))},
+		},
+	}
+
+	err = s.create(ctx, "add item version", func(client *dynamodb.DynamoDB) error {
+		_, err := client.UpdateItemWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok {
+			if awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+				return s.conditionFailedError(ctx, id)
+			}
+		}
+
+		logger.Print(err)
+		return newStoreError(ctx, err)
+	}
+
+	return nil
+}
+
+// conditionFailedError tells apart an id that was removed from one that was changed meanwhile
+func (s *DynamoDBStore) conditionFailedError(ctx context.Context, id string) error {
+	encryptedDataKeys, err := s.GetEncryptedDataKeys(ctx, id)
+	if err == nil && encryptedDataKeys == nil {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	return ConditionalUpdateFailedStoreError{ID: id}
+}
+
+// UpdateEncryptedDataKeysConditionally sets the encrypted data keys of the regions in keys for the given version of id,
+// only if the current encrypted data key of each of those regions still matches the one in previousKeys.
+// If the condition is not met, a ConditionalUpdateFailedStoreError error is returned.
+func (s *DynamoDBStore) UpdateEncryptedDataKeysConditionally(ctx context.Context, id string, version int, previousKeys map[string]string, keys map[string]string, keyIDs map[string]string, complete bool) error {
+	err := s.updateItem(ctx, id, version, previousKeys, keys, keyIDs, complete)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "ValidationException" && len(keyIDs) > 0 {
+		//versions in the legacy format that were not upgraded yet have no map to set the key ids in
+		logger.Warnf("failed to record KMS key ids of id %q, updating its keys without them: %s", id, err)
+		err = s.updateItem(ctx, id, version, previousKeys, keys, nil, complete)
+	}
+
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok {
+			if awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+				return ConditionalUpdateFailedStoreError{ID: id}
+			}
+		}
+
+		logger.Print(err)
+		return newStoreError(ctx, err)
+	}
+
+	return nil
+}
+
+// updateItem sets the keys, and the key ids if any, of the given regions in a version of the item of id
+func (s *DynamoDBStore) updateItem(ctx context.Context, id string, version int, previousKeys map[string]string, keys map[string]string, keyIDs map[string]string, complete bool) error {
+	regions := make([]string, 0, len(keys))
+	for region := range keys {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+
+	names := map[string]*string{
+		"#version": aws.String(strconv.Itoa(version)),
+		"#keys":    aws.String("keys"),
+	}
+	values := make(map[string]*dynamodb.AttributeValue)
+	updates := make([]string, 0, len(regions))
+	conditions := []string{"attribute_exists(versions.#version)"}
+
+	for i, region := range regions {
+		regionName := fmt.Sprintf("#r%d", i)
+		keyValue := fmt.Sprintf(":k%d", i)
+		names[regionName] = aws.String(region)
+		values[keyValue] = &dynamodb.AttributeValue{S: aws.String(keys[region])}
+		updates = append(updates, fmt.Sprintf("versions.#version.#keys.%s = %s", regionName, keyValue))
+
+		if previousKey, ok := previousKeys[region]; ok {
+			previousValue := fmt.Sprintf(":p%d", i)
+			values[previousValue] = &dynamodb.AttributeValue{S: aws.String(previousKey)}
+			conditions = append(conditions, fmt.Sprintf("versions.#version.#keys.%s = %s", regionName, previousValue))
+		} else {
+			conditions = append(conditions, fmt.Sprintf("attribute_not_exists(versions.#version.#keys.%s)", regionName))
+		}
+
+		if keyID, ok := keyIDs[region]; ok {
+			keyIDValue := fmt.Sprintf(":i%d", i)
+			values[keyIDValue] = &dynamodb.AttributeValue{S: aws.String(keyID)}
+			updates = append(updates, fmt.Sprintf("versions.#version.kms_key_ids.%s = %s", regionName, keyIDValue))
+		}
+	}
+
+	updateExpression := "SET " + strings.Join(updates, ", ")
+	if complete {
+		updateExpression += " REMOVE versions.#version.incomplete"
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: s.tableName,
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+		UpdateExpression:          aws.String(updateExpression),
+		ConditionExpression:       aws.String(strings.Join(conditions, " AND ")),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}
+
+	return s.write(ctx, "update item", func(client *dynamodb.DynamoDB) error {
+		_, err := client.UpdateItemWithContext(ctx, input)
+		return err
+	})
+}
+
+// ListIDs returns up to limit ids stored after the given cursor, along with the cursor to continue from.
+// The cursor is the last id returned; ids are listed in DynamoDB's scan order.
+func (s *DynamoDBStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	input := &dynamodb.ScanInput{
+		TableName:            s.tableName,
+		ProjectionExpression: aws.String("id"),
+		Limit:                aws.Int64(int64(limit)),
+		ConsistentRead:       aws.Bool(true),
+	}
+
+	if cursor != "" {
+		input.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(cursor),
+			},
+		}
+	}
+
+	var result *dynamodb.ScanOutput
+	err := s.read(ctx, "scan items", func(client *dynamodb.DynamoDB) error {
+		var err error
+		result, err = client.ScanWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		logger.Print(err)
+		return nil, "", newStoreError(ctx, err)
+	}
+
+	ids := make([]string, 0, len(result.Items))
+	for _, item := range result.Items {
+		if id := item["id"]; id != nil && id.S != nil {
+			ids = append(ids, *id.S)
+		}
+	}
+
+	nextCursor := ""
+	if lastEvaluatedID := result.LastEvaluatedKey["id"]; lastEvaluatedID != nil && lastEvaluatedID.S != nil {
+		nextCursor = *lastEvaluatedID.S
+	}
+
+	return ids, nextCursor, nil
+}
+
+// DeleteEncryptedDataKeys removes every version of the encrypted data keys for the given id.
+// If the id does not exist in the store, an IDNotFoundStoreError error is returned.
+func (s *DynamoDBStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	conditionExpression := "attribute_exists(id)"
+	input := &dynamodb.DeleteItemInput{
+		TableName: s.tableName,
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+		ConditionExpression: aws.String(conditionExpression),
+	}
+
+	err := s.write(ctx, "delete item", func(client *dynamodb.DynamoDB) error {
+		_, err := client.DeleteItemWithContext(ctx, input)
 		return err
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok {
+			if awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+				return IDNotFoundStoreError{ID: id}
+			}
+		}
+
+		logger.Print(err)
+		return newStoreError(ctx, err)
 	}
 
-	s.keysCache.Set(id, &encryptedKeysMap, cache.DefaultExpiration)
 	return nil
 }
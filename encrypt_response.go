@@ -0,0 +1,17 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+type encryptResponse struct {
+	ID         string `json:"id"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// ConstructEncryptResponse creates a server response for POST /encrypt endpoint
+func ConstructEncryptResponse(id string, ciphertext string) string {
+	resp := encryptResponse{id, ciphertext}
+	b, _ := json.Marshal(resp)
+	return string(b)
+}
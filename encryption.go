@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// CiphertextFormatVersion is the version of the ciphertext envelope produced by Encrypt.
+// Version 1 envelopes predate data key versions; Decrypt still reads them, with version 1 of the data key.
+const CiphertextFormatVersion = 2
+
+// ciphertextEnvelope - self-describing ciphertext returned by Encrypt.
+// It is serialized as base64 encoded JSON.
+type ciphertextEnvelope struct {
+	Version    int    `json:"version"`
+	ID         string `json:"id"`
+	KeyVersion int    `json:"key_version"`
+	Algorithm  string `json:"algorithm"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// InvalidCiphertextError represents an error type that Decrypt returns when the given
+// ciphertext is malformed, or cannot be authenticated with the data key of its id
+type InvalidCiphertextError struct {
+	Reason string
+}
+
+func (e InvalidCiphertextError) Error() string {
+	return fmt.Sprintf("invalid ciphertext: %s", e.Reason)
+}
+
+// Encrypt encrypts plaintext with the current version of the data key of the given id using AES-GCM.
+// additionalData is optional and must be given again to Decrypt.
+// The returned ciphertext records the id, the data key version and the algorithm used.
+func (r *RKMS) Encrypt(ctx context.Context, id string, plaintext []byte, additionalData []byte) (string, error) {
+	plaintextDataKey, keyVersion, err := r.GetPlaintextDataKey(ctx, id)
+	if err != nil {
+		return "", err
+	}
+
+	aead, algorithm, err := newAEAD(*plaintextDataKey)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	envelope := ciphertextEnvelope{
+		Version:    CiphertextFormatVersion,
+		ID:         id,
+		KeyVersion: keyVersion,
+		Algorithm:  algorithm,
+		Nonce:      nonce,
+	}
+	envelope.Ciphertext = aead.Seal(nil, nonce, plaintext, envelope.additionalData(additionalData))
+
+	b, err := json.Marshal(envelope)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// Decrypt decrypts a ciphertext returned by Encrypt and returns the id it was encrypted for along with the plaintext.
+// If the ciphertext is malformed or fails authentication, an InvalidCiphertextError is returned.
+// If no data key exists for the id in the ciphertext, an IDNotFoundStoreError is returned; Decrypt never creates one.
+func (r *RKMS) Decrypt(ctx context.Context, ciphertext string, additionalData []byte) (string, []byte, error) {
+	b, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", nil, InvalidCiphertextError{"ciphertext is not base64 encoded"}
+	}
+
+	envelope := ciphertextEnvelope{}
+	if err := json.Unmarshal(b, &envelope); err != nil {
+		return "", nil, InvalidCiphertextError{"ciphertext envelope is malformed"}
+	}
+
+	switch envelope.Version {
+	case CiphertextFormatVersion:
+		if envelope.KeyVersion <= 0 {
+			return "", nil, InvalidCiphertextError{"ciphertext does not specify a key version"}
+		}
+	case 1:
+		//the data key of an id had a single version when version 1 envelopes were written, which became version 1
+		if envelope.KeyVersion != 0 {
+			return "", nil, InvalidCiphertextError{"version 1 ciphertexts do not specify a key version"}
+		}
+		envelope.KeyVersion = 1
+	default:
+		return "", nil, InvalidCiphertextError{fmt.Sprintf("unsupported ciphertext version %d", envelope.Version)}
+	}
+
+	if envelope.ID == "" {
+		return "", nil, InvalidCiphertextError{"ciphertext does not specify an id"}
+	}
+
+	plaintextDataKey, err := r.GetPlaintextDataKeyVersion(ctx, envelope.ID, envelope.KeyVersion)
+	if err != nil {
+		return "", nil, err
+	}
+
+	aead, algorithm, err := newAEAD(*plaintextDataKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if envelope.Algorithm != algorithm {
+		return "", nil, InvalidCiphertextError{fmt.Sprintf("ciphertext algorithm %s does not match the data key algorithm %s", envelope.Algorithm, algorithm)}
+	}
+
+	if len(envelope.Nonce) != aead.NonceSize() {
+		return "", nil, InvalidCiphertextError{"ciphertext nonce has the wrong size"}
+	}
+
+	plaintext, err := aead.Open(nil, envelope.Nonce, envelope.Ciphertext, envelope.additionalData(additionalData))
+	if err != nil {
+		return "", nil, InvalidCiphertextError{"ciphertext could not be authenticated"}
+	}
+
+	return envelope.ID, plaintext, nil
+}
+
+// newAEAD returns an AES-GCM cipher keyed with the given base64 encoded data key, along with its algorithm name
+func newAEAD(plaintextDataKey string) (cipher.AEAD, string, error) {
+	dataKey, err := base64.StdEncoding.DecodeString(plaintextDataKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("data key cannot be used for AES: %s", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return aead, fmt.Sprintf("AES-%d-GCM", len(dataKey)*8), nil
+}
+
+// additionalData binds the envelope's header to the caller supplied additional data,
+// so the id, key version and algorithm recorded in the ciphertext cannot be tampered with
+func (e ciphertextEnvelope) additionalData(callerAdditionalData []byte) []byte {
+	header := fmt.Sprintf("%d\x00%s\x00%d\x00%s\x00", e.Version, e.Algorithm, e.KeyVersion, e.ID)
+	if e.Version == 1 {
+		header = fmt.Sprintf("%d\x00%s\x00%s\x00", e.Version, e.Algorithm, e.ID)
+	}
+
+	return append([]byte(header), callerAdditionalData...)
+}
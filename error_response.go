@@ -7,11 +7,12 @@ import (
 type errorResponse struct {
 	ErrorType    string `json:"error_type"`
 	ErrorMessage string `json:"error_message"`
+	Retryable    bool   `json:"retryable"`
 }
 
 // ConstructErrorResponse creates a server response for the given error
-func ConstructErrorResponse(errorType string, errorMessage string) string {
-	resp := errorResponse{errorType, errorMessage}
+func ConstructErrorResponse(errorType string, errorMessage string, retryable bool) string {
+	resp := errorResponse{errorType, errorMessage, retryable}
 	b, _ := json.Marshal(resp)
 	return string(b)
 }
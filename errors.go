@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"google.golang.org/grpc/codes"
+)
+
+// MaxIDLength is the maximum length of an id in bytes
+const MaxIDLength = 1024
+
+// InvalidIDError represents an error type that is returned when an id cannot be used for a key
+type InvalidIDError struct {
+	ID     string
+	Reason string
+}
+
+func (e InvalidIDError) Error() string {
+	return fmt.Sprintf("id %q is invalid: %s", e.ID, e.Reason)
+}
+
+// RegionsUnavailableError represents an error type that is returned when
+// an operation failed in too many KMS regions to succeed
+type RegionsUnavailableError struct {
+	Operation string
+	Err       error
+}
+
+func (e RegionsUnavailableError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("failed to %s", e.Operation)
+	}
+
+	return fmt.Sprintf("failed to %s: %s", e.Operation, e.Err)
+}
+
+// StoreUnavailableError represents an error type that is returned when the key/value store cannot be reached
+type StoreUnavailableError struct {
+	Err error
+}
+
+func (e StoreUnavailableError) Error() string {
+	return fmt.Sprintf("key/value store is unavailable: %s", e.Err)
+}
+
+// ConflictRetriesExhaustedError represents an error type that is returned when
+// concurrent writes to the same id kept conflicting with ours
+type ConflictRetriesExhaustedError struct {
+	ID    string
+	Tries int
+}
+
+func (e ConflictRetriesExhaustedError) Error() string {
+	return fmt.Sprintf("id %q kept changing concurrently; gave up after %d tries", e.ID, e.Tries)
+}
+
+// ThrottledError represents an error type that is returned when KMS or the key/value store throttled a request
+type ThrottledError struct {
+	Err error
+}
+
+func (e ThrottledError) Error() string {
+	return fmt.Sprintf("request was throttled: %s", e.Err)
+}
+
+// CancelledError represents an error type that is returned when the request was cancelled or timed out
+type CancelledError struct {
+	Err error
+}
+
+func (e CancelledError) Error() string {
+	return fmt.Sprintf("request was cancelled: %s", e.Err)
+}
+
+// ErrorType returns the stable code clients can rely on for the given error
+func ErrorType(err error) string {
+	switch err.(type) {
+	case InvalidIDError:
+		return "InvalidID"
+	case IDNotFoundStoreError, VersionNotFoundError:
+		return "NotFound"
+	case IDAlreadyExistsStoreError, ConditionalUpdateFailedStoreError:
+		return "Conflict"
+	case ConflictRetriesExhaustedError:
+		return "ConflictRetriesExhausted"
+	case RegionsUnavailableError:
+		return "RegionsUnavailable"
+	case StoreUnavailableError:
+		return "StoreUnavailable"
+	case ThrottledError:
+		return "Throttled"
+	case CancelledError:
+		return "Cancelled"
+	case InvalidCiphertextError:
+		return "InvalidCiphertext"
+	}
+
+	return "InternalServerError"
+}
+
+// IsRetryable reports whether retrying the request that failed with the given error may succeed
+func IsRetryable(err error) bool {
+	switch err.(type) {
+	case ConflictRetriesExhaustedError, RegionsUnavailableError, StoreUnavailableError, ThrottledError, CancelledError:
+		return true
+	}
+
+	return false
+}
+
+// ErrorStatus returns the HTTP status code and the gRPC code the given error is reported with,
+// so both APIs report every error the same way
+func ErrorStatus(err error) (int, codes.Code) {
+	switch err.(type) {
+	case InvalidIDError, InvalidCiphertextError:
+		return http.StatusBadRequest, codes.InvalidArgument
+	case IDNotFoundStoreError, VersionNotFoundError:
+		return http.StatusNotFound, codes.NotFound
+	case IDAlreadyExistsStoreError:
+		return http.StatusConflict, codes.AlreadyExists
+	case ConditionalUpdateFailedStoreError, ConflictRetriesExhaustedError:
+		return http.StatusConflict, codes.Aborted
+	case ThrottledError:
+		return http.StatusTooManyRequests, codes.ResourceExhausted
+	case RegionsUnavailableError, StoreUnavailableError:
+		return http.StatusServiceUnavailable, codes.Unavailable
+	case CancelledError:
+		return http.StatusRequestTimeout, codes.Canceled
+	}
+
+	return http.StatusInternalServerError, codes.Internal
+}
+
+// ValidateID returns an InvalidIDError if the given id cannot be used for a key
+func ValidateID(id string) error {
+	if id == "" {
+		return InvalidIDError{id, "id is empty"}
+	}
+
+	if len(id) > MaxIDLength {
+		return InvalidIDError{truncateID(id, 32) + "...", fmt.Sprintf("id is longer than %d bytes", MaxIDLength)}
+	}
+
+	if !utf8.ValidString(id) {
+		return InvalidIDError{id, "id is not valid UTF-8"}
+	}
+
+	for _, c := range id {
+		if unicode.IsControl(c) {
+			return InvalidIDError{id, "id contains control characters"}
+		}
+	}
+
+	return nil
+}
+
+// truncateID returns the first n bytes of id at most, without splitting a UTF-8 encoded character
+func truncateID(id string, n int) string {
+	if len(id) <= n {
+		return id
+	}
+
+	for n > 0 && !utf8.RuneStart(id[n]) {
+		n--
+	}
+	return id[:n]
+}
+
+// newStoreError wraps an error returned by the key/value store's backend in a typed error
+func newStoreError(ctx context.Context, err error) error {
+	if isCancelledError(ctx, err) {
+		return CancelledError{err}
+	}
+
+	if isThrottlingError(err) {
+		return ThrottledError{err}
+	}
+
+	return StoreUnavailableError{err}
+}
+
+// newRegionsError returns the error of an operation that failed in too many regions, given the error of each failed region
+func newRegionsError(ctx context.Context, operation string, errs []error) error {
+	if ctx.Err() != nil {
+		return CancelledError{ctx.Err()}
+	}
+
+	if len(errs) == 0 {
+		return RegionsUnavailableError{operation, nil}
+	}
+
+	//only report throttling if it is the reason every region failed
+	for _, err := range errs {
+		if !isThrottlingError(err) {
+			return RegionsUnavailableError{operation, errs[len(errs)-1]}
+		}
+	}
+
+	return ThrottledError{errs[len(errs)-1]}
+}
+
+func isCancelledError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || err == context.Canceled || err == context.DeadlineExceeded {
+		return true
+	}
+
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == request.CanceledErrorCode
+	}
+
+	return false
+}
+
+func isThrottlingError(err error) bool {
+	//key-wrapping backends other than AWS report throttling this way
+	if _, ok := err.(ThrottledError); ok {
+		return true
+	}
+
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "ThrottlingException", "Throttling", "RequestLimitExceeded", "TooManyRequestsException",
+			"ProvisionedThroughputExceededException", "LimitExceededException":
+			return true
+		}
+	}
+
+	return false
+}
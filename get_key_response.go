@@ -5,13 +5,14 @@ import (
 )
 
 type getKeyResponse struct {
-	ID  string `json:"id"`
-	Key string `json:"key"`
+	ID      string `json:"id"`
+	Key     string `json:"key"`
+	Version int    `json:"version"`
 }
 
 // ConstructGetKeyResponse creates a server response for GET /key endpoint
-func ConstructGetKeyResponse(id string, key string) string {
-	resp := getKeyResponse{id, key}
+func ConstructGetKeyResponse(id string, key string, version int) string {
+	resp := getKeyResponse{id, key, version}
 	b, _ := json.Marshal(resp)
 	return string(b)
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+type getKeysResult struct {
+	ID           string `json:"id"`
+	Key          string `json:"key,omitempty"`
+	Version      int    `json:"version,omitempty"`
+	ErrorType    string `json:"error_type,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+	Retryable    bool   `json:"retryable,omitempty"`
+}
+
+type getKeysResponse struct {
+	Keys []getKeysResult `json:"keys"`
+}
+
+// ConstructGetKeysResponse creates a server response for POST /keys endpoint
+func ConstructGetKeysResponse(results []BatchDataKeyResult) string {
+	resp := getKeysResponse{make([]getKeysResult, 0, len(results))}
+	for _, result := range results {
+		if result.Err != nil {
+			resp.Keys = append(resp.Keys, getKeysResult{ID: result.ID, ErrorType: ErrorType(result.Err), ErrorMessage: result.Err.Error(), Retryable: IsRetryable(result.Err)})
+			continue
+		}
+
+		resp.Keys = append(resp.Keys, getKeysResult{ID: result.ID, Key: *result.Key, Version: result.Version})
+	}
+
+	b, _ := json.Marshal(resp)
+	return string(b)
+}
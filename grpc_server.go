@@ -0,0 +1,169 @@
+package main
+
+//go:generate protoc -I api api/rkms.proto --go_out=plugins=grpc:.
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer - gRPC implementation of the KeyService backed by RKMS
+type grpcServer struct {
+	rkms *RKMS
+
+	// whether GetKey creates keys for unknown ids when the request does not say
+	createMissingKeys bool
+}
+
+// ServeGRPC starts serving the KeyService on the given port in the background.
+// The returned channel receives the error that made the server stop serving.
+func ServeGRPC(rkms *RKMS, port string, createMissingKeys bool) (<-chan error, error) {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+
+	server := grpc.NewServer()
+	RegisterKeyServiceServer(server, &grpcServer{rkms, createMissingKeys})
+
+	serveErrs := make(chan error, 1)
+	go func() {
+		serveErrs <- server.Serve(listener)
+	}()
+
+	return serveErrs, nil
+}
+
+// GetKey returns the plaintext data key for the given id, creating it if it does not exist and the missing key policy allows it.
+// If a version is given, that version is returned instead and no key is created.
+func (s *grpcServer) GetKey(ctx context.Context, request *GetKeyRequest) (*GetKeyResponse, error) {
+	if request.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+
+	if request.Version < 0 {
+		return nil, status.Error(codes.InvalidArgument, "version must be positive")
+	}
+
+	create := s.createMissingKeys
+	switch request.MissingKeyPolicy {
+	case MissingKeyPolicy_CREATE:
+		create = true
+	case MissingKeyPolicy_NOT_FOUND:
+		create = false
+	}
+
+	var plaintextDataKey *string
+	var err error
+	version := int(request.Version)
+	if version == 0 && create {
+		plaintextDataKey, version, err = s.rkms.GetPlaintextDataKey(ctx, request.Id)
+	} else if version == 0 {
+		plaintextDataKey, version, err = s.rkms.LookupPlaintextDataKey(ctx, request.Id)
+	} else {
+		plaintextDataKey, err = s.rkms.GetPlaintextDataKeyVersion(ctx, request.Id, version)
+	}
+
+	if err != nil {
+		return nil, toGRPCError(ctx, err)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(*plaintextDataKey)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &GetKeyResponse{Id: request.Id, Key: key, Version: int32(version)}, nil
+}
+
+// CreateKey creates the data key for the given id, failing if it already exists
+func (s *grpcServer) CreateKey(ctx context.Context, request *CreateKeyRequest) (*CreateKeyResponse, error) {
+	if request.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+
+	plaintextDataKey, version, err := s.rkms.CreatePlaintextDataKey(ctx, request.Id)
+	if err != nil {
+		return nil, toGRPCError(ctx, err)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(*plaintextDataKey)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &CreateKeyResponse{Id: request.Id, Key: key, Version: int32(version)}, nil
+}
+
+// RotateKey creates a new version of the data key for the given id
+func (s *grpcServer) RotateKey(ctx context.Context, request *RotateKeyRequest) (*RotateKeyResponse, error) {
+	if request.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+
+	version, err := s.rkms.RotateDataKey(ctx, request.Id)
+	if err != nil {
+		return nil, toGRPCError(ctx, err)
+	}
+
+	return &RotateKeyResponse{Id: request.Id, Version: int32(version)}, nil
+}
+
+// DeleteKey removes the data key for the given id
+func (s *grpcServer) DeleteKey(ctx context.Context, request *DeleteKeyRequest) (*DeleteKeyResponse, error) {
+	if request.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+
+	err := s.rkms.DeleteDataKey(ctx, request.Id)
+	if err != nil {
+		return nil, toGRPCError(ctx, err)
+	}
+
+	return &DeleteKeyResponse{Id: request.Id}, nil
+}
+
+// Encrypt encrypts plaintext with the data key of the given id
+func (s *grpcServer) Encrypt(ctx context.Context, request *EncryptRequest) (*EncryptResponse, error) {
+	if request.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+
+	ciphertext, err := s.rkms.Encrypt(ctx, request.Id, request.Plaintext, request.AdditionalData)
+	if err != nil {
+		return nil, toGRPCError(ctx, err)
+	}
+
+	return &EncryptResponse{Id: request.Id, Ciphertext: ciphertext}, nil
+}
+
+// Decrypt decrypts a ciphertext returned by Encrypt
+func (s *grpcServer) Decrypt(ctx context.Context, request *DecryptRequest) (*DecryptResponse, error) {
+	if request.Ciphertext == "" {
+		return nil, status.Error(codes.InvalidArgument, "ciphertext is required")
+	}
+
+	id, plaintext, err := s.rkms.Decrypt(ctx, request.Ciphertext, request.AdditionalData)
+	if err != nil {
+		return nil, toGRPCError(ctx, err)
+	}
+
+	return &DecryptResponse{Id: id, Plaintext: plaintext}, nil
+}
+
+func toGRPCError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+
+	_, code := ErrorStatus(err)
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LocalMasterKeySizeInBytes is the size of the AES-256 master keys of a LocalKeyWrapper
+const LocalMasterKeySizeInBytes = 32
+
+// localWrappedKeyFormat is the first byte of every data key wrapped by a LocalKeyWrapper
+const localWrappedKeyFormat = 2
+
+// localWrappedKeyHeaderSize is the size of the format byte, the master key version and the master key fingerprint
+// that start a wrapped key
+const localWrappedKeyHeaderSize = 13
+
+// localLegacyWrappedKeyFormat is the first byte of data keys wrapped before the header held the master key fingerprint
+const localLegacyWrappedKeyFormat = 1
+
+// localLegacyWrappedKeyHeaderSize is the size of the format byte and the master key version of a legacy wrapped key
+const localLegacyWrappedKeyHeaderSize = 5
+
+// localMasterKeyFingerprintSize is the size of the master key fingerprint in a wrapped key and in key ids
+const localMasterKeyFingerprintSize = 8
+
+// LocalKeyWrapper - KeyWrapper implementation that wraps data keys in process with AES-256-GCM,
+// under master keys loaded from a file or an environment variable. It needs no network access,
+// which makes it suitable for development, CI, or as a last resort next to KMS regions.
+// A wrapped key is the format byte, the big endian master key version, the master key fingerprint, the GCM nonce
+// and the sealed data key; the first three are authenticated as additional data. The fingerprint tells a master key
+// that is missing from this server apart from a corrupted data key, when servers have different keys of the same version.
+type LocalKeyWrapper struct {
+	masterKeys   map[uint32]cipher.AEAD
+	fingerprints map[uint32][]byte
+	keyIDs       map[uint32]string
+
+	// currentVersion is the version of the master key new data keys are wrapped with
+	currentVersion uint32
+}
+
+// newLocalKeyWrapper loads the master keys of a local backend from its configured file or environment variable
+func newLocalKeyWrapper(backendConfig WrappingBackendConfig) (*LocalKeyWrapper, error) {
+	var masterKeys string
+	if backendConfig.MasterKeyFile != "" {
+		b, err := ioutil.ReadFile(backendConfig.MasterKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read master keys of key-wrapping backend %s: %s", backendConfig.Name, err)
+		}
+		masterKeys = string(b)
+	} else {
+		masterKeys = os.Getenv(backendConfig.MasterKeyEnv)
+	}
+
+	wrapper, err := NewLocalKeyWrapper(masterKeys, backendConfig.MasterKeyVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid master keys of key-wrapping backend %s: %s", backendConfig.Name, err)
+	}
+
+	return wrapper, nil
+}
+
+// NewLocalKeyWrapper creates a new LocalKeyWrapper instance from the given master keys, one per line
+// as "<version>:<base64 key>". A single base64 key without a version is version 1.
+// Blank lines and lines starting with # are ignored. New data keys are wrapped with the given version
+// of the master key, or the highest one if currentVersion is 0.
+func NewLocalKeyWrapper(masterKeys string, currentVersion int) (*LocalKeyWrapper, error) {
+	w := &LocalKeyWrapper{
+		masterKeys:   make(map[uint32]cipher.AEAD),
+		fingerprints: make(map[uint32][]byte),
+		keyIDs:       make(map[uint32]string),
+	}
+
+	for _, line := range strings.Split(masterKeys, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		version, encodedKey := uint64(1), line
+		if i := strings.Index(line, ":"); i >= 0 {
+			var err error
+			version, err = strconv.ParseUint(line[:i], 10, 32)
+			if err != nil || version == 0 {
+				return nil, fmt.Errorf("master key version %q is not a positive number", line[:i])
+			}
+			encodedKey = line[i+1:]
+		}
+
+		if err := w.addMasterKey(uint32(version), encodedKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(w.masterKeys) == 0 {
+		return nil, fmt.Errorf("no master key is configured")
+	}
+
+	if currentVersion < 0 {
+		return nil, fmt.Errorf("master key version %d is not a positive number", currentVersion)
+	}
+
+	w.currentVersion = uint32(currentVersion)
+	if currentVersion == 0 {
+		for version := range w.masterKeys {
+			if version > w.currentVersion {
+				w.currentVersion = version
+			}
+		}
+	}
+
+	if _, ok := w.masterKeys[w.currentVersion]; !ok {
+		return nil, fmt.Errorf("master key version %d is not configured", w.currentVersion)
+	}
+
+	return w, nil
+}
+
+func (w *LocalKeyWrapper) addMasterKey(version uint32, encodedKey string) error {
+	if _, ok := w.masterKeys[version]; ok {
+		return fmt.Errorf("master key version %d is configured more than once", version)
+	}
+
+	masterKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+	if err != nil {
+		return fmt.Errorf("master key version %d is not base64 encoded", version)
+	}
+
+	if len(masterKey) != LocalMasterKeySizeInBytes {
+		return fmt.Errorf("master key version %d is %d bytes instead of %d", version, len(masterKey), LocalMasterKeySizeInBytes)
+	}
+
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	//the fingerprint tells master keys of the same version apart, without revealing anything about them
+	fingerprint := sha256.Sum256(append([]byte("rkms local master key:"), masterKey...))
+	w.masterKeys[version] = aead
+	w.fingerprints[version] = fingerprint[:localMasterKeyFingerprintSize]
+	w.keyIDs[version] = fmt.Sprintf("local:v%d:%s", version, hex.EncodeToString(fingerprint[:localMasterKeyFingerprintSize]))
+	return nil
+}
+
+// GenerateDataKey generates a random data key and wraps it with the current master key
+func (w *LocalKeyWrapper) GenerateDataKey(ctx context.Context, sizeInBytes int) ([]byte, []byte, string, error) {
+	plaintext := make([]byte, sizeInBytes)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, nil, "", err
+	}
+
+	ciphertext, keyID, err := w.WrapKey(ctx, plaintext)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	return plaintext, ciphertext, keyID, nil
+}
+
+// WrapKey encrypts the given data key with the current master key
+func (w *LocalKeyWrapper) WrapKey(ctx context.Context, plaintext []byte) ([]byte, string, error) {
+	return w.wrapKey(plaintext, w.currentVersion)
+}
+
+func (w *LocalKeyWrapper) wrapKey(plaintext []byte, version uint32) ([]byte, string, error) {
+	aead := w.masterKeys[version]
+
+	header := make([]byte, localWrappedKeyHeaderSize, localWrappedKeyHeaderSize+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	header[0] = localWrappedKeyFormat
+	binary.BigEndian.PutUint32(header[1:], version)
+	copy(header[5:], w.fingerprints[version])
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+
+	ciphertext := append(header, nonce...)
+	ciphertext = aead.Seal(ciphertext, nonce, plaintext, header)
+	return ciphertext, w.keyIDs[version], nil
+}
+
+// UnwrapKey decrypts the given data key with the master key it was wrapped with.
+// Data keys wrapped by another master key of the same version, or in the legacy format, are not reported as corrupted
+// when they fail to decrypt.
+func (w *LocalKeyWrapper) UnwrapKey(ctx context.Context, ciphertext []byte) ([]byte, string, error) {
+	headerSize := localWrappedKeyHeaderSize
+	if len(ciphertext) > 0 && ciphertext[0] == localLegacyWrappedKeyFormat {
+		headerSize = localLegacyWrappedKeyHeaderSize
+	} else if len(ciphertext) == 0 || ciphertext[0] != localWrappedKeyFormat {
+		return nil, "", CorruptedWrappedKeyError{fmt.Errorf("not a locally wrapped key")}
+	}
+
+	if len(ciphertext) < headerSize {
+		return nil, "", CorruptedWrappedKeyError{fmt.Errorf("wrapped key is truncated")}
+	}
+
+	//not corrupted in either case; the master key may just be missing from this server's configuration
+	version := binary.BigEndian.Uint32(ciphertext[1:5])
+	aead, ok := w.masterKeys[version]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown master key: version %d is not configured", version)
+	}
+
+	if headerSize == localWrappedKeyHeaderSize && !bytes.Equal(ciphertext[5:headerSize], w.fingerprints[version]) {
+		return nil, "", fmt.Errorf("unknown master key: version %d with fingerprint %s is not configured", version, hex.EncodeToString(ciphertext[5:headerSize]))
+	}
+
+	if len(ciphertext) < headerSize+aead.NonceSize() {
+		return nil, "", CorruptedWrappedKeyError{fmt.Errorf("wrapped key is truncated")}
+	}
+
+	header := ciphertext[:headerSize]
+	nonce := ciphertext[headerSize : headerSize+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, ciphertext[headerSize+aead.NonceSize():], header)
+	if err != nil {
+		//without a fingerprint, another master key of the same version cannot be told apart from corruption,
+		//so legacy data keys are never reported as corrupted and their region is never repaired
+		if headerSize == localLegacyWrappedKeyHeaderSize {
+			return nil, "", fmt.Errorf("unknown master key: version %d did not unwrap this legacy wrapped key: %s", version, err)
+		}
+		return nil, "", CorruptedWrappedKeyError{err}
+	}
+
+	return plaintext, w.keyIDs[version], nil
+}
+
+// CurrentKeyID returns the id of the master key new data keys are wrapped with
+func (w *LocalKeyWrapper) CurrentKeyID(ctx context.Context) (string, error) {
+	return w.keyIDs[w.currentVersion], nil
+}
+
+// RewrapKey re-encrypts the given data key under the master key with the given id.
+// The data key is only decrypted in memory, like every other operation of a LocalKeyWrapper.
+func (w *LocalKeyWrapper) RewrapKey(ctx context.Context, ciphertext []byte, keyID string) ([]byte, error) {
+	for version, id := range w.keyIDs {
+		if id != keyID {
+			continue
+		}
+
+		plaintext, _, err := w.UnwrapKey(ctx, ciphertext)
+		if err != nil {
+			return nil, err
+		}
+
+		rewrappedCiphertext, _, err := w.wrapKey(plaintext, version)
+		return rewrappedCiphertext, err
+	}
+
+	return nil, fmt.Errorf("master key %s is not configured", keyID)
+}
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"strconv"
 
 	logger "github.com/sirupsen/logrus"
 )
 
 var rkmsHandler *RKMS
 
+// createMissingKeys is whether key lookups create keys for unknown ids when a request does not say
+var createMissingKeys bool
+
+// MaxRequestBodySizeInBytes is the largest request body accepted by the POST endpoints
+const MaxRequestBodySizeInBytes = 1 << 20
+
 func main() {
 	config := LoadConfiguration()
 
@@ -18,19 +27,61 @@ func main() {
 	}
 	logger.SetLevel(level)
 
-	rkms, err := NewRKMSWithDynamoDB(config.KMS, config.DynamoDB)
+	store, err := NewStore(config)
 	if err != nil {
 		logger.Fatal(err)
 		return
 	}
-	rkmsHandler = rkms
 
-	path := "/api/" + config.Server.APIVersion + "/key"
-	http.HandleFunc(path, decorator(getKey))
-	err = http.ListenAndServe(":"+config.Server.Port, nil)
+	rkms, err := NewRKMS(config.KMS, store)
 	if err != nil {
-		logger.Fatal("ListenAndServe: ", err)
+		logger.Fatal(err)
+		return
+	}
+	rkmsHandler = rkms
+	createMissingKeys = config.Server.CreateMissingKeys
+
+	if len(os.Args) > 1 && os.Args[1] == "rewrap" {
+		runRewrapCommand(rkms, os.Args[2:])
+		return
+	}
+
+	if config.Repair.Enabled {
+		rkms.StartRepairer(config.Repair)
 	}
+
+	//stays nil, and so never ready, when gRPC is not enabled
+	var grpcErrs <-chan error
+	if config.Server.GRPCPort != "" {
+		grpcErrs, err = ServeGRPC(rkms, config.Server.GRPCPort, config.Server.CreateMissingKeys)
+		if err != nil {
+			logger.Fatal("ServeGRPC: ", err)
+		}
+	}
+
+	path := "/api/" + config.Server.APIVersion
+	http.HandleFunc(path+"/key", decorator(key))
+	http.HandleFunc(path+"/keys", decorator(post(getKeys)))
+	http.HandleFunc(path+"/key/rotate", decorator(post(rotateKey)))
+	http.HandleFunc(path+"/key/metadata", decorator(describeKey))
+	http.HandleFunc(path+"/encrypt", decorator(post(encrypt)))
+	http.HandleFunc(path+"/decrypt", decorator(post(decrypt)))
+
+	httpErrs := make(chan error, 1)
+	go func() {
+		httpErrs <- http.ListenAndServe(":"+config.Server.Port, nil)
+	}()
+
+	//both servers only return when they fail, so stop as soon as either does
+	select {
+	case err = <-httpErrs:
+		err = fmt.Errorf("ListenAndServe: %s", err)
+	case err = <-grpcErrs:
+		err = fmt.Errorf("gRPC Serve: %s", err)
+	}
+
+	rkms.StopRepairer()
+	logger.Fatal(err)
 }
 
 func decorator(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
@@ -42,26 +93,295 @@ func decorator(handler func(http.ResponseWriter, *http.Request)) func(http.Respo
 	}
 }
 
+func post(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			resp := ConstructErrorResponse("MethodNotAllowed", r.Method+" method is not supported", false)
+			fmt.Fprintln(w, resp)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, MaxRequestBodySizeInBytes)
+		handler(w, r)
+	}
+}
+
+// writeError writes the status code and JSON body matching the type of the given error
+func writeError(w http.ResponseWriter, err error) {
+	statusCode, _ := ErrorStatus(err)
+	w.WriteHeader(statusCode)
+	resp := ConstructErrorResponse(ErrorType(err), err.Error(), IsRetryable(err))
+	fmt.Fprintln(w, resp)
+}
+
+func key(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getKey(w, r)
+	case http.MethodPost:
+		createKey(w, r)
+	case http.MethodDelete:
+		deleteKey(w, r)
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost+", "+http.MethodDelete)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", r.Method+" method is not supported", false)
+		fmt.Fprintln(w, resp)
+	}
+}
+
 func getKey(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
 	if id == "" {
 		w.WriteHeader(http.StatusBadRequest)
-		resp := ConstructErrorResponse("BadRequest", "id query parameter is required")
+		resp := ConstructErrorResponse("BadRequest", "id query parameter is required", false)
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	version := 0
+	if versionParam := r.URL.Query().Get("version"); versionParam != "" {
+		var err error
+		version, err = strconv.Atoi(versionParam)
+		if err != nil || version <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			resp := ConstructErrorResponse("BadRequest", "version query parameter must be a positive integer", false)
+			fmt.Fprintln(w, resp)
+			return
+		}
+	}
+
+	create := createMissingKeys
+	if createParam := r.URL.Query().Get("create"); createParam != "" {
+		var err error
+		create, err = strconv.ParseBool(createParam)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			resp := ConstructErrorResponse("BadRequest", "create query parameter must be true or false", false)
+			fmt.Fprintln(w, resp)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	var plaintextDataKey *string
+	var err error
+	if version == 0 && create {
+		plaintextDataKey, version, err = rkmsHandler.GetPlaintextDataKey(ctx, id)
+	} else if version == 0 {
+		plaintextDataKey, version, err = rkmsHandler.LookupPlaintextDataKey(ctx, id)
+	} else {
+		plaintextDataKey, err = rkmsHandler.GetPlaintextDataKeyVersion(ctx, id, version)
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := ConstructGetKeyResponse(id, *plaintextDataKey, version)
+	fmt.Fprintln(w, resp)
+}
+
+func createKey(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "id query parameter is required", false)
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	ctx := r.Context()
+	plaintextDataKey, version, err := rkmsHandler.CreatePlaintextDataKey(ctx, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	resp := ConstructGetKeyResponse(id, *plaintextDataKey, version)
+	fmt.Fprintln(w, resp)
+}
+
+func deleteKey(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "id query parameter is required", false)
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	ctx := r.Context()
+	err := rkmsHandler.DeleteDataKey(ctx, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := ConstructDeleteKeyResponse(id)
+	fmt.Fprintln(w, resp)
+}
+
+func rotateKey(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "id query parameter is required", false)
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	ctx := r.Context()
+	version, err := rkmsHandler.RotateDataKey(ctx, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := ConstructRotateKeyResponse(id, version)
+	fmt.Fprintln(w, resp)
+}
+
+func describeKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		resp := ConstructErrorResponse("MethodNotAllowed", r.Method+" method is not supported", false)
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "id query parameter is required", false)
 		fmt.Fprintln(w, resp)
 		return
 	}
 
 	ctx := r.Context()
-	plaintextDataKey, err := rkmsHandler.GetPlaintextDataKey(ctx, id)
+	description, err := rkmsHandler.DescribeDataKey(ctx, id)
 	if err != nil {
-		//TODO: do a better error handling based on the type of error
-		w.WriteHeader(http.StatusInternalServerError)
-		resp := ConstructErrorResponse("InternalServerError", err.Error())
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := ConstructDescribeKeyResponse(description)
+	fmt.Fprintln(w, resp)
+}
+
+type getKeysRequest struct {
+	IDs    []string `json:"ids"`
+	Create *bool    `json:"create"`
+}
+
+func getKeys(w http.ResponseWriter, r *http.Request) {
+	req := getKeysRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "request body is not valid: "+err.Error(), false)
 		fmt.Fprintln(w, resp)
 		return
 	}
 
+	if len(req.IDs) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "ids are required", false)
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	if len(req.IDs) > MaxBatchSize {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", fmt.Sprintf("at most %d ids can be requested at once", MaxBatchSize), false)
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	create := createMissingKeys
+	if req.Create != nil {
+		create = *req.Create
+	}
+
+	ctx := r.Context()
+	results := rkmsHandler.GetPlaintextDataKeys(ctx, req.IDs, create)
+
+	w.WriteHeader(http.StatusOK)
+	resp := ConstructGetKeysResponse(results)
+	fmt.Fprintln(w, resp)
+}
+
+type encryptRequest struct {
+	ID             string `json:"id"`
+	Plaintext      []byte `json:"plaintext"`
+	AdditionalData []byte `json:"additional_data"`
+}
+
+func encrypt(w http.ResponseWriter, r *http.Request) {
+	req := encryptRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "request body is not valid: "+err.Error(), false)
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	if req.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "id is required", false)
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	ctx := r.Context()
+	ciphertext, err := rkmsHandler.Encrypt(ctx, req.ID, req.Plaintext, req.AdditionalData)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := ConstructEncryptResponse(req.ID, ciphertext)
+	fmt.Fprintln(w, resp)
+}
+
+type decryptRequest struct {
+	Ciphertext     string `json:"ciphertext"`
+	AdditionalData []byte `json:"additional_data"`
+}
+
+func decrypt(w http.ResponseWriter, r *http.Request) {
+	req := decryptRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "request body is not valid: "+err.Error(), false)
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	if req.Ciphertext == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := ConstructErrorResponse("BadRequest", "ciphertext is required", false)
+		fmt.Fprintln(w, resp)
+		return
+	}
+
+	ctx := r.Context()
+	id, plaintext, err := rkmsHandler.Decrypt(ctx, req.Ciphertext, req.AdditionalData)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
-	resp := ConstructGetKeyResponse(id, *plaintextDataKey)
+	resp := ConstructDecryptResponse(id, plaintext)
 	fmt.Fprintln(w, resp)
 }
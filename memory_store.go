@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemoryStore - in-memory implementation of the Store interface for local development and tests.
+// Everything is lost when the process exits, and the data keys are not shared between RKMS servers.
+type MemoryStore struct {
+	mutex sync.RWMutex
+	items map[string]*EncryptedDataKeys
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{items: make(map[string]*EncryptedDataKeys)}
+}
+
+// GetEncryptedDataKeys retrieves every version of the encrypted data keys for the given id
+func (s *MemoryStore) GetEncryptedDataKeys(ctx context.Context, id string) (*EncryptedDataKeys, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	encryptedDataKeys, ok := s.items[id]
+	if !ok {
+		return nil, nil
+	}
+
+	return copyEncryptedDataKeys(encryptedDataKeys), nil
+}
+
+// GetEncryptedDataKeysBatch retrieves every version of the encrypted data keys for each of the given ids
+func (s *MemoryStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]*EncryptedDataKeys, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	encryptedDataKeysByID := make(map[string]*EncryptedDataKeys)
+	for _, id := range ids {
+		if encryptedDataKeys, ok := s.items[id]; ok {
+			encryptedDataKeysByID[id] = copyEncryptedDataKeys(encryptedDataKeys)
+		}
+	}
+
+	return encryptedDataKeysByID, nil
+}
+
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id as its first version
+// only if id does not exist in the store already
+func (s *MemoryStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, keys map[string]string, incomplete bool, metadata DataKeyMetadata) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.items[id]; ok {
+		return IDAlreadyExistsStoreError{ID: id}
+	}
+
+	s.items[id] = newEncryptedDataKeys(copyKeys(keys), incomplete, copyMetadata(metadata))
+	return nil
+}
+
+// AddEncryptedDataKeysVersionConditionally adds the encrypted data keys for the given id as a new version
+// and makes it the current version, only if the current version of id is still version-1
+func (s *MemoryStore) AddEncryptedDataKeysVersionConditionally(ctx context.Context, id string, version int, keys map[string]string, incomplete bool, metadata DataKeyMetadata) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	encryptedDataKeys, ok := s.items[id]
+	if !ok {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	return addEncryptedDataKeysVersion(encryptedDataKeys, id, version, copyKeys(keys), incomplete, copyMetadata(metadata))
+}
+
+// UpdateEncryptedDataKeysConditionally sets the encrypted data keys of the regions in keys for the given version of id,
+// only if the current encrypted data key of each of those regions still matches the one in previousKeys
+func (s *MemoryStore) UpdateEncryptedDataKeysConditionally(ctx context.Context, id string, version int, previousKeys map[string]string, keys map[string]string, keyIDs map[string]string, complete bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	encryptedDataKeys, ok := s.items[id]
+	if !ok {
+		return ConditionalUpdateFailedStoreError{ID: id}
+	}
+
+	return updateEncryptedDataKeysVersion(encryptedDataKeys, id, version, previousKeys, keys, keyIDs, complete)
+}
+
+// ListIDs returns up to limit ids stored after the given cursor, along with the cursor to continue from.
+// Ids are listed in lexicographic order and the cursor is the last id returned.
+func (s *MemoryStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var ids []string
+	for id := range s.items {
+		if id > cursor {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	if limit <= 0 || len(ids) <= limit {
+		return ids, "", nil
+	}
+
+	ids = ids[:limit]
+	return ids, ids[limit-1], nil
+}
+
+// DeleteEncryptedDataKeys removes every version of the encrypted data keys for the given id
+func (s *MemoryStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.items[id]; !ok {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	delete(s.items, id)
+	return nil
+}
+
+// copyEncryptedDataKeys returns a deep copy, so callers cannot change what is in the store
+func copyEncryptedDataKeys(encryptedDataKeys *EncryptedDataKeys) *EncryptedDataKeys {
+	versions := make(map[int]EncryptedDataKeysVersion)
+	for version, encryptedDataKeysVersion := range encryptedDataKeys.Versions {
+		versions[version] = EncryptedDataKeysVersion{
+			Keys:       copyKeys(encryptedDataKeysVersion.Keys),
+			Incomplete: encryptedDataKeysVersion.Incomplete,
+			Metadata:   copyMetadata(encryptedDataKeysVersion.Metadata),
+		}
+	}
+
+	return &EncryptedDataKeys{
+		FormatVersion:  encryptedDataKeys.FormatVersion,
+		CurrentVersion: encryptedDataKeys.CurrentVersion,
+		Versions:       versions,
+	}
+}
+
+func copyMetadata(metadata DataKeyMetadata) DataKeyMetadata {
+	if metadata.KMSKeyIDs != nil {
+		metadata.KMSKeyIDs = copyKeys(metadata.KMSKeyIDs)
+	}
+
+	return metadata
+}
+
+func copyKeys(keys map[string]string) map[string]string {
+	copied := make(map[string]string)
+	for region, key := range keys {
+		copied[region] = key
+	}
+
+	return copied
+}
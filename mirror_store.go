@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// mirrorTombstonePrefix starts the ids of the tombstones a MirrorStore keeps in the primary store for ids
+// whose delete did not reach the secondary store yet. Ids cannot contain control characters (see ValidateID),
+// so tombstones never collide with the ids of keys.
+const mirrorTombstonePrefix = "\x7fdeleted:"
+
+// mirrorTombstoneKey is the key of the only encrypted data key of a tombstone, whose value is the deleted id
+const mirrorTombstoneKey = "deleted_id"
+
+// MirrorStats - counters and lag of the writes mirrored by a MirrorStore
+type MirrorStats struct {
+	MirroredWrites     uint64
+	FailedMirrorWrites uint64
+	SecondaryReads     uint64
+
+	// PendingIDs is the number of ids whose last write may not have reached the secondary store yet,
+	// and Lag is how long the oldest of them has been pending
+	PendingIDs int
+	Lag        time.Duration
+}
+
+// ReconcileResult - what a reconciliation pass of a MirrorStore found and fixed
+type ReconcileResult struct {
+	CheckedIDs        int
+	CopiedToPrimary   int
+	CopiedToSecondary int
+	DeletedIDs        int
+
+	// DivergentIDs are the ids whose encrypted data keys differ between the stores
+	// and could not be reconciled automatically
+	DivergentIDs []string
+}
+
+// MirrorStore - Store decorator that writes to a primary store and mirrors every write to a secondary one,
+// so losing the primary store does not lose every data key.
+// Reads fall back to the secondary store only when the primary one fails; an id the primary store does not have
+// is missing even if the secondary one still has it, so deleted data keys are never served from a lagging mirror.
+type MirrorStore struct {
+	primary   Store
+	secondary Store
+
+	// ids whose mirrored write failed, with the time of their first failure.
+	// The primary store is the source of truth for these until they are reconciled.
+	// Failed deletes are also recorded durably, as tombstones in the primary store.
+	mutex          sync.Mutex
+	pending        map[string]time.Time
+	pendingDeletes map[string]time.Time
+
+	mirroredWrites     uint64
+	failedMirrorWrites uint64
+	secondaryReads     uint64
+}
+
+// NewMirrorStore creates a new MirrorStore writing to primary and mirroring to secondary
+func NewMirrorStore(primary Store, secondary Store) *MirrorStore {
+	return &MirrorStore{
+		primary:        primary,
+		secondary:      secondary,
+		pending:        make(map[string]time.Time),
+		pendingDeletes: make(map[string]time.Time),
+	}
+}
+
+// GetEncryptedDataKeys retrieves every version of the encrypted data keys for the given id
+// from the primary store, or from the secondary one if the primary one fails
+func (s *MirrorStore) GetEncryptedDataKeys(ctx context.Context, id string) (*EncryptedDataKeys, error) {
+	encryptedDataKeys, err := s.primary.GetEncryptedDataKeys(ctx, id)
+	if !s.shouldReadSecondary(ctx, err) {
+		return encryptedDataKeys, err
+	}
+
+	logger.Warnf("failed to read id %q from primary store, reading it from secondary store: %s", id, err)
+
+	secondaryEncryptedDataKeys, secondaryErr := s.secondary.GetEncryptedDataKeys(ctx, id)
+	if secondaryErr != nil {
+		logger.Errorf("failed to read id %q from secondary store: %s", id, secondaryErr)
+		return nil, err
+	}
+
+	atomic.AddUint64(&s.secondaryReads, 1)
+	return secondaryEncryptedDataKeys, nil
+}
+
+// GetEncryptedDataKeysBatch retrieves every version of the encrypted data keys for each of the given ids
+// from the primary store, or from the secondary one if the primary one fails
+func (s *MirrorStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]*EncryptedDataKeys, error) {
+	encryptedDataKeysByID, err := s.primary.GetEncryptedDataKeysBatch(ctx, ids)
+	if !s.shouldReadSecondary(ctx, err) {
+		return encryptedDataKeysByID, err
+	}
+
+	logger.Warnf("failed to read %d ids from primary store, reading them from secondary store: %s", len(ids), err)
+
+	secondaryEncryptedDataKeysByID, secondaryErr := s.secondary.GetEncryptedDataKeysBatch(ctx, ids)
+	if secondaryErr != nil {
+		logger.Errorf("failed to read %d ids from secondary store: %s", len(ids), secondaryErr)
+		return nil, err
+	}
+
+	atomic.AddUint64(&s.secondaryReads, uint64(len(secondaryEncryptedDataKeysByID)))
+	return secondaryEncryptedDataKeysByID, nil
+}
+
+// shouldReadSecondary reports whether a read from the primary store that returned err should be retried on the secondary one
+func (s *MirrorStore) shouldReadSecondary(ctx context.Context, err error) bool {
+	switch err.(type) {
+	case StoreUnavailableError, ThrottledError:
+		return ctx.Err() == nil
+	}
+
+	return false
+}
+
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id as its first version
+// in the primary store, and then mirrors it to the secondary store
+func (s *MirrorStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, keys map[string]string, incomplete bool, metadata DataKeyMetadata) error {
+	if err := s.primary.SetEncryptedDataKeysConditionally(ctx, id, keys, incomplete, metadata); err != nil {
+		return err
+	}
+
+	s.mirror(id, s.secondary.SetEncryptedDataKeysConditionally(ctx, id, keys, incomplete, metadata))
+	return nil
+}
+
+// AddEncryptedDataKeysVersionConditionally adds the encrypted data keys for the given id as a new version
+// in the primary store, and then mirrors it to the secondary store
+func (s *MirrorStore) AddEncryptedDataKeysVersionConditionally(ctx context.Context, id string, version int, keys map[string]string, incomplete bool, metadata DataKeyMetadata) error {
+	if err := s.primary.AddEncryptedDataKeysVersionConditionally(ctx, id, version, keys, incomplete, metadata); err != nil {
+		return err
+	}
+
+	s.mirror(id, s.secondary.AddEncryptedDataKeysVersionConditionally(ctx, id, version, keys, incomplete, metadata))
+	return nil
+}
+
+// UpdateEncryptedDataKeysConditionally sets the encrypted data keys of the regions in keys for the given version of id
+// in the primary store, and then mirrors the update to the secondary store
+func (s *MirrorStore) UpdateEncryptedDataKeysConditionally(ctx context.Context, id string, version int, previousKeys map[string]string, keys map[string]string, keyIDs map[string]string, complete bool) error {
+	if err := s.primary.UpdateEncryptedDataKeysConditionally(ctx, id, version, previousKeys, keys, keyIDs, complete); err != nil {
+		return err
+	}
+
+	s.mirror(id, s.secondary.UpdateEncryptedDataKeysConditionally(ctx, id, version, previousKeys, keys, keyIDs, complete))
+	return nil
+}
+
+// mirror records the outcome of a write to the secondary store that already succeeded in the primary one
+func (s *MirrorStore) mirror(id string, err error) {
+	if err == nil {
+		atomic.AddUint64(&s.mirroredWrites, 1)
+		return
+	}
+
+	atomic.AddUint64(&s.failedMirrorWrites, 1)
+	logger.Errorf("failed to mirror write of id %q to secondary store: %s", id, err)
+
+	s.mutex.Lock()
+	if _, ok := s.pending[id]; !ok {
+		s.pending[id] = time.Now()
+	}
+	s.mutex.Unlock()
+}
+
+// ListIDs returns up to limit ids stored in the primary store after the given cursor,
+// along with the cursor to continue from. Tombstones are left out, so a page may have fewer ids than limit.
+func (s *MirrorStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	ids, nextCursor, err := s.primary.ListIDs(ctx, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keyIDs := ids[:0]
+	for _, id := range ids {
+		if !isMirrorTombstone(id) {
+			keyIDs = append(keyIDs, id)
+		}
+	}
+
+	return keyIDs, nextCursor, nil
+}
+
+// DeleteEncryptedDataKeys removes every version of the encrypted data keys for the given id from both stores.
+// If the secondary store fails, a tombstone is written to the primary store so reconciliation finishes the delete
+// instead of copying the id back, even after a restart; the delete fails if the tombstone cannot be written either.
+// Deleting an id that is only left in the secondary store removes it from there.
+func (s *MirrorStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	primaryErr := s.primary.DeleteEncryptedDataKeys(ctx, id)
+	if _, ok := primaryErr.(IDNotFoundStoreError); !ok && primaryErr != nil {
+		return primaryErr
+	}
+
+	s.mutex.Lock()
+	delete(s.pending, id)
+	s.mutex.Unlock()
+
+	err := s.secondary.DeleteEncryptedDataKeys(ctx, id)
+	if _, ok := err.(IDNotFoundStoreError); ok {
+		return primaryErr
+	}
+
+	if err == nil {
+		atomic.AddUint64(&s.mirroredWrites, 1)
+		return nil
+	}
+
+	atomic.AddUint64(&s.failedMirrorWrites, 1)
+	logger.Errorf("failed to mirror delete of id %q to secondary store: %s", id, err)
+
+	if err := s.putTombstone(ctx, id); err != nil {
+		logger.Errorf("failed to write tombstone of id %q to primary store: %s", id, err)
+		return err
+	}
+
+	s.mutex.Lock()
+	if _, ok := s.pendingDeletes[id]; !ok {
+		s.pendingDeletes[id] = time.Now()
+	}
+	s.mutex.Unlock()
+	return primaryErr
+}
+
+// putTombstone records in the primary store that id still has to be deleted from the secondary store
+func (s *MirrorStore) putTombstone(ctx context.Context, id string) error {
+	keys := map[string]string{mirrorTombstoneKey: id}
+	err := s.primary.SetEncryptedDataKeysConditionally(ctx, mirrorTombstoneID(id), keys, false, DataKeyMetadata{CreatedAt: time.Now()})
+	if _, ok := err.(IDAlreadyExistsStoreError); ok {
+		return nil
+	}
+
+	return err
+}
+
+// hasTombstone reports whether the primary store has a tombstone for id
+func (s *MirrorStore) hasTombstone(ctx context.Context, id string) (bool, error) {
+	tombstone, err := s.primary.GetEncryptedDataKeys(ctx, mirrorTombstoneID(id))
+	return tombstone != nil, err
+}
+
+// finishDelete deletes the id of the given tombstone from the secondary store, and then the tombstone itself
+func (s *MirrorStore) finishDelete(ctx context.Context, tombstoneID string, result *ReconcileResult) error {
+	tombstone, err := s.primary.GetEncryptedDataKeys(ctx, tombstoneID)
+	if err != nil || tombstone == nil {
+		return err
+	}
+
+	id := tombstone.Versions[1].Keys[mirrorTombstoneKey]
+	err = s.secondary.DeleteEncryptedDataKeys(ctx, id)
+	if _, ok := err.(IDNotFoundStoreError); !ok && err != nil {
+		return err
+	}
+
+	err = s.primary.DeleteEncryptedDataKeys(ctx, tombstoneID)
+	if _, ok := err.(IDNotFoundStoreError); !ok && err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	delete(s.pendingDeletes, id)
+	s.mutex.Unlock()
+
+	logger.Infof("deleted id %q from secondary store", id)
+	result.DeletedIDs++
+	return nil
+}
+
+// mirrorTombstoneID returns the id of the tombstone of id, which fits in every store whatever the length of id
+func mirrorTombstoneID(id string) string {
+	hash := sha256.Sum256([]byte(id))
+	return mirrorTombstonePrefix + hex.EncodeToString(hash[:])
+}
+
+func isMirrorTombstone(id string) bool {
+	return strings.HasPrefix(id, mirrorTombstonePrefix)
+}
+
+// Stats returns the counters of the writes mirrored so far, along with the current lag of the secondary store
+func (s *MirrorStore) Stats() MirrorStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := MirrorStats{
+		MirroredWrites:     atomic.LoadUint64(&s.mirroredWrites),
+		FailedMirrorWrites: atomic.LoadUint64(&s.failedMirrorWrites),
+		SecondaryReads:     atomic.LoadUint64(&s.secondaryReads),
+		PendingIDs:         len(s.pending) + len(s.pendingDeletes),
+	}
+
+	var oldest time.Time
+	for _, pendingSince := range s.pending {
+		if oldest.IsZero() || pendingSince.Before(oldest) {
+			oldest = pendingSince
+		}
+	}
+	for _, pendingSince := range s.pendingDeletes {
+		if oldest.IsZero() || pendingSince.Before(oldest) {
+			oldest = pendingSince
+		}
+	}
+
+	if !oldest.IsZero() {
+		stats.Lag = time.Since(oldest)
+	}
+
+	return stats
+}
+
+// Reconcile compares every id of both stores and copies the ids missing from one store to the other.
+// Deletes that did not reach the secondary store are finished first, and their ids are never copied back.
+// Ids whose mirrored write failed are made to match the primary store; other ids whose encrypted data keys
+// differ between the stores are reported as divergent and left untouched.
+func (s *MirrorStore) Reconcile(ctx context.Context) (ReconcileResult, error) {
+	result := ReconcileResult{}
+
+	cursor := ""
+	for {
+		ids, nextCursor, err := s.primary.ListIDs(ctx, cursor, MaxBatchSize)
+		if err != nil {
+			return result, err
+		}
+
+		for _, id := range ids {
+			if !isMirrorTombstone(id) {
+				continue
+			}
+
+			if err := s.finishDelete(ctx, id, &result); err != nil {
+				return result, err
+			}
+		}
+
+		if nextCursor == "" {
+			break
+		}
+		cursor = nextCursor
+	}
+
+	checked := make(map[string]bool)
+	for _, store := range []Store{s.primary, s.secondary} {
+		cursor := ""
+		for {
+			ids, nextCursor, err := store.ListIDs(ctx, cursor, MaxBatchSize)
+			if err != nil {
+				return result, err
+			}
+
+			for _, id := range ids {
+				if checked[id] || isMirrorTombstone(id) {
+					continue
+				}
+				checked[id] = true
+
+				if err := s.reconcileID(ctx, id, &result); err != nil {
+					return result, err
+				}
+			}
+
+			if nextCursor == "" {
+				break
+			}
+			cursor = nextCursor
+		}
+	}
+
+	return result, nil
+}
+
+func (s *MirrorStore) reconcileID(ctx context.Context, id string, result *ReconcileResult) error {
+	result.CheckedIDs++
+
+	primaryEncryptedDataKeys, err := s.primary.GetEncryptedDataKeys(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	secondaryEncryptedDataKeys, err := s.secondary.GetEncryptedDataKeys(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	_, pending := s.pending[id]
+	s.mutex.Unlock()
+
+	switch {
+	case primaryEncryptedDataKeys == nil && secondaryEncryptedDataKeys == nil:
+		//deleted meanwhile
+	case primaryEncryptedDataKeys == nil:
+		//deleted meanwhile, but not from the secondary store yet
+		if deleted, err := s.hasTombstone(ctx, id); err != nil || deleted {
+			return err
+		}
+
+		if err := putEncryptedDataKeys(ctx, s.primary, id, secondaryEncryptedDataKeys); err != nil {
+			return err
+		}
+		logger.Infof("copied id %q from secondary store to primary store", id)
+		result.CopiedToPrimary++
+	case secondaryEncryptedDataKeys == nil:
+		if err := putEncryptedDataKeys(ctx, s.secondary, id, primaryEncryptedDataKeys); err != nil {
+			return err
+		}
+		logger.Infof("copied id %q from primary store to secondary store", id)
+		result.CopiedToSecondary++
+	case equalEncryptedDataKeys(primaryEncryptedDataKeys, secondaryEncryptedDataKeys):
+	case pending:
+		//the secondary store missed a write, so the primary store has the latest encrypted data keys
+		if err := s.secondary.DeleteEncryptedDataKeys(ctx, id); err != nil {
+			return err
+		}
+		if err := putEncryptedDataKeys(ctx, s.secondary, id, primaryEncryptedDataKeys); err != nil {
+			return err
+		}
+		logger.Infof("replaced id %q in secondary store with the one in primary store", id)
+		result.CopiedToSecondary++
+	default:
+		logger.Errorf("encrypted data keys of id %q differ between primary and secondary store", id)
+		result.DivergentIDs = append(result.DivergentIDs, id)
+		return nil
+	}
+
+	s.mutex.Lock()
+	delete(s.pending, id)
+	s.mutex.Unlock()
+	return nil
+}
+
+// StartReconciler reconciles both stores every interval and logs the mirror stats, until the process exits
+func (s *MirrorStore) StartReconciler(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			result, err := s.Reconcile(context.Background())
+			if err != nil {
+				logger.Errorf("failed to reconcile mirrored stores: %s", err)
+			}
+
+			logger.Infof("reconciled mirrored stores: %+v", result)
+			logger.Infof("mirror stats: %+v", s.Stats())
+		}
+	}()
+}
+
+// putEncryptedDataKeys writes every version of encryptedDataKeys for id to a store that does not have id yet
+func putEncryptedDataKeys(ctx context.Context, store Store, id string, encryptedDataKeys *EncryptedDataKeys) error {
+	first := encryptedDataKeys.Versions[1]
+	if err := store.SetEncryptedDataKeysConditionally(ctx, id, first.Keys, first.Incomplete, first.Metadata); err != nil {
+		return err
+	}
+
+	for version := 2; version <= encryptedDataKeys.CurrentVersion; version++ {
+		encryptedDataKeysVersion, ok := encryptedDataKeys.Versions[version]
+		if !ok { //keep the version numbers the same in both stores
+			encryptedDataKeysVersion = EncryptedDataKeysVersion{Keys: map[string]string{}, Incomplete: true}
+		}
+
+		err := store.AddEncryptedDataKeysVersionConditionally(ctx, id, version, encryptedDataKeysVersion.Keys, encryptedDataKeysVersion.Incomplete, encryptedDataKeysVersion.Metadata)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func equalEncryptedDataKeys(a *EncryptedDataKeys, b *EncryptedDataKeys) bool {
+	if a.CurrentVersion != b.CurrentVersion || len(a.Versions) != len(b.Versions) {
+		return false
+	}
+
+	for version, aVersion := range a.Versions {
+		bVersion, ok := b.Versions[version]
+		if !ok || aVersion.Incomplete != bVersion.Incomplete || len(aVersion.Keys) != len(bVersion.Keys) {
+			return false
+		}
+
+		for region, key := range aVersion.Keys {
+			if bVersion.Keys[region] != key {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3ObjectBucket - objectBucket in an S3-compatible bucket, under a key prefix.
+// The service must support conditional writes (If-None-Match and If-Match on PutObject), as S3 and MinIO do;
+// otherwise concurrent writers may overwrite each other.
+type s3ObjectBucket struct {
+	client *s3.S3
+	bucket string
+	prefix string
+}
+
+func newS3ObjectBucket(objectStoreConfig ObjectStoreConfig) (*s3ObjectBucket, error) {
+	if objectStoreConfig.Bucket == "" {
+		return nil, fmt.Errorf("an S3 bucket is required")
+	}
+
+	awsConfig := &aws.Config{
+		Region:           aws.String(objectStoreConfig.Region),
+		S3ForcePathStyle: aws.Bool(objectStoreConfig.ForcePathStyle),
+	}
+
+	if objectStoreConfig.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(objectStoreConfig.Endpoint)
+	}
+
+	if objectStoreConfig.AccessKeyID != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(objectStoreConfig.AccessKeyID, objectStoreConfig.SecretAccessKey, "")
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3ObjectBucket{s3.New(sess), objectStoreConfig.Bucket, objectStoreConfig.Prefix}, nil
+}
+
+func (b *s3ObjectBucket) getObject(ctx context.Context, name string) ([]byte, string, error) {
+	output, err := b.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + name),
+	})
+	if isS3NotFoundError(err) {
+		return nil, "", nil
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+	defer output.Body.Close()
+
+	data, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, aws.StringValue(output.ETag), nil
+}
+
+func (b *s3ObjectBucket) createObject(ctx context.Context, name string, data []byte) error {
+	err := b.putObject(ctx, name, data, "If-None-Match", "*")
+	if isS3PreconditionFailedError(err) {
+		return errObjectExists
+	}
+
+	return err
+}
+
+func (b *s3ObjectBucket) replaceObject(ctx context.Context, name string, data []byte, etag string) error {
+	err := b.putObject(ctx, name, data, "If-Match", etag)
+	if isS3PreconditionFailedError(err) || isS3NotFoundError(err) {
+		return errObjectChanged
+	}
+
+	return err
+}
+
+// putObject writes the object with the given conditional header, which this version of the SDK has no field for
+func (b *s3ObjectBucket) putObject(ctx context.Context, name string, data []byte, conditionHeader string, conditionValue string) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(b.bucket),
+		Key:         aws.String(b.prefix + name),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	}
+
+	_, err := b.client.PutObjectWithContext(ctx, input, func(r *request.Request) {
+		r.HTTPRequest.Header.Set(conditionHeader, conditionValue)
+	})
+	return err
+}
+
+func (b *s3ObjectBucket) listObjects(ctx context.Context, startAfter string, limit int) ([]string, bool, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(b.prefix),
+	}
+
+	if startAfter != "" {
+		input.StartAfter = aws.String(b.prefix + startAfter)
+	}
+
+	if limit > 0 {
+		input.MaxKeys = aws.Int64(int64(limit))
+	}
+
+	output, err := b.client.ListObjectsV2WithContext(ctx, input)
+	if err != nil {
+		return nil, false, err
+	}
+
+	names := make([]string, 0, len(output.Contents))
+	for _, object := range output.Contents {
+		names = append(names, strings.TrimPrefix(aws.StringValue(object.Key), b.prefix))
+	}
+
+	return names, aws.BoolValue(output.IsTruncated), nil
+}
+
+func (b *s3ObjectBucket) deleteObject(ctx context.Context, name string) (bool, error) {
+	//S3 deletes succeed whether or not the object exists
+	_, err := b.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + name),
+	})
+	if isS3NotFoundError(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	_, err = b.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + name),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func isS3NotFoundError(err error) bool {
+	if requestErr, ok := err.(awserr.RequestFailure); ok {
+		return requestErr.StatusCode() == http.StatusNotFound
+	}
+
+	return false
+}
+
+func isS3PreconditionFailedError(err error) bool {
+	if requestErr, ok := err.(awserr.RequestFailure); ok {
+		//409 is returned when a concurrent conditional write to the same key is in progress
+		return requestErr.StatusCode() == http.StatusPreconditionFailed || requestErr.StatusCode() == http.StatusConflict
+	}
+
+	return false
+}
+
+// directoryObjectBucket - objectBucket in a local directory, one file per object.
+// Creates are atomic across processes, but replaces are only atomic within one process,
+// so a directory must not be shared by several RKMS servers.
+type directoryObjectBucket struct {
+	path string
+
+	// serializes replaces and deletes, so the etag check and the write happen together
+	mutex sync.Mutex
+}
+
+func newDirectoryObjectBucket(path string) (*directoryObjectBucket, error) {
+	if path == "" {
+		return nil, fmt.Errorf("an object store directory is required")
+	}
+
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+
+	return &directoryObjectBucket{path: path}, nil
+}
+
+func (b *directoryObjectBucket) getObject(ctx context.Context, name string) ([]byte, string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(b.path, name))
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, directoryObjectETag(data), nil
+}
+
+func (b *directoryObjectBucket) createObject(ctx context.Context, name string, data []byte) error {
+	tmp, err := b.writeTempFile(data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	//unlike a rename, a link fails if the object exists, and the object appears with its whole content
+	err = os.Link(tmp, filepath.Join(b.path, name))
+	if os.IsExist(err) {
+		return errObjectExists
+	}
+
+	return err
+}
+
+func (b *directoryObjectBucket) replaceObject(ctx context.Context, name string, data []byte, etag string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	current, currentETag, err := b.getObject(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if current == nil || currentETag != etag {
+		return errObjectChanged
+	}
+
+	tmp, err := b.writeTempFile(data)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(b.path, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+func (b *directoryObjectBucket) listObjects(ctx context.Context, startAfter string, limit int) ([]string, bool, error) {
+	file, err := os.Open(b.path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	allNames, err := file.Readdirnames(-1)
+	if err != nil {
+		return nil, false, err
+	}
+	sort.Strings(allNames)
+
+	var names []string
+	for _, name := range allNames {
+		if strings.HasPrefix(name, ".") || name <= startAfter {
+			continue //temporary files start with a dot
+		}
+
+		if limit > 0 && len(names) == limit {
+			return names, true, nil
+		}
+		names = append(names, name)
+	}
+
+	return names, false, nil
+}
+
+func (b *directoryObjectBucket) deleteObject(ctx context.Context, name string) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	err := os.Remove(filepath.Join(b.path, name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// writeTempFile writes data to a new temporary file in the directory and flushes it to disk
+func (b *directoryObjectBucket) writeTempFile(data []byte) (string, error) {
+	file, err := ioutil.TempFile(b.path, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+func directoryObjectETag(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// the object storage backends ObjectStore supports
+const (
+	ObjectStorageS3        = "s3"
+	ObjectStorageDirectory = "directory"
+)
+
+// maxEncodedObjectIDLength is the length in bytes of the longest id whose object is named after the id itself.
+// Longer ids are named after their hash so every object name fits in a file name.
+const maxEncodedObjectIDLength = 100
+
+// prefixes of the two kinds of object names
+const (
+	encodedObjectNamePrefix = "x-"
+	hashedObjectNamePrefix  = "h-"
+)
+
+var (
+	errObjectExists  = errors.New("object already exists")
+	errObjectChanged = errors.New("object was changed or removed meanwhile")
+)
+
+// objectBucket - where ObjectStore keeps its objects; names given to it are safe to use as keys and file names
+type objectBucket interface {
+	// getObject returns nil data if the object does not exist, and otherwise its content along with
+	// an etag that changes whenever the content does
+	getObject(ctx context.Context, name string) (data []byte, etag string, err error)
+
+	// createObject returns errObjectExists if the object exists already
+	createObject(ctx context.Context, name string, data []byte) error
+
+	// replaceObject returns errObjectChanged if the etag of the object is not the given one anymore
+	replaceObject(ctx context.Context, name string, data []byte, etag string) error
+
+	// listObjects returns up to limit names after startAfter in lexicographic order, and whether there are more
+	listObjects(ctx context.Context, startAfter string, limit int) (names []string, more bool, err error)
+
+	// deleteObject returns false if the object did not exist
+	deleteObject(ctx context.Context, name string) (bool, error)
+}
+
+// ObjectStore - object storage implementation of the Store interface, for an S3-compatible bucket or a local directory.
+// Every id is kept as a JSON object (see jsonItem). First writes are conditional creates and updates are
+// conditional on the etag of the object read, so concurrent writers cannot overwrite each other.
+type ObjectStore struct {
+	bucket objectBucket
+}
+
+// NewObjectStore creates a new ObjectStore instance for the configured backend
+func NewObjectStore(objectStoreConfig ObjectStoreConfig) (*ObjectStore, error) {
+	switch objectStoreConfig.Backend {
+	case ObjectStorageS3:
+		bucket, err := newS3ObjectBucket(objectStoreConfig)
+		if err != nil {
+			return nil, err
+		}
+		return &ObjectStore{bucket}, nil
+	case ObjectStorageDirectory:
+		bucket, err := newDirectoryObjectBucket(objectStoreConfig.Directory)
+		if err != nil {
+			return nil, err
+		}
+		return &ObjectStore{bucket}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported object storage backend %q", objectStoreConfig.Backend)
+}
+
+// objectName returns the name of the object of id, which only contains characters safe in object keys and file names.
+// Names are lowercase, so ids cannot collide on case-insensitive file systems.
+func objectName(id string) string {
+	if len(id) <= maxEncodedObjectIDLength {
+		return encodedObjectNamePrefix + hex.EncodeToString([]byte(id))
+	}
+
+	hash := sha256.Sum256([]byte(id))
+	return hashedObjectNamePrefix + hex.EncodeToString(hash[:])
+}
+
+// GetEncryptedDataKeys retrieves every version of the encrypted data keys for the given id
+func (s *ObjectStore) GetEncryptedDataKeys(ctx context.Context, id string) (*EncryptedDataKeys, error) {
+	encryptedDataKeys, _, err := s.get(ctx, id)
+	return encryptedDataKeys, err
+}
+
+// get returns the encrypted data keys of id along with the etag of their object
+func (s *ObjectStore) get(ctx context.Context, id string) (*EncryptedDataKeys, string, error) {
+	data, etag, err := s.bucket.getObject(ctx, objectName(id))
+	if err != nil {
+		logger.Print(err)
+		return nil, "", newStoreError(ctx, err)
+	}
+
+	if data == nil {
+		return nil, "", nil
+	}
+
+	//never serve the keys of another id whose object got the same name
+	storedID, err := objectItemID(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if storedID != id {
+		err := fmt.Errorf("object %s holds id %q instead of %q", objectName(id), storedID, id)
+		logger.Error(err)
+		return nil, "", err
+	}
+
+	encryptedDataKeys, err := unmarshalJSONItem(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return encryptedDataKeys, etag, nil
+}
+
+// GetEncryptedDataKeysBatch retrieves every version of the encrypted data keys for each of the given ids,
+// reading up to DefaultBatchConcurrency objects at a time
+func (s *ObjectStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]*EncryptedDataKeys, error) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	encryptedDataKeysByID := make(map[string]*EncryptedDataKeys)
+	semaphore := make(chan struct{}, DefaultBatchConcurrency)
+
+	for _, id := range ids {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(id string) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+
+			encryptedDataKeys, err := s.GetEncryptedDataKeys(ctx, id)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+
+			if encryptedDataKeys != nil {
+				encryptedDataKeysByID[id] = encryptedDataKeys
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return encryptedDataKeysByID, nil
+}
+
+// SetEncryptedDataKeysConditionally creates the object of the given id with its first version,
+// only if the object does not exist already
+func (s *ObjectStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, keys map[string]string, incomplete bool, metadata DataKeyMetadata) error {
+	data, err := marshalObject(id, newEncryptedDataKeys(keys, incomplete, metadata))
+	if err != nil {
+		return err
+	}
+
+	err = s.bucket.createObject(ctx, objectName(id), data)
+	if err == errObjectExists {
+		return IDAlreadyExistsStoreError{ID: id}
+	}
+
+	if err != nil {
+		logger.Print(err)
+		return newStoreError(ctx, err)
+	}
+
+	return nil
+}
+
+// AddEncryptedDataKeysVersionConditionally adds the encrypted data keys for the given id as a new version
+// and makes it the current version, only if the current version of id is still version-1
+func (s *ObjectStore) AddEncryptedDataKeysVersionConditionally(ctx context.Context, id string, version int, keys map[string]string, incomplete bool, metadata DataKeyMetadata) error {
+	return s.updateConditionally(ctx, id, func(encryptedDataKeys *EncryptedDataKeys) error {
+		return addEncryptedDataKeysVersion(encryptedDataKeys, id, version, keys, incomplete, metadata)
+	})
+}
+
+// UpdateEncryptedDataKeysConditionally sets the encrypted data keys of the regions in keys for the given version of id,
+// only if the current encrypted data key of each of those regions still matches the one in previousKeys
+func (s *ObjectStore) UpdateEncryptedDataKeysConditionally(ctx context.Context, id string, version int, previousKeys map[string]string, keys map[string]string, keyIDs map[string]string, complete bool) error {
+	return s.updateConditionally(ctx, id, func(encryptedDataKeys *EncryptedDataKeys) error {
+		return updateEncryptedDataKeysVersion(encryptedDataKeys, id, version, previousKeys, keys, keyIDs, complete)
+	})
+}
+
+// updateConditionally reads the object of id, lets update change it and writes it back,
+// only if the object was not changed in between
+func (s *ObjectStore) updateConditionally(ctx context.Context, id string, update func(*EncryptedDataKeys) error) error {
+	encryptedDataKeys, etag, err := s.get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := update(encryptedDataKeys); err != nil {
+		return err
+	}
+
+	data, err := marshalObject(id, encryptedDataKeys)
+	if err != nil {
+		return err
+	}
+
+	err = s.bucket.replaceObject(ctx, objectName(id), data, etag)
+	if err == errObjectChanged {
+		return ConditionalUpdateFailedStoreError{ID: id}
+	}
+
+	if err != nil {
+		logger.Print(err)
+		return newStoreError(ctx, err)
+	}
+
+	return nil
+}
+
+// ListIDs returns up to limit ids stored after the given cursor, along with the cursor to continue from.
+// Ids are listed in the order of their object names and the cursor is the last object name listed.
+func (s *ObjectStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	names, more, err := s.bucket.listObjects(ctx, cursor, limit)
+	if err != nil {
+		logger.Print(err)
+		return nil, "", newStoreError(ctx, err)
+	}
+
+	ids := make([]string, 0, len(names))
+	for _, name := range names {
+		id, err := s.objectID(ctx, name)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+
+	if !more || len(names) == 0 {
+		return ids, "", nil
+	}
+
+	return ids, names[len(names)-1], nil
+}
+
+// objectID returns the id an object is named after, reading it from the object if its name is a hash.
+// An empty id is returned for an object that is not one of ours or was deleted meanwhile.
+func (s *ObjectStore) objectID(ctx context.Context, name string) (string, error) {
+	if strings.HasPrefix(name, encodedObjectNamePrefix) {
+		id, err := hex.DecodeString(strings.TrimPrefix(name, encodedObjectNamePrefix))
+		if err != nil {
+			return "", nil
+		}
+		return string(id), nil
+	}
+
+	if !strings.HasPrefix(name, hashedObjectNamePrefix) {
+		return "", nil
+	}
+
+	data, _, err := s.bucket.getObject(ctx, name)
+	if err != nil {
+		logger.Print(err)
+		return "", newStoreError(ctx, err)
+	}
+
+	if data == nil {
+		return "", nil
+	}
+
+	return objectItemID(data)
+}
+
+// objectItemID returns the id the given object content names
+func objectItemID(data []byte) (string, error) {
+	item := jsonItem{}
+	if err := json.Unmarshal(data, &item); err != nil {
+		return "", err
+	}
+
+	return item.ID, nil
+}
+
+// DeleteEncryptedDataKeys removes the object of the given id
+func (s *ObjectStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	deleted, err := s.bucket.deleteObject(ctx, objectName(id))
+	if err != nil {
+		logger.Print(err)
+		return newStoreError(ctx, err)
+	}
+
+	if !deleted {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	return nil
+}
+
+// marshalObject returns the content of the object of id, which names the id since the object name may be a hash
+func marshalObject(id string, encryptedDataKeys *EncryptedDataKeys) ([]byte, error) {
+	item := newJSONItem(encryptedDataKeys)
+	item.ID = id
+	return json.Marshal(item)
+}
@@ -0,0 +1,11 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package main
+
+import "fmt"
+
+// newPKCS11KeyWrapper fails for builds without the pkcs11 build tag, which leave out PKCS#11 and its cgo dependency
+func newPKCS11KeyWrapper(backendConfig WrappingBackendConfig) (KeyWrapper, error) {
+	return nil, fmt.Errorf("key-wrapping backend %s: pkcs11 support not compiled in, build RKMS with -tags pkcs11", backendConfig.Name)
+}
@@ -0,0 +1,16 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPKCS11KeyWrapperNotCompiledIn(t *testing.T) {
+	_, err := newKeyWrapper(WrappingBackendConfig{Name: "hsm", Type: WrappingBackendPKCS11, ModulePath: "/usr/lib/softhsm/libsofthsm2.so", KeyLabel: "rkms"})
+	if err == nil || !strings.Contains(err.Error(), "pkcs11 support not compiled in") {
+		t.Fatalf("expected pkcs11 backends to fail without the pkcs11 build tag, got: %v", err)
+	}
+}
@@ -0,0 +1,413 @@
+//go:build pkcs11
+// +build pkcs11
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// DefaultPKCS11MaxSessions is the number of sessions opened with the HSM at most when none is configured
+const DefaultPKCS11MaxSessions = 8
+
+// pkcs11WrappedKeyFormat is the first byte of every data key wrapped by a PKCS11KeyWrapper
+const pkcs11WrappedKeyFormat = 1
+
+// the size of the IV and of the tag of AES-GCM as used by a PKCS11KeyWrapper
+const (
+	pkcs11GCMIVSize     = 12
+	pkcs11GCMTagSizeBit = 128
+)
+
+// pkcs11Module - the calls to a PKCS#11 module a PKCS11KeyWrapper makes once it has found its token
+// (see pkcs11Ctx)
+type pkcs11Module interface {
+	OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error)
+	CloseSession(sh pkcs11.SessionHandle) error
+	Login(sh pkcs11.SessionHandle, userType uint, pin string) error
+	FindObjectsInit(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) error
+	FindObjects(sh pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error)
+	FindObjectsFinal(sh pkcs11.SessionHandle) error
+	GenerateRandom(sh pkcs11.SessionHandle, length int) ([]byte, error)
+
+	// encryptGCM returns the ciphertext along with the IV actually used, since some HSMs ignore the given one
+	encryptGCM(sh pkcs11.SessionHandle, key pkcs11.ObjectHandle, iv []byte, additionalData []byte, plaintext []byte) ([]byte, []byte, error)
+	decryptGCM(sh pkcs11.SessionHandle, key pkcs11.ObjectHandle, iv []byte, additionalData []byte, ciphertext []byte) ([]byte, error)
+}
+
+// pkcs11Ctx - pkcs11Module implementation for a loaded PKCS#11 module
+type pkcs11Ctx struct {
+	*pkcs11.Ctx
+}
+
+func (c pkcs11Ctx) encryptGCM(sh pkcs11.SessionHandle, key pkcs11.ObjectHandle, iv []byte, additionalData []byte, plaintext []byte) ([]byte, []byte, error) {
+	params := pkcs11.NewGCMParams(iv, additionalData, pkcs11GCMTagSizeBit)
+	defer params.Free()
+
+	if err := c.EncryptInit(sh, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_GCM, params)}, key); err != nil {
+		return nil, nil, err
+	}
+
+	ciphertext, err := c.Encrypt(sh, plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if usedIV := params.IV(); len(usedIV) == len(iv) {
+		iv = usedIV
+	}
+
+	return ciphertext, iv, nil
+}
+
+func (c pkcs11Ctx) decryptGCM(sh pkcs11.SessionHandle, key pkcs11.ObjectHandle, iv []byte, additionalData []byte, ciphertext []byte) ([]byte, error) {
+	params := pkcs11.NewGCMParams(iv, additionalData, pkcs11GCMTagSizeBit)
+	defer params.Free()
+
+	if err := c.DecryptInit(sh, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_GCM, params)}, key); err != nil {
+		return nil, err
+	}
+
+	return c.Decrypt(sh, ciphertext)
+}
+
+// PKCS11KeyWrapper - KeyWrapper implementation for an AES key resident in an HSM, used through its PKCS#11 module.
+// Data keys are generated by the HSM and wrapped with AES-GCM (CKM_AES_GCM) under the key with the configured label.
+// A wrapped key is the format byte, the length and label of the key that wrapped it, the IV and the GCM ciphertext;
+// everything before the IV is authenticated as additional data. Keys are found by label, so rotating is creating
+// a key with a new label in the HSM, configuring it, and re-wrapping; the old key must stay until then.
+type PKCS11KeyWrapper struct {
+	module   pkcs11Module
+	slot     uint
+	pin      string
+	tokenID  string
+	keyLabel string
+
+	// idle holds the open sessions not in use; at most cap(opened) are open at once
+	idle   chan pkcs11.SessionHandle
+	opened chan struct{}
+
+	mutex sync.Mutex
+	keys  map[string]pkcs11.ObjectHandle //by label
+}
+
+// newPKCS11KeyWrapper loads the PKCS#11 module of the given backend, finds its token and logs in to it
+func newPKCS11KeyWrapper(backendConfig WrappingBackendConfig) (*PKCS11KeyWrapper, error) {
+	pin, err := readPKCS11PIN(backendConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := pkcs11.New(backendConfig.ModulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module %s of key-wrapping backend %s", backendConfig.ModulePath, backendConfig.Name)
+	}
+
+	if err := ctx.Initialize(); err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		return nil, fmt.Errorf("failed to initialize PKCS#11 module %s: %s", backendConfig.ModulePath, err)
+	}
+
+	slot, tokenID := backendConfig.Slot, fmt.Sprintf("slot-%d", backendConfig.Slot)
+	if backendConfig.TokenLabel != "" {
+		slot, err = findPKCS11Slot(ctx, backendConfig.TokenLabel)
+		if err != nil {
+			ctx.Destroy()
+			return nil, err
+		}
+		tokenID = backendConfig.TokenLabel
+	}
+
+	w := newPKCS11KeyWrapperWithModule(pkcs11Ctx{ctx}, slot, pin, tokenID, backendConfig.KeyLabel, backendConfig.MaxSessions)
+
+	//fail fast on a wrong PIN or key label
+	if _, err := w.CurrentKeyID(context.Background()); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("key-wrapping backend %s is not usable: %s", backendConfig.Name, err)
+	}
+
+	return w, nil
+}
+
+func newPKCS11KeyWrapperWithModule(module pkcs11Module, slot uint, pin string, tokenID string, keyLabel string, maxSessions int) *PKCS11KeyWrapper {
+	if maxSessions <= 0 {
+		maxSessions = DefaultPKCS11MaxSessions
+	}
+
+	return &PKCS11KeyWrapper{
+		module:   module,
+		slot:     slot,
+		pin:      pin,
+		tokenID:  tokenID,
+		keyLabel: keyLabel,
+		idle:     make(chan pkcs11.SessionHandle, maxSessions),
+		opened:   make(chan struct{}, maxSessions),
+		keys:     make(map[string]pkcs11.ObjectHandle),
+	}
+}
+
+// readPKCS11PIN returns the PIN of the user of the token, from wherever the backend is configured to take it
+func readPKCS11PIN(backendConfig WrappingBackendConfig) (string, error) {
+	switch {
+	case backendConfig.PINFile != "":
+		b, err := ioutil.ReadFile(backendConfig.PINFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read PIN of key-wrapping backend %s: %s", backendConfig.Name, err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	case backendConfig.PINEnv != "":
+		return os.Getenv(backendConfig.PINEnv), nil
+	}
+
+	return backendConfig.PIN, nil
+}
+
+func findPKCS11Slot(ctx *pkcs11.Ctx, tokenLabel string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list PKCS#11 slots: %s", err)
+	}
+
+	for _, slot := range slots {
+		tokenInfo, err := ctx.GetTokenInfo(slot)
+		if err == nil && tokenInfo.Label == tokenLabel {
+			return slot, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no PKCS#11 token is labeled %q", tokenLabel)
+}
+
+// GenerateDataKey generates a data key with the random number generator of the HSM and wraps it
+func (w *PKCS11KeyWrapper) GenerateDataKey(ctx context.Context, sizeInBytes int) ([]byte, []byte, string, error) {
+	var plaintext []byte
+	err := w.withSession(ctx, func(session pkcs11.SessionHandle) error {
+		var err error
+		plaintext, err = w.module.GenerateRandom(session, sizeInBytes)
+		return err
+	})
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	ciphertext, keyID, err := w.WrapKey(ctx, plaintext)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	return plaintext, ciphertext, keyID, nil
+}
+
+// WrapKey encrypts the given data key with the configured key of the HSM
+func (w *PKCS11KeyWrapper) WrapKey(ctx context.Context, plaintext []byte) ([]byte, string, error) {
+	return w.wrapKey(ctx, plaintext, w.keyLabel)
+}
+
+func (w *PKCS11KeyWrapper) wrapKey(ctx context.Context, plaintext []byte, keyLabel string) ([]byte, string, error) {
+	header := pkcs11WrappedKeyHeader(keyLabel)
+
+	iv := make([]byte, pkcs11GCMIVSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, "", err
+	}
+
+	var ciphertext []byte
+	err := w.withKey(ctx, keyLabel, func(session pkcs11.SessionHandle, key pkcs11.ObjectHandle) error {
+		sealed, usedIV, err := w.module.encryptGCM(session, key, iv, header, plaintext)
+		if err != nil {
+			return err
+		}
+
+		ciphertext = append(append(header, usedIV...), sealed...)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return ciphertext, w.keyID(keyLabel), nil
+}
+
+// UnwrapKey decrypts the given data key with the key of the HSM that wrapped it
+func (w *PKCS11KeyWrapper) UnwrapKey(ctx context.Context, ciphertext []byte) ([]byte, string, error) {
+	if len(ciphertext) < 2 || ciphertext[0] != pkcs11WrappedKeyFormat || len(ciphertext) < 2+int(ciphertext[1])+pkcs11GCMIVSize {
+		return nil, "", CorruptedWrappedKeyError{fmt.Errorf("not a data key wrapped by a PKCS#11 backend")}
+	}
+
+	keyLabel := string(ciphertext[2 : 2+int(ciphertext[1])])
+	headerSize := len(pkcs11WrappedKeyHeader(keyLabel))
+	iv := ciphertext[headerSize : headerSize+pkcs11GCMIVSize]
+
+	var plaintext []byte
+	err := w.withKey(ctx, keyLabel, func(session pkcs11.SessionHandle, key pkcs11.ObjectHandle) error {
+		var err error
+		plaintext, err = w.module.decryptGCM(session, key, iv, ciphertext[:headerSize], ciphertext[headerSize+pkcs11GCMIVSize:])
+		return err
+	})
+	if err != nil {
+		switch err {
+		case pkcs11.Error(pkcs11.CKR_ENCRYPTED_DATA_INVALID), pkcs11.Error(pkcs11.CKR_ENCRYPTED_DATA_LEN_RANGE):
+			return nil, "", CorruptedWrappedKeyError{err}
+		}
+		return nil, "", err
+	}
+
+	return plaintext, w.keyID(keyLabel), nil
+}
+
+// CurrentKeyID returns the id of the configured key, after checking that it exists in the HSM
+func (w *PKCS11KeyWrapper) CurrentKeyID(ctx context.Context) (string, error) {
+	err := w.withKey(ctx, w.keyLabel, func(pkcs11.SessionHandle, pkcs11.ObjectHandle) error {
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return w.keyID(w.keyLabel), nil
+}
+
+// RewrapKey decrypts the given data key and wraps it again under the key of the HSM with the given id.
+// Unlike with KMS, the data key passes through RKMS's memory on the way, as it does when it is unwrapped.
+func (w *PKCS11KeyWrapper) RewrapKey(ctx context.Context, ciphertext []byte, keyID string) ([]byte, error) {
+	prefix := w.keyID("")
+	if !strings.HasPrefix(keyID, prefix) {
+		return nil, fmt.Errorf("%s is not a key of PKCS#11 token %s", keyID, w.tokenID)
+	}
+
+	plaintext, _, err := w.UnwrapKey(ctx, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	rewrappedCiphertext, _, err := w.wrapKey(ctx, plaintext, strings.TrimPrefix(keyID, prefix))
+	return rewrappedCiphertext, err
+}
+
+// keyID returns the id of the key with the given label, which includes the token it is in
+func (w *PKCS11KeyWrapper) keyID(keyLabel string) string {
+	return fmt.Sprintf("pkcs11:%s/%s", w.tokenID, keyLabel)
+}
+
+func pkcs11WrappedKeyHeader(keyLabel string) []byte {
+	return append([]byte{pkcs11WrappedKeyFormat, byte(len(keyLabel))}, keyLabel...)
+}
+
+// withKey calls f with a session and the handle of the key with the given label
+func (w *PKCS11KeyWrapper) withKey(ctx context.Context, keyLabel string, f func(pkcs11.SessionHandle, pkcs11.ObjectHandle) error) error {
+	return w.withSession(ctx, func(session pkcs11.SessionHandle) error {
+		key, err := w.findKey(session, keyLabel)
+		if err != nil {
+			return err
+		}
+
+		err = f(session, key)
+		if err == pkcs11.Error(pkcs11.CKR_KEY_HANDLE_INVALID) || err == pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID) {
+			w.mutex.Lock()
+			delete(w.keys, keyLabel)
+			w.mutex.Unlock()
+		}
+		return err
+	})
+}
+
+func (w *PKCS11KeyWrapper) findKey(session pkcs11.SessionHandle, keyLabel string) (pkcs11.ObjectHandle, error) {
+	w.mutex.Lock()
+	key, ok := w.keys[keyLabel]
+	w.mutex.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel),
+	}
+
+	if err := w.module.FindObjectsInit(session, template); err != nil {
+		return 0, err
+	}
+
+	keys, _, err := w.module.FindObjects(session, 2)
+	if finalErr := w.module.FindObjectsFinal(session); err == nil {
+		err = finalErr
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(keys) != 1 {
+		return 0, fmt.Errorf("expected 1 secret key labeled %q in PKCS#11 token %s, found %d", keyLabel, w.tokenID, len(keys))
+	}
+
+	w.mutex.Lock()
+	w.keys[keyLabel] = keys[0]
+	w.mutex.Unlock()
+	return keys[0], nil
+}
+
+// withSession calls f with a logged in session that no one else uses meanwhile,
+// opening a new one if none is idle and fewer than the maximum are open
+func (w *PKCS11KeyWrapper) withSession(ctx context.Context, f func(pkcs11.SessionHandle) error) error {
+	session, err := w.acquireSession(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = f(session)
+	switch err {
+	case pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID), pkcs11.Error(pkcs11.CKR_SESSION_CLOSED),
+		pkcs11.Error(pkcs11.CKR_DEVICE_REMOVED), pkcs11.Error(pkcs11.CKR_TOKEN_NOT_PRESENT),
+		pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN), pkcs11.Error(pkcs11.CKR_DEVICE_ERROR):
+		//the session is gone with the token or the login; open a new one next time
+		w.module.CloseSession(session)
+		<-w.opened
+
+		w.mutex.Lock()
+		w.keys = make(map[string]pkcs11.ObjectHandle)
+		w.mutex.Unlock()
+	default:
+		w.idle <- session
+	}
+
+	return err
+}
+
+func (w *PKCS11KeyWrapper) acquireSession(ctx context.Context) (pkcs11.SessionHandle, error) {
+	select {
+	case session := <-w.idle:
+		return session, nil
+	default:
+	}
+
+	select {
+	case session := <-w.idle:
+		return session, nil
+	case w.opened <- struct{}{}:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	session, err := w.module.OpenSession(w.slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		<-w.opened
+		return 0, fmt.Errorf("failed to open a PKCS#11 session: %s", err)
+	}
+
+	//the login is shared by every session of the token, so it may be there already
+	if err := w.module.Login(session, pkcs11.CKU_USER, w.pin); err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		w.module.CloseSession(session)
+		<-w.opened
+		return 0, fmt.Errorf("failed to log in to PKCS#11 token %s: %s", w.tokenID, err)
+	}
+
+	return session, nil
+}
@@ -0,0 +1,224 @@
+//go:build pkcs11
+// +build pkcs11
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"os"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+// fakePKCS11Module is a token with AES keys for PKCS11KeyWrapper, implemented with the standard library.
+// Sessions are invalidated when the token is "removed", like a real HSM would do on restart.
+type fakePKCS11Module struct {
+	keys         map[string][]byte
+	sessions     map[pkcs11.SessionHandle]bool
+	openSessions int
+	logins       int
+	findLabel    string
+}
+
+func newFakePKCS11Module(labels ...string) *fakePKCS11Module {
+	m := &fakePKCS11Module{keys: make(map[string][]byte), sessions: make(map[pkcs11.SessionHandle]bool)}
+	for i, label := range labels {
+		m.keys[label] = bytes.Repeat([]byte{byte(i + 1)}, 32)
+	}
+	return m
+}
+
+func (m *fakePKCS11Module) removeToken() {
+	m.sessions = make(map[pkcs11.SessionHandle]bool)
+}
+
+func (m *fakePKCS11Module) OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error) {
+	m.openSessions++
+	session := pkcs11.SessionHandle(m.openSessions)
+	m.sessions[session] = true
+	return session, nil
+}
+
+func (m *fakePKCS11Module) CloseSession(sh pkcs11.SessionHandle) error {
+	delete(m.sessions, sh)
+	return nil
+}
+
+func (m *fakePKCS11Module) Login(sh pkcs11.SessionHandle, userType uint, pin string) error {
+	if pin != "1234" {
+		return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	}
+	m.logins++
+	return nil
+}
+
+func (m *fakePKCS11Module) FindObjectsInit(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) error {
+	for _, attribute := range temp {
+		if attribute.Type == pkcs11.CKA_LABEL {
+			m.findLabel = string(attribute.Value)
+		}
+	}
+	return m.checkSession(sh)
+}
+
+func (m *fakePKCS11Module) FindObjects(sh pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error) {
+	if _, ok := m.keys[m.findLabel]; !ok {
+		return nil, false, nil
+	}
+	return []pkcs11.ObjectHandle{pkcs11.ObjectHandle(len(m.findLabel))}, false, nil
+}
+
+func (m *fakePKCS11Module) FindObjectsFinal(sh pkcs11.SessionHandle) error {
+	return nil
+}
+
+func (m *fakePKCS11Module) GenerateRandom(sh pkcs11.SessionHandle, length int) ([]byte, error) {
+	return []byte(testDataKey)[:length], m.checkSession(sh)
+}
+
+func (m *fakePKCS11Module) encryptGCM(sh pkcs11.SessionHandle, key pkcs11.ObjectHandle, iv []byte, additionalData []byte, plaintext []byte) ([]byte, []byte, error) {
+	aead, err := m.aead(sh, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead.Seal(nil, iv, plaintext, additionalData), iv, nil
+}
+
+func (m *fakePKCS11Module) decryptGCM(sh pkcs11.SessionHandle, key pkcs11.ObjectHandle, iv []byte, additionalData []byte, ciphertext []byte) ([]byte, error) {
+	aead, err := m.aead(sh, key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, iv, ciphertext, additionalData)
+	if err != nil {
+		return nil, pkcs11.Error(pkcs11.CKR_ENCRYPTED_DATA_INVALID)
+	}
+	return plaintext, nil
+}
+
+func (m *fakePKCS11Module) checkSession(sh pkcs11.SessionHandle) error {
+	if !m.sessions[sh] {
+		return pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)
+	}
+	return nil
+}
+
+// aead returns the cipher of the key whose handle is the length of its label
+func (m *fakePKCS11Module) aead(sh pkcs11.SessionHandle, key pkcs11.ObjectHandle) (cipher.AEAD, error) {
+	if err := m.checkSession(sh); err != nil {
+		return nil, err
+	}
+
+	for label, secret := range m.keys {
+		if pkcs11.ObjectHandle(len(label)) == key {
+			block, _ := aes.NewCipher(secret)
+			return cipher.NewGCM(block)
+		}
+	}
+	return nil, pkcs11.Error(pkcs11.CKR_KEY_HANDLE_INVALID)
+}
+
+func TestPKCS11KeyWrapper(t *testing.T) {
+	module := newFakePKCS11Module("rkms", "rkms-2024")
+	w := newPKCS11KeyWrapperWithModule(module, 0, "1234", "softhsm", "rkms", 2)
+
+	ctx := context.Background()
+	plaintext, ciphertext, keyID, err := w.GenerateDataKey(ctx, 32)
+	if err != nil || string(plaintext) != testDataKey || keyID != "pkcs11:softhsm/rkms" {
+		t.Fatalf("was not able to generate a data key: key id %q, %v", keyID, err)
+	}
+
+	unwrapped, unwrappedKeyID, err := w.UnwrapKey(ctx, ciphertext)
+	if err != nil || !bytes.Equal(unwrapped, plaintext) || unwrappedKeyID != keyID {
+		t.Fatalf("unwrapped a different data key or key id: %q, %v", unwrappedKeyID, err)
+	}
+
+	//a tampered or malformed data key is reported as corrupted, so it gets repaired
+	tampered := append([]byte{}, ciphertext...)
+	tampered[len(tampered)-1] ^= 1
+	for _, corrupted := range [][]byte{tampered, []byte("ciphertext"), ciphertext[:10]} {
+		if _, _, err := w.UnwrapKey(ctx, corrupted); !isCorruptedCiphertextError(err) {
+			t.Fatalf("expected a CorruptedWrappedKeyError for %q, got: %v", corrupted, err)
+		}
+	}
+
+	//sessions lost with the token are replaced by new ones
+	module.removeToken()
+	if _, _, err := w.UnwrapKey(ctx, ciphertext); err == nil || isCorruptedCiphertextError(err) {
+		t.Fatalf("expected the HSM to be reported unavailable, got: %v", err)
+	}
+
+	if _, _, err := w.UnwrapKey(ctx, ciphertext); err != nil {
+		t.Fatalf("was not able to unwrap with a new session: %s", err)
+	}
+
+	//rotating to a key with another label
+	w = newPKCS11KeyWrapperWithModule(module, 0, "1234", "softhsm", "rkms-2024", 2)
+	currentKeyID, err := w.CurrentKeyID(ctx)
+	if err != nil || currentKeyID != "pkcs11:softhsm/rkms-2024" {
+		t.Fatalf("unexpected current key id: %q, %v", currentKeyID, err)
+	}
+
+	rewrapped, err := w.RewrapKey(ctx, ciphertext, currentKeyID)
+	if err != nil {
+		t.Fatalf("was not able to re-wrap: %s", err)
+	}
+
+	if _, unwrappedKeyID, err := w.UnwrapKey(ctx, rewrapped); err != nil || unwrappedKeyID != currentKeyID {
+		t.Fatalf("re-wrapped data key does not unwrap under the new key: %q, %v", unwrappedKeyID, err)
+	}
+
+	delete(module.keys, "rkms")
+	w = newPKCS11KeyWrapperWithModule(module, 0, "1234", "softhsm", "rkms-2024", 2)
+	if _, _, err := w.UnwrapKey(ctx, ciphertext); err == nil || isCorruptedCiphertextError(err) {
+		t.Fatalf("a missing key should not be mistaken for a corrupted data key, got: %v", err)
+	}
+
+	w = newPKCS11KeyWrapperWithModule(module, 0, "wrong", "softhsm", "rkms-2024", 2)
+	if _, err := w.CurrentKeyID(ctx); err == nil {
+		t.Fatalf("expected the login to fail with the wrong PIN")
+	}
+}
+
+// TestPKCS11KeyWrapperSoftHSM runs against a token of SoftHSM (or another PKCS#11 module) with an AES key labeled "rkms".
+// It is skipped unless RKMS_TEST_PKCS11_MODULE is set, along with RKMS_TEST_PKCS11_TOKEN_LABEL and RKMS_TEST_PKCS11_PIN.
+func TestPKCS11KeyWrapperSoftHSM(t *testing.T) {
+	modulePath := os.Getenv("RKMS_TEST_PKCS11_MODULE")
+	if modulePath == "" {
+		t.Skip("RKMS_TEST_PKCS11_MODULE is not set")
+	}
+
+	wrapper, err := newKeyWrapper(WrappingBackendConfig{
+		Name:       "hsm",
+		Type:       WrappingBackendPKCS11,
+		ModulePath: modulePath,
+		TokenLabel: os.Getenv("RKMS_TEST_PKCS11_TOKEN_LABEL"),
+		KeyLabel:   "rkms",
+		PINEnv:     "RKMS_TEST_PKCS11_PIN",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	plaintext, ciphertext, keyID, err := wrapper.GenerateDataKey(ctx, 32)
+	if err != nil || len(plaintext) != 32 {
+		t.Fatalf("was not able to generate a data key: %v", err)
+	}
+
+	unwrapped, unwrappedKeyID, err := wrapper.UnwrapKey(ctx, ciphertext)
+	if err != nil || !bytes.Equal(unwrapped, plaintext) || unwrappedKeyID != keyID {
+		t.Fatalf("unwrapped a different data key or key id: %q, %v", unwrappedKeyID, err)
+	}
+
+	tampered := append([]byte{}, ciphertext...)
+	tampered[len(tampered)-1] ^= 1
+	if _, _, err := wrapper.UnwrapKey(ctx, tampered); err == nil {
+		t.Fatalf("expected a tampered data key to fail")
+	}
+}
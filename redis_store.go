@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+	logger "github.com/sirupsen/logrus"
+)
+
+// DefaultRedisKeyPrefix is prepended to every id when no key prefix is configured
+const DefaultRedisKeyPrefix = "rkms:"
+
+// RedisStore - Redis implementation of the Store interface.
+// Every id is kept as a JSON value (see jsonItem) under its prefixed key.
+type RedisStore struct {
+	client    redis.UniversalClient
+	keyPrefix string
+}
+
+// NewRedisStore creates a new RedisStore instance.
+// A sentinel-monitored master is used if a master name is configured, a cluster if several addresses are,
+// and a single server otherwise.
+func NewRedisStore(redisConfig RedisConfig) (*RedisStore, error) {
+	if len(redisConfig.Addresses) == 0 {
+		return nil, fmt.Errorf("at least one Redis address is required")
+	}
+
+	options := &redis.UniversalOptions{
+		Addrs:      redisConfig.Addresses,
+		MasterName: redisConfig.MasterName,
+		Password:   redisConfig.Password,
+		DB:         redisConfig.DB,
+	}
+
+	if redisConfig.TLS {
+		tlsConfig, err := newRedisTLSConfig(redisConfig)
+		if err != nil {
+			return nil, err
+		}
+		options.TLSConfig = tlsConfig
+	}
+
+	keyPrefix := redisConfig.KeyPrefix
+	if keyPrefix == "" {
+		keyPrefix = DefaultRedisKeyPrefix
+	}
+
+	client := redis.NewUniversalClient(options)
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %s", err)
+	}
+
+	return &RedisStore{client, keyPrefix}, nil
+}
+
+func newRedisTLSConfig(redisConfig RedisConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: redisConfig.TLSServerName,
+	}
+
+	if redisConfig.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(redisConfig.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", redisConfig.TLSCAFile)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// GetEncryptedDataKeys retrieves every version of the encrypted data keys for the given id
+func (s *RedisStore) GetEncryptedDataKeys(ctx context.Context, id string) (*EncryptedDataKeys, error) {
+	value, err := s.clientWithContext(ctx).Get(s.key(id)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+
+	if err != nil {
+		logger.Print(err)
+		return nil, newStoreError(ctx, err)
+	}
+
+	return unmarshalJSONItem(value)
+}
+
+// GetEncryptedDataKeysBatch retrieves every version of the encrypted data keys for each of the given ids.
+// The reads are pipelined rather than done with MGET, so ids may live on different nodes of a cluster.
+func (s *RedisStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]*EncryptedDataKeys, error) {
+	pipe := s.clientWithContext(ctx).Pipeline()
+	cmds := make([]*redis.StringCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.Get(s.key(id))
+	}
+
+	//a missing id fails its own command with redis.Nil, which is not an error here
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		logger.Print(err)
+		return nil, newStoreError(ctx, err)
+	}
+
+	encryptedDataKeysByID := make(map[string]*EncryptedDataKeys)
+	for i, cmd := range cmds {
+		value, err := cmd.Bytes()
+		if err == redis.Nil {
+			continue
+		}
+
+		if err != nil {
+			logger.Print(err)
+			return nil, newStoreError(ctx, err)
+		}
+
+		encryptedDataKeys, err := unmarshalJSONItem(value)
+		if err != nil {
+			return nil, err
+		}
+
+		encryptedDataKeysByID[ids[i]] = encryptedDataKeys
+	}
+
+	return encryptedDataKeysByID, nil
+}
+
+// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id as its first version
+// only if id does not exist in the store already, using SET NX
+func (s *RedisStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, keys map[string]string, incomplete bool, metadata DataKeyMetadata) error {
+	value, err := marshalJSONItem(newEncryptedDataKeys(keys, incomplete, metadata))
+	if err != nil {
+		return err
+	}
+
+	set, err := s.clientWithContext(ctx).SetNX(s.key(id), value, 0).Result()
+	if err != nil {
+		logger.Print(err)
+		return newStoreError(ctx, err)
+	}
+
+	if !set {
+		return IDAlreadyExistsStoreError{ID: id}
+	}
+
+	return nil
+}
+
+// AddEncryptedDataKeysVersionConditionally adds the encrypted data keys for the given id as a new version
+// and makes it the current version, only if the current version of id is still version-1
+func (s *RedisStore) AddEncryptedDataKeysVersionConditionally(ctx context.Context, id string, version int, keys map[string]string, incomplete bool, metadata DataKeyMetadata) error {
+	return s.updateConditionally(ctx, id, func(encryptedDataKeys *EncryptedDataKeys) error {
+		return addEncryptedDataKeysVersion(encryptedDataKeys, id, version, keys, incomplete, metadata)
+	})
+}
+
+// UpdateEncryptedDataKeysConditionally sets the encrypted data keys of the regions in keys for the given version of id,
+// only if the current encrypted data key of each of those regions still matches the one in previousKeys
+func (s *RedisStore) UpdateEncryptedDataKeysConditionally(ctx context.Context, id string, version int, previousKeys map[string]string, keys map[string]string, keyIDs map[string]string, complete bool) error {
+	return s.updateConditionally(ctx, id, func(encryptedDataKeys *EncryptedDataKeys) error {
+		return updateEncryptedDataKeysVersion(encryptedDataKeys, id, version, previousKeys, keys, keyIDs, complete)
+	})
+}
+
+// updateConditionally reads id, lets update change it and writes it back in a transaction,
+// which fails if id was changed by someone else in between
+func (s *RedisStore) updateConditionally(ctx context.Context, id string, update func(*EncryptedDataKeys) error) error {
+	key := s.key(id)
+	err := s.clientWithContext(ctx).Watch(func(tx *redis.Tx) error {
+		var encryptedDataKeys *EncryptedDataKeys
+
+		value, err := tx.Get(key).Bytes()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		if err == nil {
+			encryptedDataKeys, err = unmarshalJSONItem(value)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := update(encryptedDataKeys); err != nil {
+			return err
+		}
+
+		value, err = marshalJSONItem(encryptedDataKeys)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(key, value, 0)
+			return nil
+		})
+		return err
+	}, key)
+
+	switch err.(type) {
+	case nil:
+		return nil
+	case IDNotFoundStoreError, ConditionalUpdateFailedStoreError:
+		return err
+	}
+
+	if err == redis.TxFailedErr {
+		return ConditionalUpdateFailedStoreError{ID: id}
+	}
+
+	logger.Print(err)
+	return newStoreError(ctx, err)
+}
+
+// ListIDs returns up to limit ids found by SCAN after the given cursor, along with the cursor to continue from.
+// The cursor is the SCAN cursor (prefixed with the index of the node for a cluster), followed by the ids
+// of the last SCAN call that did not fit in limit. As with SCAN, an id may be returned more than once.
+func (s *RedisStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	node, scanCursor, ids, err := parseRedisCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(ids) == 0 {
+		clients, err := s.nodeClients(ctx)
+		if err != nil {
+			logger.Print(err)
+			return nil, "", newStoreError(ctx, err)
+		}
+
+		if node >= len(clients) {
+			return nil, "", nil
+		}
+
+		//COUNT is only a hint, so SCAN may return more keys than limit
+		keys, nextScanCursor, err := clients[node].Scan(scanCursor, s.keyPrefix+"*", int64(limit)).Result()
+		if err != nil {
+			logger.Print(err)
+			return nil, "", newStoreError(ctx, err)
+		}
+
+		for _, key := range keys {
+			ids = append(ids, strings.TrimPrefix(key, s.keyPrefix))
+		}
+
+		scanCursor = nextScanCursor
+		if scanCursor == 0 {
+			node++
+		}
+
+		if node >= len(clients) && (limit <= 0 || len(ids) <= limit) {
+			return ids, "", nil
+		}
+	}
+
+	if limit > 0 && len(ids) > limit {
+		return ids[:limit], formatRedisCursor(node, scanCursor, ids[limit:]), nil
+	}
+
+	return ids, formatRedisCursor(node, scanCursor, nil), nil
+}
+
+// DeleteEncryptedDataKeys removes every version of the encrypted data keys for the given id
+func (s *RedisStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	deleted, err := s.clientWithContext(ctx).Del(s.key(id)).Result()
+	if err != nil {
+		logger.Print(err)
+		return newStoreError(ctx, err)
+	}
+
+	if deleted == 0 {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	return nil
+}
+
+func (s *RedisStore) key(id string) string {
+	return s.keyPrefix + id
+}
+
+func (s *RedisStore) clientWithContext(ctx context.Context) redis.UniversalClient {
+	switch client := s.client.(type) {
+	case *redis.Client:
+		return client.WithContext(ctx)
+	case *redis.ClusterClient:
+		return client.WithContext(ctx)
+	}
+
+	return s.client
+}
+
+// nodeClients returns a client for every node ids have to be listed from, in a stable order
+func (s *RedisStore) nodeClients(ctx context.Context) ([]*redis.Client, error) {
+	cluster, ok := s.client.(*redis.ClusterClient)
+	if !ok {
+		return []*redis.Client{s.clientWithContext(ctx).(*redis.Client)}, nil
+	}
+
+	var mutex sync.Mutex
+	var clients []*redis.Client
+	err := cluster.ForEachMaster(func(client *redis.Client) error {
+		mutex.Lock()
+		clients = append(clients, client.WithContext(ctx))
+		mutex.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Options().Addr < clients[j].Options().Addr
+	})
+	return clients, nil
+}
+
+func formatRedisCursor(node int, scanCursor uint64, pendingIDs []string) string {
+	cursor := fmt.Sprintf("%d:%d", node, scanCursor)
+	if len(pendingIDs) == 0 {
+		return cursor
+	}
+
+	encodedIDs, _ := json.Marshal(pendingIDs)
+	return cursor + ":" + base64.RawURLEncoding.EncodeToString(encodedIDs)
+}
+
+func parseRedisCursor(cursor string) (int, uint64, []string, error) {
+	if cursor == "" {
+		return 0, 0, nil, nil
+	}
+
+	parts := strings.SplitN(cursor, ":", 3)
+	if len(parts) < 2 {
+		return 0, 0, nil, fmt.Errorf("invalid Redis cursor %q", cursor)
+	}
+
+	node, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("invalid Redis cursor %q", cursor)
+	}
+
+	scanCursor, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("invalid Redis cursor %q", cursor)
+	}
+
+	var pendingIDs []string
+	if len(parts) == 3 {
+		encodedIDs, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil || json.Unmarshal(encodedIDs, &pendingIDs) != nil {
+			return 0, 0, nil, fmt.Errorf("invalid Redis cursor %q", cursor)
+		}
+	}
+
+	return node, scanCursor, pendingIDs, nil
+}
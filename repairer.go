@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// DefaultRepairWorkers is the number of repair workers used when none is configured
+const DefaultRepairWorkers = 1
+
+// DefaultRepairQueueSize is the number of pending repairs kept when no queue size is configured
+const DefaultRepairQueueSize = 100
+
+// DefaultRepairTimeoutInSeconds is the time a single repair may take when no timeout is configured
+const DefaultRepairTimeoutInSeconds = 30
+
+type repairRequest struct {
+	id               string
+	version          int
+	plaintextDataKey string
+	previousKeys     map[string]string
+	regions          []string
+}
+
+// RepairStats - counters of the repairs done by a Repairer
+type RepairStats struct {
+	RepairedRegions uint64
+	FailedRegions   uint64
+	DroppedRepairs  uint64
+}
+
+// Repairer - re-encrypts data keys in the regions whose ciphertext is missing or
+// corrupted in the store, off the request path
+type Repairer struct {
+	rkms     *RKMS
+	requests chan repairRequest
+	workers  int
+	timeout  time.Duration
+
+	// ids that are queued or being repaired, so the same id is not repaired twice at once
+	mutex   sync.Mutex
+	pending map[string]bool
+	stopped bool
+
+	// ctx is cancelled by Stop, which then waits for the workers
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+
+	repairedRegions uint64
+	failedRegions   uint64
+	droppedRepairs  uint64
+}
+
+// NewRepairer creates a new Repairer instance for the given RKMS
+func NewRepairer(rkms *RKMS, repairConfig RepairConfig) *Repairer {
+	workers := repairConfig.Workers
+	if workers <= 0 {
+		workers = DefaultRepairWorkers
+	}
+
+	queueSize := repairConfig.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultRepairQueueSize
+	}
+
+	timeout := repairConfig.TimeoutInSeconds
+	if timeout <= 0 {
+		timeout = DefaultRepairTimeoutInSeconds
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Repairer{
+		rkms:     rkms,
+		requests: make(chan repairRequest, queueSize),
+		workers:  workers,
+		timeout:  time.Duration(timeout) * time.Second,
+		pending:  make(map[string]bool),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Start launches the repair workers
+func (p *Repairer) Start() {
+	for i := 0; i < p.workers; i++ {
+		p.running.Add(1)
+		go func() {
+			defer p.running.Done()
+			for request := range p.requests {
+				p.repair(request)
+			}
+		}()
+	}
+}
+
+// Stop stops accepting repairs, cancels the ones in progress and waits for the workers to exit.
+// Repairs still queued are dropped.
+func (p *Repairer) Stop() {
+	p.mutex.Lock()
+	if p.stopped {
+		p.mutex.Unlock()
+		return
+	}
+	p.stopped = true
+	close(p.requests)
+	p.mutex.Unlock()
+
+	p.cancel()
+	p.running.Wait()
+}
+
+// Enqueue schedules the given regions of a version of id to be re-encrypted with plaintextDataKey.
+// previousKeys are the encrypted data keys of the version read from the store and are not modified.
+// The repair is dropped if the id is already pending, the queue is full or the Repairer is stopped.
+func (p *Repairer) Enqueue(id string, version int, plaintextDataKey string, previousKeys map[string]string, regions []string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.stopped || p.pending[id] {
+		return
+	}
+
+	select {
+	case p.requests <- repairRequest{id, version, plaintextDataKey, previousKeys, regions}:
+		p.pending[id] = true
+		logger.Infof("scheduled repair of version %d of id %q in regions %v", version, id, regions)
+	default:
+		atomic.AddUint64(&p.droppedRepairs, 1)
+		logger.Warnf("repair queue is full; dropped repair of id %q", id)
+	}
+}
+
+// Stats returns the counters of the repairs done so far
+func (p *Repairer) Stats() RepairStats {
+	return RepairStats{
+		RepairedRegions: atomic.LoadUint64(&p.repairedRegions),
+		FailedRegions:   atomic.LoadUint64(&p.failedRegions),
+		DroppedRepairs:  atomic.LoadUint64(&p.droppedRepairs),
+	}
+}
+
+func (p *Repairer) done(id string) {
+	p.mutex.Lock()
+	delete(p.pending, id)
+	p.mutex.Unlock()
+}
+
+func (p *Repairer) repair(request repairRequest) {
+	defer p.done(request.id)
+
+	ctx, cancel := context.WithTimeout(p.ctx, p.timeout)
+	defer cancel()
+
+	keys := make(map[string]string)
+	keyIDs := make(map[string]string)
+	for _, region := range request.regions {
+		ciphertext, keyID, err := p.rkms.encryptDataKey(ctx, request.plaintextDataKey, region)
+		if err != nil {
+			atomic.AddUint64(&p.failedRegions, 1)
+			logger.Errorf("failed to repair id %q in %s region: %s", request.id, region, err)
+			continue
+		}
+
+		keys[region] = *ciphertext
+		keyIDs[region] = keyID
+	}
+
+	if len(keys) == 0 {
+		return
+	}
+
+	//the item is complete once every region has a ciphertext that was repaired or decrypts successfully;
+	//a damaged region that could not be repaired keeps it incomplete
+	complete := len(keys) == len(request.regions) && p.decryptsInEveryOtherRegion(ctx, request, keys)
+
+	err := p.rkms.store.UpdateEncryptedDataKeysConditionally(ctx, request.id, request.version, request.previousKeys, keys, keyIDs, complete)
+	if err != nil {
+		atomic.AddUint64(&p.failedRegions, uint64(len(keys)))
+		if _, ok := err.(ConditionalUpdateFailedStoreError); ok {
+			logger.Infof("skipped repair of id %q since it was changed in the store meanwhile", request.id)
+			return
+		}
+
+		logger.Errorf("failed to save repaired encrypted data keys of id %q: %s", request.id, err)
+		return
+	}
+
+	atomic.AddUint64(&p.repairedRegions, uint64(len(keys)))
+	for region := range keys {
+		logger.Infof("repaired version %d of encrypted data key of id %q in %s region", request.version, request.id, region)
+	}
+	logger.Infof("repair stats: %+v", p.Stats())
+}
+
+// decryptsInEveryOtherRegion reports whether the previous ciphertext of every region that was not repaired
+// decrypts to the data key being repaired
+func (p *Repairer) decryptsInEveryOtherRegion(ctx context.Context, request repairRequest, repairedKeys map[string]string) bool {
+	for _, region := range p.rkms.regions {
+		if _, repaired := repairedKeys[region]; repaired {
+			continue
+		}
+
+		ciphertext, err := base64.StdEncoding.DecodeString(request.previousKeys[region])
+		if err != nil || len(ciphertext) == 0 {
+			return false
+		}
+
+		plaintext, _, err := p.rkms.wrappers[region].UnwrapKey(ctx, ciphertext)
+		if err != nil || base64.StdEncoding.EncodeToString(plaintext) != request.plaintextDataKey {
+			logger.Infof("keeping id %q incomplete since its ciphertext in %s region could not be verified: %v", request.id, region, err)
+			return false
+		}
+	}
+
+	return true
+}
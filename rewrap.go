@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// DefaultRewrapBatchSize is the number of ids re-wrapped between two progress reports when none is configured
+const DefaultRewrapBatchSize = 100
+
+// RewrapOptions - options of a RewrapDataKeys run
+type RewrapOptions struct {
+	// DryRun reports what would be re-wrapped without changing the store
+	DryRun bool
+
+	// Cursor is where to resume a previous run from; empty starts from the beginning of the store
+	Cursor string
+
+	// BatchSize is the number of ids listed from the store at once
+	BatchSize int
+
+	// OnProgress, if set, is called after every batch with the progress so far
+	OnProgress func(RewrapProgress)
+}
+
+// RewrapProgress - counters of a RewrapDataKeys run
+type RewrapProgress struct {
+	// Cursor is where to resume from to continue this run; empty once every id was processed
+	Cursor string
+
+	IDs           int
+	RewrappedKeys int
+	UpToDateKeys  int
+	FailedKeys    int
+	ConflictedIDs int
+}
+
+// succeeded returns whether no data key failed to be re-wrapped and no id was skipped so far
+func (p RewrapProgress) succeeded() bool {
+	return p.FailedKeys == 0 && p.ConflictedIDs == 0
+}
+
+// RewrapDataKeys walks every id in the store and re-encrypts each region's encrypted data keys
+// under the key currently configured for that region, if they were encrypted under another key.
+// Writes are conditional, so it is safe to run while the store is serving traffic.
+func (r *RKMS) RewrapDataKeys(ctx context.Context, options RewrapOptions) (RewrapProgress, error) {
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultRewrapBatchSize
+	}
+
+	currentKeyIDs, err := r.resolveCurrentKeyIDs(ctx)
+	if err != nil {
+		return RewrapProgress{Cursor: options.Cursor}, err
+	}
+
+	progress := RewrapProgress{Cursor: options.Cursor}
+	for {
+		ids, nextCursor, err := r.store.ListIDs(ctx, progress.Cursor, batchSize)
+		if err != nil {
+			logger.Errorf("failed to list ids from key/value store: %s", err)
+			return progress, err
+		}
+
+		for _, id := range ids {
+			if err := ctx.Err(); err != nil {
+				return progress, err
+			}
+
+			r.rewrapID(ctx, id, currentKeyIDs, options.DryRun, &progress)
+		}
+
+		progress.Cursor = nextCursor
+		if options.OnProgress != nil {
+			options.OnProgress(progress)
+		}
+
+		if nextCursor == "" {
+			return progress, nil
+		}
+	}
+}
+
+// resolveCurrentKeyIDs returns the id of the master key every region currently wraps data keys with,
+// as the region reports it for ciphertexts. Regions whose backend cannot re-wrap are left out.
+func (r *RKMS) resolveCurrentKeyIDs(ctx context.Context) (map[string]string, error) {
+	currentKeyIDs := make(map[string]string)
+	for _, region := range r.regions {
+		wrapper, ok := r.wrappers[region].(RewrappingKeyWrapper)
+		if !ok {
+			logger.Warnf("data keys of %s region will not be re-wrapped since its backend does not support it", region)
+			continue
+		}
+
+		keyID, err := wrapper.CurrentKeyID(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve the current key of %s region: %s", region, err)
+		}
+
+		currentKeyIDs[region] = keyID
+	}
+
+	return currentKeyIDs, nil
+}
+
+// rewrapOutcome - what happened to the data key of a region in a version while re-wrapping an id
+type rewrapOutcome int
+
+const (
+	rewrapUpToDate rewrapOutcome = iota + 1
+	rewrapRewrapped
+	rewrapFailed
+)
+
+// rewrapKey identifies the data key of a region in a version of the id being re-wrapped
+type rewrapKey struct {
+	version int
+	region  string
+}
+
+// rewrapID re-wraps every version of the encrypted data keys of id, retrying once if the id changed meanwhile.
+// Each data key is counted once in progress, with the outcome of its last attempt.
+func (r *RKMS) rewrapID(ctx context.Context, id string, currentKeyIDs map[string]string, dryRun bool, progress *RewrapProgress) {
+	progress.IDs++
+
+	outcomes := make(map[rewrapKey]rewrapOutcome)
+	defer progress.count(outcomes)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		encryptedDataKeys, err := r.store.GetEncryptedDataKeys(ctx, id)
+		if err != nil {
+			progress.FailedKeys++
+			logger.Errorf("failed to read id %q from key/value store: %s", id, err)
+			return
+		}
+
+		if encryptedDataKeys == nil { //deleted meanwhile
+			return
+		}
+
+		conflicted := false
+		for version, encryptedDataKeysVersion := range encryptedDataKeys.Versions {
+			err := r.rewrapVersion(ctx, id, version, encryptedDataKeysVersion.Keys, currentKeyIDs, dryRun, outcomes)
+			if _, ok := err.(ConditionalUpdateFailedStoreError); ok {
+				conflicted = true
+				break
+			}
+		}
+
+		if !conflicted {
+			return
+		}
+	}
+
+	progress.ConflictedIDs++
+	logger.Warnf("skipped id %q since it kept changing while being re-wrapped", id)
+}
+
+func (r *RKMS) rewrapVersion(ctx context.Context, id string, version int, keys map[string]string, currentKeyIDs map[string]string, dryRun bool, outcomes map[rewrapKey]rewrapOutcome) error {
+	previousKeys := make(map[string]string)
+	rewrappedKeys := make(map[string]string)
+	keyIDs := make(map[string]string)
+
+	for _, region := range r.regions {
+		ciphertext, ok := keys[region]
+		currentKeyID, rewrappable := currentKeyIDs[region]
+		if !ok || !rewrappable {
+			continue
+		}
+
+		key := rewrapKey{version, region}
+		rewrappedKey, err := r.rewrapDataKey(ctx, region, ciphertext, currentKeyID, dryRun)
+		if err != nil {
+			outcomes[key] = rewrapFailed
+			logger.Errorf("failed to re-wrap version %d of id %q in %s region: %s", version, id, region, err)
+			continue
+		}
+
+		if rewrappedKey == nil {
+			//a key re-wrapped by a previous attempt is up to date in the next one
+			if outcomes[key] != rewrapRewrapped {
+				outcomes[key] = rewrapUpToDate
+			}
+			continue
+		}
+
+		previousKeys[region] = ciphertext
+		rewrappedKeys[region] = *rewrappedKey
+		keyIDs[region] = currentKeyID
+	}
+
+	if len(rewrappedKeys) == 0 {
+		return nil
+	}
+
+	if dryRun {
+		setRewrapOutcomes(outcomes, version, rewrappedKeys, rewrapRewrapped)
+		logger.Infof("would re-wrap version %d of id %q in %d regions", version, id, len(rewrappedKeys))
+		return nil
+	}
+
+	err := r.store.UpdateEncryptedDataKeysConditionally(ctx, id, version, previousKeys, rewrappedKeys, keyIDs, false)
+	if err != nil {
+		if _, ok := err.(ConditionalUpdateFailedStoreError); !ok {
+			setRewrapOutcomes(outcomes, version, rewrappedKeys, rewrapFailed)
+			logger.Errorf("failed to save re-wrapped version %d of id %q: %s", version, id, err)
+		}
+		return err
+	}
+
+	setRewrapOutcomes(outcomes, version, rewrappedKeys, rewrapRewrapped)
+	logger.Debugf("re-wrapped version %d of id %q in %d regions", version, id, len(rewrappedKeys))
+	return nil
+}
+
+func setRewrapOutcomes(outcomes map[rewrapKey]rewrapOutcome, version int, keys map[string]string, outcome rewrapOutcome) {
+	for region := range keys {
+		outcomes[rewrapKey{version, region}] = outcome
+	}
+}
+
+// count adds the outcome of every data key of an id to the counters
+func (p *RewrapProgress) count(outcomes map[rewrapKey]rewrapOutcome) {
+	for _, outcome := range outcomes {
+		switch outcome {
+		case rewrapUpToDate:
+			p.UpToDateKeys++
+		case rewrapRewrapped:
+			p.RewrappedKeys++
+		case rewrapFailed:
+			p.FailedKeys++
+		}
+	}
+}
+
+// rewrapDataKey re-encrypts the given ciphertext of a region under the master key with destinationKeyID.
+// A nil ciphertext is returned if it is already encrypted under destinationKeyID.
+// In dry run mode, the ciphertext is returned as is instead of being re-encrypted.
+func (r *RKMS) rewrapDataKey(ctx context.Context, region string, ciphertext string, destinationKeyID string, dryRun bool) (*string, error) {
+	ciphertextBlob, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapper := r.wrappers[region].(RewrappingKeyWrapper)
+	_, keyID, err := wrapper.UnwrapKey(ctx, ciphertextBlob)
+	if err != nil {
+		return nil, err
+	}
+
+	if keyID == destinationKeyID {
+		return nil, nil
+	}
+
+	if dryRun {
+		return &ciphertext, nil
+	}
+
+	rewrappedCiphertextBlob, err := wrapper.RewrapKey(ctx, ciphertextBlob, destinationKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	rewrappedCiphertext := base64.StdEncoding.EncodeToString(rewrappedCiphertextBlob)
+	return &rewrappedCiphertext, nil
+}
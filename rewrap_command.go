@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// runRewrapCommand re-wraps every stored data key under the currently configured KMS key ids.
+// Its progress is saved to a state file after every batch, so an interrupted run resumes where it stopped.
+// The state file stops advancing once a key failed, and is removed only after a run without failures,
+// so the next run retries the failed keys.
+//
+// Usage: rkms rewrap [-dry-run] [-state-file rewrap.state] [-batch-size 100]
+func runRewrapCommand(rkms *RKMS, args []string) {
+	flags := flag.NewFlagSet("rewrap", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would be re-wrapped without changing the store")
+	stateFile := flags.String("state-file", "rewrap.state", "file to save progress to and resume from")
+	batchSize := flags.Int("batch-size", DefaultRewrapBatchSize, "number of ids to process between progress reports")
+	flags.Parse(args)
+
+	cursor := ""
+	if !*dryRun {
+		if state, err := ioutil.ReadFile(*stateFile); err == nil {
+			cursor = strings.TrimSpace(string(state))
+			logger.Infof("resuming re-wrap after id %q", cursor)
+		}
+	}
+
+	options := RewrapOptions{
+		DryRun:    *dryRun,
+		Cursor:    cursor,
+		BatchSize: *batchSize,
+		OnProgress: func(progress RewrapProgress) {
+			logger.Infof("re-wrap progress: %d ids, %d keys re-wrapped, %d keys up to date, %d keys failed, %d ids conflicted",
+				progress.IDs, progress.RewrappedKeys, progress.UpToDateKeys, progress.FailedKeys, progress.ConflictedIDs)
+
+			if *dryRun || progress.Cursor == "" || !progress.succeeded() {
+				return
+			}
+
+			if err := ioutil.WriteFile(*stateFile, []byte(progress.Cursor), 0600); err != nil {
+				logger.Errorf("failed to save re-wrap progress: %s", err)
+			}
+		},
+	}
+
+	progress, err := rkms.RewrapDataKeys(context.Background(), options)
+	if err != nil {
+		logger.Fatalf("re-wrap stopped after id %q: %s", progress.Cursor, err)
+	}
+
+	if !progress.succeeded() {
+		logger.Fatalf("re-wrap finished with %d failed keys and %d conflicted ids; run it again to retry them", progress.FailedKeys, progress.ConflictedIDs)
+	}
+
+	if !*dryRun {
+		os.Remove(*stateFile)
+	}
+
+	logger.Info("re-wrap finished")
+}
@@ -4,14 +4,10 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/request"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/kms"
-	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
 	logger "github.com/sirupsen/logrus"
 )
 
@@ -23,78 +19,162 @@ const MaxNumberOfGetPlaintextDataKeyTries = 3
 
 // RKMS - Implementation of reliable KMS logic
 type RKMS struct {
-	regions []string
-	keyIds  map[string]*string
-	clients map[string]kmsiface.KMSAPI
-	store   Store
+	// the names of the key-wrapping backends, in the order they are tried. Encrypted data keys are stored
+	// by backend name, which is the region name for AWS KMS backends configured the legacy way.
+	regions  []string
+	wrappers map[string]KeyWrapper
+	store    Store
 
 	// the length of the data encryption key in bytes
 	dataKeySizeInBytes int64
+
+	// the number of regions that must encrypt a new data key for its creation to succeed
+	minimumRegionsForKeyCreation int
+
+	// fixes missing or corrupted encrypted data keys in the background; nil if disabled
+	repairer *Repairer
+
+	// the number of ids of a batch processed concurrently
+	batchConcurrency int
 }
 
-// NewRKMSWithDynamoDB creates a new RKMS instance with DynamoDB used as its key/value store
-func NewRKMSWithDynamoDB(kmsConfig KMSConfig, dynamoDBConfig DynamoDBConfig) (*RKMS, error) {
-	store, err := NewDynamoDBStore(dynamoDBConfig)
+// NewRKMS creates a new RKMS instance with the given key/value store
+func NewRKMS(kmsConfig KMSConfig, store Store) (*RKMS, error) {
+	backends := kmsConfig.WrappingBackends()
+	wrappers, err := newKeyWrappers(backends)
 	if err != nil {
 		logger.Error(err)
 		return nil, err
 	}
 
-	clients, err := getKMSClientsForRegions(kmsConfig.Regions)
-	if err != nil {
-		logger.Error(err)
-		return nil, err
+	names := make([]string, len(backends))
+	for i, backend := range backends {
+		names[i] = backend.Name
+	}
+
+	minimumRegionsForKeyCreation := kmsConfig.MinimumRegionsForKeyCreation
+	if minimumRegionsForKeyCreation == 0 {
+		minimumRegionsForKeyCreation = len(names)
 	}
 
-	return &RKMS{kmsConfig.Regions, kmsConfig.KeyIds, clients, store, kmsConfig.DataKeySizeInBytes}, nil
+	return &RKMS{names, wrappers, store, kmsConfig.DataKeySizeInBytes, minimumRegionsForKeyCreation, nil, kmsConfig.BatchConcurrency}, nil
 }
 
-func getKMSClientsForRegions(regions []string) (map[string]kmsiface.KMSAPI, error) {
-	clients := make(map[string]kmsiface.KMSAPI)
+// StartRepairer starts repairing missing or corrupted encrypted data keys found
+// while reading from the store in the background
+func (r *RKMS) StartRepairer(repairConfig RepairConfig) {
+	r.repairer = NewRepairer(r, repairConfig)
+	r.repairer.Start()
+}
 
-	for _, region := range regions {
-		client, err := getKMSClientForRegion(region)
-		if err != nil {
-			return nil, err
-		}
-		clients[region] = client
+// StopRepairer stops the repairer started by StartRepairer, if any
+func (r *RKMS) StopRepairer() {
+	if r.repairer != nil {
+		r.repairer.Stop()
 	}
+}
 
-	return clients, nil
+// VersionNotFoundError represents an error type that is returned when the requested
+// version of the data key of an id does not exist
+type VersionNotFoundError struct {
+	ID      string
+	Version int
 }
 
-func getKMSClientForRegion(region string) (kmsiface.KMSAPI, error) {
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(region),
-	})
+func (e VersionNotFoundError) Error() string {
+	return fmt.Sprintf("version %d of the data key for id %q does not exist", e.Version, e.ID)
+}
+
+// GetPlaintextDataKey retrieves the current version of the key assosicated with the given id, along with its version.
+// If a key is not found in the store, a key is generated for the given id.
+func (r *RKMS) GetPlaintextDataKey(ctx context.Context, id string) (*string, int, error) {
+	if err := ValidateID(id); err != nil {
+		return nil, 0, err
+	}
+
+	return r.getPlaintextDataKey(ctx, id, MaxNumberOfGetPlaintextDataKeyTries, nil)
+}
 
+// GetPlaintextDataKeyVersion retrieves the given version of the key assosicated with the given id.
+// Unlike GetPlaintextDataKey, no key is generated if the id does not exist; an IDNotFoundStoreError is returned instead.
+// If the version does not exist, a VersionNotFoundError is returned.
+func (r *RKMS) GetPlaintextDataKeyVersion(ctx context.Context, id string, version int) (*string, error) {
+	if err := ValidateID(id); err != nil {
+		return nil, err
+	}
+
+	plaintextDataKey, _, err := r.lookInStoreForDataKey(ctx, id, version)
 	if err != nil {
 		return nil, err
 	}
 
-	return kms.New(sess), nil
+	if plaintextDataKey == nil {
+		return nil, IDNotFoundStoreError{ID: id}
+	}
+
+	return plaintextDataKey, nil
 }
 
-// GetPlaintextDataKey retrieves the key assosicated with the given id.
-// If a key is not found in the store, a key is generated for the given id.
-func (r *RKMS) GetPlaintextDataKey(ctx context.Context, id string) (*string, error) {
-	return r.getPlaintextDataKey(ctx, id, MaxNumberOfGetPlaintextDataKeyTries, nil)
+// LookupPlaintextDataKey retrieves the current version of the key assosicated with the given id, along with its version.
+// Unlike GetPlaintextDataKey, no key is generated if the id does not exist; an IDNotFoundStoreError is returned instead.
+func (r *RKMS) LookupPlaintextDataKey(ctx context.Context, id string) (*string, int, error) {
+	if err := ValidateID(id); err != nil {
+		return nil, 0, err
+	}
+
+	plaintextDataKey, version, err := r.lookInStoreForDataKey(ctx, id, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if plaintextDataKey == nil {
+		return nil, 0, IDNotFoundStoreError{ID: id}
+	}
+
+	return plaintextDataKey, version, nil
+}
+
+// CreatePlaintextDataKey generates a key for the given id and returns it along with its version.
+// If a key already exists for the given id, an IDAlreadyExistsStoreError is returned.
+func (r *RKMS) CreatePlaintextDataKey(ctx context.Context, id string) (*string, int, error) {
+	if err := ValidateID(id); err != nil {
+		return nil, 0, err
+	}
+
+	//avoid calling KMS in every region for an id that is known to exist already
+	encryptedDataKeys, err := r.store.GetEncryptedDataKeys(ctx, id)
+	if err != nil {
+		logger.Error(err)
+		return nil, 0, err
+	}
+
+	if encryptedDataKeys != nil {
+		return nil, 0, IDAlreadyExistsStoreError{ID: id}
+	}
+
+	plaintextDataKey, err := r.createDataKeyForID(ctx, id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return plaintextDataKey, 1, nil
 }
 
-func (r *RKMS) getPlaintextDataKey(ctx context.Context, id string, triesLeft int, lastErr error) (*string, error) {
+func (r *RKMS) getPlaintextDataKey(ctx context.Context, id string, triesLeft int, lastErr error) (*string, int, error) {
 	if triesLeft == 0 {
-		return nil, lastErr
+		logger.Errorf("giving up on id %q after conflicting writes: %s", id, lastErr)
+		return nil, 0, ConflictRetriesExhaustedError{ID: id, Tries: MaxNumberOfGetPlaintextDataKeyTries}
 	}
 
-	plaintextDataKey, err := r.lookInStoreForDataKey(ctx, id)
+	plaintextDataKey, version, err := r.lookInStoreForDataKey(ctx, id, 0)
 	if err != nil {
 		logger.Error(err)
-		return nil, err
+		return nil, 0, err
 	}
 
 	if plaintextDataKey != nil {
 		logger.Debugln("a data key was found in the store for the given id")
-		return plaintextDataKey, nil
+		return plaintextDataKey, version, nil
 	}
 
 	plaintextDataKey, err = r.createDataKeyForID(ctx, id)
@@ -105,51 +185,213 @@ func (r *RKMS) getPlaintextDataKey(ctx context.Context, id string, triesLeft int
 		}
 
 		logger.Error(err)
-		return nil, err
+		return nil, 0, err
 	}
 
 	//return the data key
-	return plaintextDataKey, nil
+	return plaintextDataKey, 1, nil
 }
 
-func (r *RKMS) lookInStoreForDataKey(ctx context.Context, id string) (*string, error) {
+// lookInStoreForDataKey decrypts the given version of the data key of id, or its current version if version is 0.
+// If the id does not exist in the store, a nil data key is returned.
+func (r *RKMS) lookInStoreForDataKey(ctx context.Context, id string, version int) (*string, int, error) {
 	encryptedDataKeys, err := r.store.GetEncryptedDataKeys(ctx, id)
 	if err != nil {
 		logger.Error(err)
-		return nil, err
+		return nil, 0, err
 	}
 
 	if encryptedDataKeys == nil {
 		logger.Debugln("no data key exists in the store for the given id")
-		return nil, nil
+		return nil, 0, nil
+	}
+
+	return r.decryptDataKeyVersion(ctx, id, encryptedDataKeys, version)
+}
+
+// decryptDataKeyVersion decrypts the given version of the encrypted data keys of id, or its current version if version is 0
+func (r *RKMS) decryptDataKeyVersion(ctx context.Context, id string, encryptedDataKeys *EncryptedDataKeys, version int) (*string, int, error) {
+	if version == 0 {
+		version = encryptedDataKeys.CurrentVersion
+	}
+
+	encryptedDataKeysVersion, ok := encryptedDataKeys.Versions[version]
+	if !ok {
+		return nil, 0, VersionNotFoundError{ID: id, Version: version}
+	}
+
+	plaintextDataKey, damagedRegions, err := r.decryptDataKey(ctx, encryptedDataKeysVersion.Keys)
+	if err != nil {
+		logger.Error(err)
+		return nil, 0, err
+	}
+
+	if len(damagedRegions) > 0 && r.repairer != nil {
+		r.repairer.Enqueue(id, version, *plaintextDataKey, encryptedDataKeysVersion.Keys, damagedRegions)
+	}
+
+	return plaintextDataKey, version, nil
+}
+
+// RotateDataKey creates a new version of the key assosicated with the given id in every region and
+// makes it the current version. Older versions remain available through GetPlaintextDataKeyVersion.
+// If no key exists for the given id, an IDNotFoundStoreError is returned.
+func (r *RKMS) RotateDataKey(ctx context.Context, id string) (int, error) {
+	if err := ValidateID(id); err != nil {
+		return 0, err
+	}
+
+	encryptedDataKeys, err := r.store.GetEncryptedDataKeys(ctx, id)
+	if err != nil {
+		logger.Error(err)
+		return 0, err
+	}
+
+	if encryptedDataKeys == nil {
+		return 0, IDNotFoundStoreError{ID: id}
+	}
+
+	logger.Debugln("creating a new version of the data key...")
+	_, keys, incomplete, metadata, err := r.createEncryptedDataKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	version := encryptedDataKeys.CurrentVersion + 1
+	logger.Debugf("saving version %d of encrypted data keys in store...", version)
+	err = r.store.AddEncryptedDataKeysVersionConditionally(ctx, id, version, keys, incomplete, metadata)
+	if err != nil {
+		logger.Errorf("failed to save new version of encrypted data keys in key/value store: %s", err)
+		return 0, err
+	}
+
+	logger.Debugln("done rotating data key")
+	return version, nil
+}
+
+// DataKeyDescription - the versions of the data key of an id and their metadata, without the keys themselves
+type DataKeyDescription struct {
+	ID             string
+	FormatVersion  int
+	CurrentVersion int
+	Versions       []DataKeyVersionDescription
+}
+
+// DataKeyVersionDescription - a version of a data key, the regions it is encrypted in and its metadata
+type DataKeyVersionDescription struct {
+	Version    int
+	Regions    []string
+	Incomplete bool
+	Metadata   DataKeyMetadata
+}
+
+// DescribeDataKey returns every version of the key associated with the given id along with its metadata,
+// without decrypting any of them. Metadata is empty for versions created before it was recorded.
+// If no key exists for the given id, an IDNotFoundStoreError is returned.
+func (r *RKMS) DescribeDataKey(ctx context.Context, id string) (*DataKeyDescription, error) {
+	if err := ValidateID(id); err != nil {
+		return nil, err
 	}
 
-	plaintextDataKey, err := r.decryptDataKey(ctx, encryptedDataKeys)
+	encryptedDataKeys, err := r.store.GetEncryptedDataKeys(ctx, id)
 	if err != nil {
-		err := fmt.Errorf("failed to decrypt data key in every region: %s", err)
 		logger.Error(err)
 		return nil, err
 	}
 
-	return plaintextDataKey, err
+	if encryptedDataKeys == nil {
+		return nil, IDNotFoundStoreError{ID: id}
+	}
+
+	description := &DataKeyDescription{
+		ID:             id,
+		FormatVersion:  encryptedDataKeys.FormatVersion,
+		CurrentVersion: encryptedDataKeys.CurrentVersion,
+	}
+
+	for version := 1; version <= encryptedDataKeys.CurrentVersion; version++ {
+		encryptedDataKeysVersion, ok := encryptedDataKeys.Versions[version]
+		if !ok {
+			continue
+		}
+
+		regions := make([]string, 0, len(encryptedDataKeysVersion.Keys))
+		for region := range encryptedDataKeysVersion.Keys {
+			regions = append(regions, region)
+		}
+		sort.Strings(regions)
+
+		description.Versions = append(description.Versions, DataKeyVersionDescription{
+			Version:    version,
+			Regions:    regions,
+			Incomplete: encryptedDataKeysVersion.Incomplete,
+			Metadata:   encryptedDataKeysVersion.Metadata,
+		})
+	}
+
+	return description, nil
+}
+
+// DeleteDataKey deletes every version of the key associated with the given id from the store.
+// If no key exists for the given id, an IDNotFoundStoreError is returned.
+func (r *RKMS) DeleteDataKey(ctx context.Context, id string) error {
+	if err := ValidateID(id); err != nil {
+		return err
+	}
+
+	logger.Debugln("deleting encrypted data keys from store...")
+	err := r.store.DeleteEncryptedDataKeys(ctx, id)
+	if err != nil {
+		if _, ok := err.(IDNotFoundStoreError); !ok {
+			logger.Errorf("failed to delete encrypted data keys from key/value store: %s", err)
+		}
+		return err
+	}
+
+	logger.Debugln("done deleting encrypted data keys")
+	return nil
 }
 
 type encryptDataKeyResult struct {
 	region     string
 	ciphertext *string
+	keyID      string
 	err        error
 }
 
 func (r *RKMS) createDataKeyForID(ctx context.Context, id string) (*string, error) {
+	plaintextDataKey, encryptedDataKeys, incomplete, metadata, err := r.createEncryptedDataKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugln("saving encrypted data keys in store...")
+	err = r.store.SetEncryptedDataKeysConditionally(ctx, id, encryptedDataKeys, incomplete, metadata)
+	if err != nil {
+		logger.Errorf("failed to save encrypted data keys in key/value store: %s", err)
+		return nil, err
+	}
+
+	logger.Debugln("done creating and saving encrypted data keys")
+	return plaintextDataKey, nil
+}
+
+// createEncryptedDataKeys generates a new data key and encrypts it in every region.
+// It returns the plaintext data key, the encrypted data keys, whether some regions failed to encrypt it
+// and the metadata to store along with the encrypted data keys.
+func (r *RKMS) createEncryptedDataKeys(ctx context.Context) (*string, map[string]string, bool, DataKeyMetadata, error) {
 	logger.Debugln("creating data key...")
-	firstRegion, plaintextDataKey, firstRegionCiphertext, err := r.createDataKey(ctx)
+	createdAt := time.Now().UTC()
+	firstRegion, plaintextDataKey, firstRegionCiphertext, firstRegionKeyID, err := r.createDataKey(ctx)
 	if err != nil {
 		logger.Errorf("failed to create a data key: %s", err)
-		return nil, err
+		return nil, nil, false, DataKeyMetadata{}, err
 	}
 
 	encryptedDataKeys := make(map[string]string)
 	encryptedDataKeys[*firstRegion] = *firstRegionCiphertext
+	keyIDs := make(map[string]string)
+	keyIDs[*firstRegion] = firstRegionKeyID
 
 	resultsChannel := make(chan encryptDataKeyResult, len(r.regions)-1)
 	childCtx, cancel := context.WithCancel(ctx)
@@ -163,134 +405,164 @@ func (r *RKMS) createDataKeyForID(ctx context.Context, id string) (*string, erro
 
 		go func(ctx context.Context, resultsChannel chan<- encryptDataKeyResult, plaintextDataKey string, region string) {
 			logger.Debugf("encrypting data key in %s region", region)
-			ciphertext, err := r.encryptDataKey(ctx, plaintextDataKey, region)
-			resultsChannel <- encryptDataKeyResult{region, ciphertext, err}
+			ciphertext, keyID, err := r.encryptDataKey(ctx, plaintextDataKey, region)
+			resultsChannel <- encryptDataKeyResult{region, ciphertext, keyID, err}
 		}(childCtx, resultsChannel, *plaintextDataKey, region)
 	}
 
+	var errs []error
 	for i := 0; i < len(r.regions)-1; i++ {
 		select {
 		case result := <-resultsChannel:
 			if result.err != nil {
 				logger.Errorf("failed to encrypt data key in %s region: %s", result.region, result.err)
-				return nil, result.err
+				errs = append(errs, result.err)
+				continue
 			}
 
 			encryptedDataKeys[result.region] = *result.ciphertext
+			keyIDs[result.region] = result.keyID
 		case <-ctx.Done():
-			return nil, fmt.Errorf("cancelled while encrypting data key in all regions")
+			return nil, nil, false, DataKeyMetadata{}, CancelledError{ctx.Err()}
 		}
 	}
 
-	logger.Debugln("saving encrypted data keys in store...")
-	err = r.store.SetEncryptedDataKeysConditionally(ctx, id, encryptedDataKeys)
-	if err != nil {
-		logger.Errorf("failed to save encrypted data keys in key/value store: %s", err)
-		return nil, err
+	if len(encryptedDataKeys) < r.minimumRegionsForKeyCreation {
+		operation := fmt.Sprintf("encrypt data key in at least %d regions (succeeded in %d)", r.minimumRegionsForKeyCreation, len(encryptedDataKeys))
+		err := newRegionsError(ctx, operation, errs)
+		logger.Error(err)
+		return nil, nil, false, DataKeyMetadata{}, err
 	}
 
-	logger.Debugln("done creating and saving encrypted data keys")
-	return plaintextDataKey, nil
+	incomplete := len(encryptedDataKeys) < len(r.regions)
+	if incomplete {
+		logger.Warnf("data key was only encrypted in %d of %d regions; it will be saved as incomplete", len(encryptedDataKeys), len(r.regions))
+	}
+
+	metadata := DataKeyMetadata{
+		CreatedAt:      createdAt,
+		KeySizeInBytes: int(r.dataKeySizeInBytes),
+		KMSKeyIDs:      keyIDs,
+	}
+
+	return plaintextDataKey, encryptedDataKeys, incomplete, metadata, nil
 }
 
-func (r *RKMS) createDataKey(ctx context.Context) (*string, *string, *string, error) {
+// createDataKey generates a data key in the first region that succeeds, and returns that region,
+// the plaintext and encrypted data key, and the id of the master key that encrypted it
+func (r *RKMS) createDataKey(ctx context.Context) (*string, *string, *string, string, error) {
+	var errs []error
 	for _, region := range r.regions {
-		input := &kms.GenerateDataKeyInput{
-			KeyId:         r.keyIds[region],
-			NumberOfBytes: aws.Int64(r.dataKeySizeInBytes),
-		}
-
-		result, err := r.clients[region].GenerateDataKeyWithContext(ctx, input)
+		plaintextBlob, ciphertextBlob, keyID, err := r.wrappers[region].GenerateDataKey(ctx, int(r.dataKeySizeInBytes))
 		if err != nil { //failed to create data key in this region
 			logger.Error(err)
+			errs = append(errs, err)
 			continue
 		}
 
-		plaintext := base64.StdEncoding.EncodeToString(result.Plaintext)
-		ciphertext := base64.StdEncoding.EncodeToString(result.CiphertextBlob)
-		return &region, &plaintext, &ciphertext, nil
+		plaintext := base64.StdEncoding.EncodeToString(plaintextBlob)
+		ciphertext := base64.StdEncoding.EncodeToString(ciphertextBlob)
+		return &region, &plaintext, &ciphertext, keyID, nil
 	}
 
-	return nil, nil, nil, fmt.Errorf("failed to create a data key in every region")
+	return nil, nil, nil, "", newRegionsError(ctx, "create a data key in every region", errs)
 }
 
-func (r *RKMS) encryptDataKey(ctx context.Context, dataKey string, region string) (*string, error) {
+// encryptDataKey encrypts the data key in the given region, and returns the ciphertext
+// along with the id of the master key that encrypted it
+func (r *RKMS) encryptDataKey(ctx context.Context, dataKey string, region string) (*string, string, error) {
 	plaintext, err := base64.StdEncoding.DecodeString(dataKey)
 	if err != nil {
 		logger.Error(err)
-		return nil, err
-	}
-
-	input := &kms.EncryptInput{
-		KeyId:     r.keyIds[region],
-		Plaintext: plaintext,
+		return nil, "", err
 	}
 
-	result, err := r.clients[region].EncryptWithContext(ctx, input)
+	ciphertextBlob, keyID, err := r.wrappers[region].WrapKey(ctx, plaintext)
 	if err != nil { //failed to create data key in this region
 		logger.Error(err)
-		return nil, err
+		return nil, "", err
 	}
 
-	ciphertext := base64.StdEncoding.EncodeToString(result.CiphertextBlob)
-	return &ciphertext, nil
+	ciphertext := base64.StdEncoding.EncodeToString(ciphertextBlob)
+	return &ciphertext, keyID, nil
 }
 
 type decryptDataKeyResult struct {
 	region    string
 	plaintext *string
+	corrupted bool
 	err       error
 }
 
-func (r *RKMS) decryptDataKey(ctx context.Context, encryptedDataKeys map[string]string) (*string, error) {
+// decryptDataKey returns the data key decrypted by the first region that succeeds,
+// along with the regions whose ciphertext was found to be missing or corrupted on the way.
+func (r *RKMS) decryptDataKey(ctx context.Context, encryptedDataKeys map[string]string) (*string, []string, error) {
 	resultsChannel := make(chan decryptDataKeyResult, len(r.regions))
 	childCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	var damagedRegions []string
+	numberOfDecryptions := 0
+
 	//TODO(enhancement): add config param to run this serially if wanted
 	for _, region := range r.regions {
-		go func(ctx context.Context, resultsChannel chan<- decryptDataKeyResult, ciphertext string, region string) {
-			ciphertextBlob, err := base64.StdEncoding.DecodeString(ciphertext)
-			if err != nil {
-				//TODO(enhancement): fix it asyncrounously
-				logger.Errorf("ciphertext value is corrupted in the store for %s region: %s", region, err)
-				resultsChannel <- decryptDataKeyResult{region, nil, err}
-				return
-			}
+		ciphertext, ok := encryptedDataKeys[region]
+		if !ok || ciphertext == "" {
+			logger.Warnf("ciphertext value is missing in the store for %s region", region)
+			damagedRegions = append(damagedRegions, region)
+			continue
+		}
 
-			input := &kms.DecryptInput{
-				CiphertextBlob: ciphertextBlob,
-			}
+		ciphertextBlob, err := base64.StdEncoding.DecodeString(ciphertext)
+		if err != nil {
+			logger.Errorf("ciphertext value is corrupted in the store for %s region: %s", region, err)
+			damagedRegions = append(damagedRegions, region)
+			continue
+		}
 
+		numberOfDecryptions++
+		go func(ctx context.Context, resultsChannel chan<- decryptDataKeyResult, ciphertextBlob []byte, region string) {
 			logger.Debugf("decrypting data key in %s region", region)
-			result, err := r.clients[region].DecryptWithContext(ctx, input)
+			plaintext, _, err := r.wrappers[region].UnwrapKey(ctx, ciphertextBlob)
 			if err != nil { //failed to decrypt in this region
-				if aerr, ok := err.(awserr.Error); ok && aerr.Code() != request.CanceledErrorCode {
+				if !isCancelledError(ctx, err) {
 					logger.Errorf("failed to decrypt in %s region: %s", region, err)
 				}
-				resultsChannel <- decryptDataKeyResult{region, nil, err}
+				resultsChannel <- decryptDataKeyResult{region, nil, isCorruptedCiphertextError(err), err}
 				return
 			}
 
-			dataKey := base64.StdEncoding.EncodeToString(result.Plaintext)
-			resultsChannel <- decryptDataKeyResult{region, &dataKey, nil}
-		}(childCtx, resultsChannel, encryptedDataKeys[region], region)
+			dataKey := base64.StdEncoding.EncodeToString(plaintext)
+			resultsChannel <- decryptDataKeyResult{region, &dataKey, false, nil}
+		}(childCtx, resultsChannel, ciphertextBlob, region)
 	}
 
-	for i := 0; i < len(r.regions); i++ {
+	var errs []error
+	for i := 0; i < numberOfDecryptions; i++ {
 		select {
 		case result := <-resultsChannel:
 			if result.err != nil {
 				logger.Infof("failed to decrypt data key in %s region: %s", result.region, result.err)
+				errs = append(errs, result.err)
+				if result.corrupted {
+					damagedRegions = append(damagedRegions, result.region)
+				}
 				continue
 			}
 
 			logger.Debugf("successfully decrypted data key in %s region", result.region)
-			return result.plaintext, nil
+			return result.plaintext, damagedRegions, nil
 		case <-ctx.Done():
-			return nil, fmt.Errorf("cancelled while decrypting data key in all regions")
+			return nil, nil, CancelledError{ctx.Err()}
 		}
 	}
 
-	return nil, fmt.Errorf("failed to decrypt data key in all regions")
+	return nil, nil, newRegionsError(ctx, "decrypt data key in every region", errs)
+}
+
+// isCorruptedCiphertextError reports whether the backend rejected the ciphertext itself,
+// as opposed to the region being unavailable
+func isCorruptedCiphertextError(err error) bool {
+	_, ok := err.(CorruptedWrappedKeyError)
+	return ok
 }
@@ -0,0 +1,927 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: rkms.proto
+
+package main
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+
+// MissingKeyPolicy is what GetKey does for an id that has no key.
+type MissingKeyPolicy int32
+
+const (
+	// use the server's create_missing_keys setting
+	MissingKeyPolicy_SERVER_DEFAULT MissingKeyPolicy = 0
+	// create a key for the id
+	MissingKeyPolicy_CREATE MissingKeyPolicy = 1
+	// fail with NOT_FOUND
+	MissingKeyPolicy_NOT_FOUND MissingKeyPolicy = 2
+)
+
+var MissingKeyPolicy_name = map[int32]string{
+	0: "SERVER_DEFAULT",
+	1: "CREATE",
+	2: "NOT_FOUND",
+}
+var MissingKeyPolicy_value = map[string]int32{
+	"SERVER_DEFAULT": 0,
+	"CREATE":         1,
+	"NOT_FOUND":      2,
+}
+
+func (x MissingKeyPolicy) String() string {
+	return proto.EnumName(MissingKeyPolicy_name, int32(x))
+}
+func (MissingKeyPolicy) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_rkms_09a3e26f5ef15cc0, []int{0}
+}
+
+type GetKeyRequest struct {
+	// unique identifier for a given key
+	Id string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	// optional; the current version is returned if it is not set
+	Version              int32            `protobuf:"varint,2,opt,name=version,proto3" json:"version,omitempty"`
+	MissingKeyPolicy     MissingKeyPolicy `protobuf:"varint,3,opt,name=missing_key_policy,json=missingKeyPolicy,proto3,enum=rkms.MissingKeyPolicy" json:"missing_key_policy,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
+	XXX_unrecognized     []byte           `json:"-"`
+	XXX_sizecache        int32            `json:"-"`
+}
+
+func (m *GetKeyRequest) Reset()         { *m = GetKeyRequest{} }
+func (m *GetKeyRequest) String() string { return proto.CompactTextString(m) }
+func (*GetKeyRequest) ProtoMessage()    {}
+func (*GetKeyRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_rkms_09a3e26f5ef15cc0, []int{0}
+}
+func (m *GetKeyRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetKeyRequest.Unmarshal(m, b)
+}
+func (m *GetKeyRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetKeyRequest.Marshal(b, m, deterministic)
+}
+func (dst *GetKeyRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetKeyRequest.Merge(dst, src)
+}
+func (m *GetKeyRequest) XXX_Size() int {
+	return xxx_messageInfo_GetKeyRequest.Size(m)
+}
+func (m *GetKeyRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetKeyRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetKeyRequest proto.InternalMessageInfo
+
+func (m *GetKeyRequest) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *GetKeyRequest) GetVersion() int32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *GetKeyRequest) GetMissingKeyPolicy() MissingKeyPolicy {
+	if m != nil {
+		return m.MissingKeyPolicy
+	}
+	return MissingKeyPolicy_SERVER_DEFAULT
+}
+
+type GetKeyResponse struct {
+	Id string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	// the plaintext data key
+	Key                  []byte   `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Version              int32    `protobuf:"varint,3,opt,name=version,proto3" json:"version,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetKeyResponse) Reset()         { *m = GetKeyResponse{} }
+func (m *GetKeyResponse) String() string { return proto.CompactTextString(m) }
+func (*GetKeyResponse) ProtoMessage()    {}
+func (*GetKeyResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_rkms_09a3e26f5ef15cc0, []int{1}
+}
+func (m *GetKeyResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetKeyResponse.Unmarshal(m, b)
+}
+func (m *GetKeyResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetKeyResponse.Marshal(b, m, deterministic)
+}
+func (dst *GetKeyResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetKeyResponse.Merge(dst, src)
+}
+func (m *GetKeyResponse) XXX_Size() int {
+	return xxx_messageInfo_GetKeyResponse.Size(m)
+}
+func (m *GetKeyResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetKeyResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetKeyResponse proto.InternalMessageInfo
+
+func (m *GetKeyResponse) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *GetKeyResponse) GetKey() []byte {
+	if m != nil {
+		return m.Key
+	}
+	return nil
+}
+
+func (m *GetKeyResponse) GetVersion() int32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+type CreateKeyRequest struct {
+	// unique identifier for a given key
+	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CreateKeyRequest) Reset()         { *m = CreateKeyRequest{} }
+func (m *CreateKeyRequest) String() string { return proto.CompactTextString(m) }
+func (*CreateKeyRequest) ProtoMessage()    {}
+func (*CreateKeyRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_rkms_09a3e26f5ef15cc0, []int{2}
+}
+func (m *CreateKeyRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CreateKeyRequest.Unmarshal(m, b)
+}
+func (m *CreateKeyRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CreateKeyRequest.Marshal(b, m, deterministic)
+}
+func (dst *CreateKeyRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CreateKeyRequest.Merge(dst, src)
+}
+func (m *CreateKeyRequest) XXX_Size() int {
+	return xxx_messageInfo_CreateKeyRequest.Size(m)
+}
+func (m *CreateKeyRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_CreateKeyRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CreateKeyRequest proto.InternalMessageInfo
+
+func (m *CreateKeyRequest) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+type CreateKeyResponse struct {
+	Id string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	// the plaintext data key
+	Key                  []byte   `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Version              int32    `protobuf:"varint,3,opt,name=version,proto3" json:"version,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CreateKeyResponse) Reset()         { *m = CreateKeyResponse{} }
+func (m *CreateKeyResponse) String() string { return proto.CompactTextString(m) }
+func (*CreateKeyResponse) ProtoMessage()    {}
+func (*CreateKeyResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_rkms_09a3e26f5ef15cc0, []int{3}
+}
+func (m *CreateKeyResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CreateKeyResponse.Unmarshal(m, b)
+}
+func (m *CreateKeyResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CreateKeyResponse.Marshal(b, m, deterministic)
+}
+func (dst *CreateKeyResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CreateKeyResponse.Merge(dst, src)
+}
+func (m *CreateKeyResponse) XXX_Size() int {
+	return xxx_messageInfo_CreateKeyResponse.Size(m)
+}
+func (m *CreateKeyResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_CreateKeyResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CreateKeyResponse proto.InternalMessageInfo
+
+func (m *CreateKeyResponse) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *CreateKeyResponse) GetKey() []byte {
+	if m != nil {
+		return m.Key
+	}
+	return nil
+}
+
+func (m *CreateKeyResponse) GetVersion() int32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+type RotateKeyRequest struct {
+	// unique identifier for a given key
+	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RotateKeyRequest) Reset()         { *m = RotateKeyRequest{} }
+func (m *RotateKeyRequest) String() string { return proto.CompactTextString(m) }
+func (*RotateKeyRequest) ProtoMessage()    {}
+func (*RotateKeyRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_rkms_09a3e26f5ef15cc0, []int{4}
+}
+func (m *RotateKeyRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RotateKeyRequest.Unmarshal(m, b)
+}
+func (m *RotateKeyRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RotateKeyRequest.Marshal(b, m, deterministic)
+}
+func (dst *RotateKeyRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RotateKeyRequest.Merge(dst, src)
+}
+func (m *RotateKeyRequest) XXX_Size() int {
+	return xxx_messageInfo_RotateKeyRequest.Size(m)
+}
+func (m *RotateKeyRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_RotateKeyRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RotateKeyRequest proto.InternalMessageInfo
+
+func (m *RotateKeyRequest) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+type RotateKeyResponse struct {
+	Id string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	// the new current version of the data key
+	Version              int32    `protobuf:"varint,2,opt,name=version,proto3" json:"version,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RotateKeyResponse) Reset()         { *m = RotateKeyResponse{} }
+func (m *RotateKeyResponse) String() string { return proto.CompactTextString(m) }
+func (*RotateKeyResponse) ProtoMessage()    {}
+func (*RotateKeyResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_rkms_09a3e26f5ef15cc0, []int{5}
+}
+func (m *RotateKeyResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RotateKeyResponse.Unmarshal(m, b)
+}
+func (m *RotateKeyResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RotateKeyResponse.Marshal(b, m, deterministic)
+}
+func (dst *RotateKeyResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RotateKeyResponse.Merge(dst, src)
+}
+func (m *RotateKeyResponse) XXX_Size() int {
+	return xxx_messageInfo_RotateKeyResponse.Size(m)
+}
+func (m *RotateKeyResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_RotateKeyResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RotateKeyResponse proto.InternalMessageInfo
+
+func (m *RotateKeyResponse) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *RotateKeyResponse) GetVersion() int32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+type DeleteKeyRequest struct {
+	// unique identifier for a given key
+	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DeleteKeyRequest) Reset()         { *m = DeleteKeyRequest{} }
+func (m *DeleteKeyRequest) String() string { return proto.CompactTextString(m) }
+func (*DeleteKeyRequest) ProtoMessage()    {}
+func (*DeleteKeyRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_rkms_09a3e26f5ef15cc0, []int{6}
+}
+func (m *DeleteKeyRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DeleteKeyRequest.Unmarshal(m, b)
+}
+func (m *DeleteKeyRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DeleteKeyRequest.Marshal(b, m, deterministic)
+}
+func (dst *DeleteKeyRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DeleteKeyRequest.Merge(dst, src)
+}
+func (m *DeleteKeyRequest) XXX_Size() int {
+	return xxx_messageInfo_DeleteKeyRequest.Size(m)
+}
+func (m *DeleteKeyRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_DeleteKeyRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DeleteKeyRequest proto.InternalMessageInfo
+
+func (m *DeleteKeyRequest) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+type DeleteKeyResponse struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DeleteKeyResponse) Reset()         { *m = DeleteKeyResponse{} }
+func (m *DeleteKeyResponse) String() string { return proto.CompactTextString(m) }
+func (*DeleteKeyResponse) ProtoMessage()    {}
+func (*DeleteKeyResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_rkms_09a3e26f5ef15cc0, []int{7}
+}
+func (m *DeleteKeyResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DeleteKeyResponse.Unmarshal(m, b)
+}
+func (m *DeleteKeyResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DeleteKeyResponse.Marshal(b, m, deterministic)
+}
+func (dst *DeleteKeyResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DeleteKeyResponse.Merge(dst, src)
+}
+func (m *DeleteKeyResponse) XXX_Size() int {
+	return xxx_messageInfo_DeleteKeyResponse.Size(m)
+}
+func (m *DeleteKeyResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_DeleteKeyResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DeleteKeyResponse proto.InternalMessageInfo
+
+func (m *DeleteKeyResponse) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+type EncryptRequest struct {
+	Id        string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Plaintext []byte `protobuf:"bytes,2,opt,name=plaintext,proto3" json:"plaintext,omitempty"`
+	// optional; the same value must be given to Decrypt
+	AdditionalData       []byte   `protobuf:"bytes,3,opt,name=additional_data,json=additionalData,proto3" json:"additional_data,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *EncryptRequest) Reset()         { *m = EncryptRequest{} }
+func (m *EncryptRequest) String() string { return proto.CompactTextString(m) }
+func (*EncryptRequest) ProtoMessage()    {}
+func (*EncryptRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_rkms_09a3e26f5ef15cc0, []int{8}
+}
+func (m *EncryptRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_EncryptRequest.Unmarshal(m, b)
+}
+func (m *EncryptRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_EncryptRequest.Marshal(b, m, deterministic)
+}
+func (dst *EncryptRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_EncryptRequest.Merge(dst, src)
+}
+func (m *EncryptRequest) XXX_Size() int {
+	return xxx_messageInfo_EncryptRequest.Size(m)
+}
+func (m *EncryptRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_EncryptRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_EncryptRequest proto.InternalMessageInfo
+
+func (m *EncryptRequest) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *EncryptRequest) GetPlaintext() []byte {
+	if m != nil {
+		return m.Plaintext
+	}
+	return nil
+}
+
+func (m *EncryptRequest) GetAdditionalData() []byte {
+	if m != nil {
+		return m.AdditionalData
+	}
+	return nil
+}
+
+type EncryptResponse struct {
+	Id string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	// self-describing ciphertext which records the id and algorithm
+	Ciphertext           string   `protobuf:"bytes,2,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *EncryptResponse) Reset()         { *m = EncryptResponse{} }
+func (m *EncryptResponse) String() string { return proto.CompactTextString(m) }
+func (*EncryptResponse) ProtoMessage()    {}
+func (*EncryptResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_rkms_09a3e26f5ef15cc0, []int{9}
+}
+func (m *EncryptResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_EncryptResponse.Unmarshal(m, b)
+}
+func (m *EncryptResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_EncryptResponse.Marshal(b, m, deterministic)
+}
+func (dst *EncryptResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_EncryptResponse.Merge(dst, src)
+}
+func (m *EncryptResponse) XXX_Size() int {
+	return xxx_messageInfo_EncryptResponse.Size(m)
+}
+func (m *EncryptResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_EncryptResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_EncryptResponse proto.InternalMessageInfo
+
+func (m *EncryptResponse) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *EncryptResponse) GetCiphertext() string {
+	if m != nil {
+		return m.Ciphertext
+	}
+	return ""
+}
+
+type DecryptRequest struct {
+	Ciphertext           string   `protobuf:"bytes,1,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`
+	AdditionalData       []byte   `protobuf:"bytes,2,opt,name=additional_data,json=additionalData,proto3" json:"additional_data,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DecryptRequest) Reset()         { *m = DecryptRequest{} }
+func (m *DecryptRequest) String() string { return proto.CompactTextString(m) }
+func (*DecryptRequest) ProtoMessage()    {}
+func (*DecryptRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_rkms_09a3e26f5ef15cc0, []int{10}
+}
+func (m *DecryptRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DecryptRequest.Unmarshal(m, b)
+}
+func (m *DecryptRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DecryptRequest.Marshal(b, m, deterministic)
+}
+func (dst *DecryptRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DecryptRequest.Merge(dst, src)
+}
+func (m *DecryptRequest) XXX_Size() int {
+	return xxx_messageInfo_DecryptRequest.Size(m)
+}
+func (m *DecryptRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_DecryptRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DecryptRequest proto.InternalMessageInfo
+
+func (m *DecryptRequest) GetCiphertext() string {
+	if m != nil {
+		return m.Ciphertext
+	}
+	return ""
+}
+
+func (m *DecryptRequest) GetAdditionalData() []byte {
+	if m != nil {
+		return m.AdditionalData
+	}
+	return nil
+}
+
+type DecryptResponse struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Plaintext            []byte   `protobuf:"bytes,2,opt,name=plaintext,proto3" json:"plaintext,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DecryptResponse) Reset()         { *m = DecryptResponse{} }
+func (m *DecryptResponse) String() string { return proto.CompactTextString(m) }
+func (*DecryptResponse) ProtoMessage()    {}
+func (*DecryptResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_rkms_09a3e26f5ef15cc0, []int{11}
+}
+func (m *DecryptResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DecryptResponse.Unmarshal(m, b)
+}
+func (m *DecryptResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DecryptResponse.Marshal(b, m, deterministic)
+}
+func (dst *DecryptResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DecryptResponse.Merge(dst, src)
+}
+func (m *DecryptResponse) XXX_Size() int {
+	return xxx_messageInfo_DecryptResponse.Size(m)
+}
+func (m *DecryptResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_DecryptResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DecryptResponse proto.InternalMessageInfo
+
+func (m *DecryptResponse) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *DecryptResponse) GetPlaintext() []byte {
+	if m != nil {
+		return m.Plaintext
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*GetKeyRequest)(nil), "rkms.GetKeyRequest")
+	proto.RegisterType((*GetKeyResponse)(nil), "rkms.GetKeyResponse")
+	proto.RegisterType((*CreateKeyRequest)(nil), "rkms.CreateKeyRequest")
+	proto.RegisterType((*CreateKeyResponse)(nil), "rkms.CreateKeyResponse")
+	proto.RegisterType((*RotateKeyRequest)(nil), "rkms.RotateKeyRequest")
+	proto.RegisterType((*RotateKeyResponse)(nil), "rkms.RotateKeyResponse")
+	proto.RegisterType((*DeleteKeyRequest)(nil), "rkms.DeleteKeyRequest")
+	proto.RegisterType((*DeleteKeyResponse)(nil), "rkms.DeleteKeyResponse")
+	proto.RegisterType((*EncryptRequest)(nil), "rkms.EncryptRequest")
+	proto.RegisterType((*EncryptResponse)(nil), "rkms.EncryptResponse")
+	proto.RegisterType((*DecryptRequest)(nil), "rkms.DecryptRequest")
+	proto.RegisterType((*DecryptResponse)(nil), "rkms.DecryptResponse")
+	proto.RegisterEnum("rkms.MissingKeyPolicy", MissingKeyPolicy_name, MissingKeyPolicy_value)
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// KeyServiceClient is the client API for KeyService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type KeyServiceClient interface {
+	// GetKey returns the plaintext data key for the given id.
+	// Whether a key is created for an unknown id depends on missing_key_policy.
+	// If a version is given, that version is returned instead of the current one and no key is created.
+	GetKey(ctx context.Context, in *GetKeyRequest, opts ...grpc.CallOption) (*GetKeyResponse, error)
+	// CreateKey creates the data key for the given id.
+	// It fails with ALREADY_EXISTS if the id already has a key.
+	CreateKey(ctx context.Context, in *CreateKeyRequest, opts ...grpc.CallOption) (*CreateKeyResponse, error)
+	// RotateKey creates a new version of the data key for the given id and makes it the current version.
+	RotateKey(ctx context.Context, in *RotateKeyRequest, opts ...grpc.CallOption) (*RotateKeyResponse, error)
+	// DeleteKey removes the data key for the given id.
+	// Data encrypted with the key can no longer be decrypted.
+	DeleteKey(ctx context.Context, in *DeleteKeyRequest, opts ...grpc.CallOption) (*DeleteKeyResponse, error)
+	// Encrypt encrypts plaintext with the data key of the given id using AES-GCM,
+	// so the data key never leaves the server.
+	Encrypt(ctx context.Context, in *EncryptRequest, opts ...grpc.CallOption) (*EncryptResponse, error)
+	// Decrypt decrypts a ciphertext returned by Encrypt.
+	Decrypt(ctx context.Context, in *DecryptRequest, opts ...grpc.CallOption) (*DecryptResponse, error)
+}
+
+type keyServiceClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewKeyServiceClient(cc *grpc.ClientConn) KeyServiceClient {
+	return &keyServiceClient{cc}
+}
+
+func (c *keyServiceClient) GetKey(ctx context.Context, in *GetKeyRequest, opts ...grpc.CallOption) (*GetKeyResponse, error) {
+	out := new(GetKeyResponse)
+	err := c.cc.Invoke(ctx, "/rkms.KeyService/GetKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyServiceClient) CreateKey(ctx context.Context, in *CreateKeyRequest, opts ...grpc.CallOption) (*CreateKeyResponse, error) {
+	out := new(CreateKeyResponse)
+	err := c.cc.Invoke(ctx, "/rkms.KeyService/CreateKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyServiceClient) RotateKey(ctx context.Context, in *RotateKeyRequest, opts ...grpc.CallOption) (*RotateKeyResponse, error) {
+	out := new(RotateKeyResponse)
+	err := c.cc.Invoke(ctx, "/rkms.KeyService/RotateKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyServiceClient) DeleteKey(ctx context.Context, in *DeleteKeyRequest, opts ...grpc.CallOption) (*DeleteKeyResponse, error) {
+	out := new(DeleteKeyResponse)
+	err := c.cc.Invoke(ctx, "/rkms.KeyService/DeleteKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyServiceClient) Encrypt(ctx context.Context, in *EncryptRequest, opts ...grpc.CallOption) (*EncryptResponse, error) {
+	out := new(EncryptResponse)
+	err := c.cc.Invoke(ctx, "/rkms.KeyService/Encrypt", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyServiceClient) Decrypt(ctx context.Context, in *DecryptRequest, opts ...grpc.CallOption) (*DecryptResponse, error) {
+	out := new(DecryptResponse)
+	err := c.cc.Invoke(ctx, "/rkms.KeyService/Decrypt", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// KeyServiceServer is the server API for KeyService service.
+type KeyServiceServer interface {
+	// GetKey returns the plaintext data key for the given id.
+	// Whether a key is created for an unknown id depends on missing_key_policy.
+	// If a version is given, that version is returned instead of the current one and no key is created.
+	GetKey(context.Context, *GetKeyRequest) (*GetKeyResponse, error)
+	// CreateKey creates the data key for the given id.
+	// It fails with ALREADY_EXISTS if the id already has a key.
+	CreateKey(context.Context, *CreateKeyRequest) (*CreateKeyResponse, error)
+	// RotateKey creates a new version of the data key for the given id and makes it the current version.
+	RotateKey(context.Context, *RotateKeyRequest) (*RotateKeyResponse, error)
+	// DeleteKey removes the data key for the given id.
+	// Data encrypted with the key can no longer be decrypted.
+	DeleteKey(context.Context, *DeleteKeyRequest) (*DeleteKeyResponse, error)
+	// Encrypt encrypts plaintext with the data key of the given id using AES-GCM,
+	// so the data key never leaves the server.
+	Encrypt(context.Context, *EncryptRequest) (*EncryptResponse, error)
+	// Decrypt decrypts a ciphertext returned by Encrypt.
+	Decrypt(context.Context, *DecryptRequest) (*DecryptResponse, error)
+}
+
+func RegisterKeyServiceServer(s *grpc.Server, srv KeyServiceServer) {
+	s.RegisterService(&_KeyService_serviceDesc, srv)
+}
+
+func _KeyService_GetKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyServiceServer).GetKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rkms.KeyService/GetKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyServiceServer).GetKey(ctx, req.(*GetKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyService_CreateKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyServiceServer).CreateKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rkms.KeyService/CreateKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyServiceServer).CreateKey(ctx, req.(*CreateKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyService_RotateKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RotateKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyServiceServer).RotateKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rkms.KeyService/RotateKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyServiceServer).RotateKey(ctx, req.(*RotateKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyService_DeleteKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyServiceServer).DeleteKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rkms.KeyService/DeleteKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyServiceServer).DeleteKey(ctx, req.(*DeleteKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyService_Encrypt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EncryptRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyServiceServer).Encrypt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rkms.KeyService/Encrypt",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyServiceServer).Encrypt(ctx, req.(*EncryptRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyService_Decrypt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DecryptRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyServiceServer).Decrypt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rkms.KeyService/Decrypt",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyServiceServer).Decrypt(ctx, req.(*DecryptRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _KeyService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "rkms.KeyService",
+	HandlerType: (*KeyServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetKey",
+			Handler:    _KeyService_GetKey_Handler,
+		},
+		{
+			MethodName: "CreateKey",
+			Handler:    _KeyService_CreateKey_Handler,
+		},
+		{
+			MethodName: "RotateKey",
+			Handler:    _KeyService_RotateKey_Handler,
+		},
+		{
+			MethodName: "DeleteKey",
+			Handler:    _KeyService_DeleteKey_Handler,
+		},
+		{
+			MethodName: "Encrypt",
+			Handler:    _KeyService_Encrypt_Handler,
+		},
+		{
+			MethodName: "Decrypt",
+			Handler:    _KeyService_Decrypt_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "rkms.proto",
+}
+
+func init() { proto.RegisterFile("rkms.proto", fileDescriptor_rkms_09a3e26f5ef15cc0) }
+
+var fileDescriptor_rkms_09a3e26f5ef15cc0 = []byte{
+	// 479 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x54, 0x4d, 0x6f, 0xd3, 0x40,
+	0x10, 0xc5, 0x4e, 0x49, 0xe5, 0x51, 0xeb, 0x38, 0xcb, 0x47, 0x22, 0x0b, 0xa1, 0xc8, 0x1c, 0x88,
+	0x38, 0xf4, 0xd0, 0x4a, 0x9c, 0x40, 0x28, 0x74, 0x5d, 0x0e, 0x29, 0x0d, 0xda, 0xa6, 0x48, 0x70,
+	0xb1, 0x96, 0x78, 0x54, 0x56, 0x49, 0x6c, 0x63, 0x2f, 0x11, 0x3e, 0xf1, 0x83, 0xf9, 0x13, 0x28,
+	0x8e, 0xe3, 0x8f, 0x4d, 0x9c, 0x53, 0x6f, 0xeb, 0xb7, 0xf3, 0xf4, 0xde, 0xcc, 0xbe, 0x31, 0x40,
+	0x3c, 0x5f, 0x26, 0x67, 0x51, 0x1c, 0xca, 0x90, 0x1c, 0xad, 0xcf, 0xce, 0x5f, 0x38, 0xfd, 0x84,
+	0x72, 0x8c, 0x29, 0xc3, 0x5f, 0xbf, 0x31, 0x91, 0xc4, 0x04, 0x5d, 0xf8, 0x7d, 0x6d, 0xa0, 0x0d,
+	0x0d, 0xa6, 0x0b, 0x9f, 0xf4, 0xe1, 0x78, 0x85, 0x71, 0x22, 0xc2, 0xa0, 0xaf, 0x0f, 0xb4, 0xe1,
+	0x63, 0xb6, 0xfd, 0x24, 0x14, 0xc8, 0x52, 0x24, 0x89, 0x08, 0xee, 0xbd, 0x39, 0xa6, 0x5e, 0x14,
+	0x2e, 0xc4, 0x2c, 0xed, 0xb7, 0x06, 0xda, 0xd0, 0x3c, 0x7f, 0x7e, 0x96, 0x29, 0x7d, 0xde, 0xdc,
+	0x8f, 0x31, 0xfd, 0x92, 0xdd, 0x32, 0x6b, 0xa9, 0x20, 0xce, 0x35, 0x98, 0x5b, 0x03, 0x49, 0x14,
+	0x06, 0x09, 0xee, 0x38, 0xb0, 0xa0, 0x35, 0xc7, 0x34, 0x53, 0x3f, 0x61, 0xeb, 0x63, 0xd5, 0x53,
+	0xab, 0xe6, 0xc9, 0x71, 0xc0, 0xba, 0x8c, 0x91, 0x4b, 0x6c, 0xee, 0xc8, 0x99, 0x40, 0xb7, 0x52,
+	0xf3, 0x30, 0xa2, 0x2c, 0x94, 0x87, 0x45, 0xdf, 0x43, 0xb7, 0x52, 0xd3, 0x20, 0xda, 0x38, 0xeb,
+	0xb5, 0x04, 0xc5, 0x05, 0x1e, 0x94, 0x78, 0x05, 0xdd, 0x4a, 0xcd, 0x7e, 0x09, 0xe7, 0x1e, 0x4c,
+	0x37, 0x98, 0xc5, 0x69, 0x24, 0x9b, 0x1e, 0xfc, 0x05, 0x18, 0xd1, 0x82, 0x8b, 0x40, 0xe2, 0x1f,
+	0x99, 0xf7, 0x5f, 0x02, 0xe4, 0x35, 0x74, 0xb8, 0xef, 0x0b, 0x29, 0xc2, 0x80, 0x2f, 0x3c, 0x9f,
+	0x4b, 0x9e, 0x4d, 0xe3, 0x84, 0x99, 0x25, 0x4c, 0xb9, 0xe4, 0xce, 0x08, 0x3a, 0x85, 0x50, 0x43,
+	0xbb, 0x2f, 0x01, 0x66, 0x22, 0xfa, 0x89, 0x71, 0x21, 0x65, 0xb0, 0x0a, 0xe2, 0x7c, 0x03, 0x93,
+	0x62, 0xcd, 0x6b, 0x9d, 0xa1, 0xa9, 0x8c, 0x7d, 0xee, 0xf4, 0xbd, 0xee, 0x3e, 0x40, 0x87, 0xe2,
+	0x61, 0x77, 0x07, 0xe7, 0xf0, 0x66, 0x04, 0x96, 0x1a, 0x6e, 0x42, 0xc0, 0xbc, 0x75, 0xd9, 0x57,
+	0x97, 0x79, 0xd4, 0xbd, 0x1a, 0xdd, 0x5d, 0x4f, 0xad, 0x47, 0x04, 0xa0, 0x7d, 0xc9, 0xdc, 0xd1,
+	0xd4, 0xb5, 0x34, 0x72, 0x0a, 0xc6, 0xcd, 0x64, 0xea, 0x5d, 0x4d, 0xee, 0x6e, 0xa8, 0xa5, 0x9f,
+	0xff, 0xd3, 0x01, 0xc6, 0x98, 0xde, 0x62, 0xbc, 0x12, 0x33, 0x24, 0x17, 0xd0, 0xde, 0x2c, 0x02,
+	0x79, 0xb2, 0x59, 0x9e, 0xda, 0x5e, 0xda, 0x4f, 0xeb, 0x60, 0x6e, 0xfa, 0x1d, 0x18, 0x45, 0x96,
+	0x49, 0xbe, 0x74, 0xea, 0x02, 0xd8, 0xbd, 0x1d, 0xbc, 0x64, 0x17, 0xa1, 0xdc, 0xb2, 0xd5, 0x24,
+	0xdb, 0xbd, 0x1d, 0xbc, 0x64, 0x17, 0x79, 0xdb, 0xb2, 0xd5, 0x90, 0xda, 0xbd, 0x1d, 0x3c, 0x67,
+	0xbf, 0x85, 0xe3, 0x3c, 0x1f, 0x24, 0x6f, 0xad, 0x9e, 0x4b, 0xfb, 0x99, 0x82, 0x96, 0x3c, 0x8a,
+	0x35, 0x1e, 0xc5, 0x7d, 0x3c, 0xe5, 0x79, 0x3f, 0xb6, 0xbf, 0x1f, 0x2d, 0xb9, 0x08, 0x7e, 0xb4,
+	0xb3, 0xbf, 0xdf, 0xc5, 0xff, 0x01, 0x00, 0x52, 0xf0, 0x68, 0xb1, 0x0b, 0x05, 0x00, 0x00,
+}
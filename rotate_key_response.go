@@ -0,0 +1,17 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+type rotateKeyResponse struct {
+	ID      string `json:"id"`
+	Version int    `json:"version"`
+}
+
+// ConstructRotateKeyResponse creates a server response for POST /key/rotate endpoint
+func ConstructRotateKeyResponse(id string, version int) string {
+	resp := rotateKeyResponse{id, version}
+	b, _ := json.Marshal(resp)
+	return string(b)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	// database/sql drivers selectable with the driver setting
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	logger "github.com/sirupsen/logrus"
+)
+
+// mysqlDuplicateEntryError is the MySQL error number of an insert conflicting with an existing primary key
+const mysqlDuplicateEntryError = 1062
+
+// DefaultSQLTableName is the table encrypted data keys are kept in when none is configured
+const DefaultSQLTableName = "rkms_keys"
+
+// the database/sql drivers SQLStore supports
+const (
+	SQLDriverPostgres = "postgres"
+	SQLDriverMySQL    = "mysql"
+	SQLDriverSQLite   = "sqlite3"
+)
+
+var sqlTableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SQLStore - database/sql implementation of the Store interface for PostgreSQL, MySQL and SQLite.
+// Every id is a row holding its versions as JSON (see jsonItem), along with a revision
+// that is bumped on every update so updates can be made conditional.
+type SQLStore struct {
+	db        *sql.DB
+	driver    string
+	tableName string
+}
+
+// NewSQLStore creates a new SQLStore instance and creates its table if it does not exist
+func NewSQLStore(sqlConfig SQLConfig) (*SQLStore, error) {
+	switch sqlConfig.Driver {
+	case SQLDriverPostgres, SQLDriverMySQL, SQLDriverSQLite:
+	default:
+		return nil, fmt.Errorf("unsupported SQL driver %q", sqlConfig.Driver)
+	}
+
+	tableName := sqlConfig.TableName
+	if tableName == "" {
+		tableName = DefaultSQLTableName
+	}
+
+	if !sqlTableNameRegexp.MatchString(tableName) {
+		return nil, fmt.Errorf("invalid SQL table name %q", tableName)
+	}
+
+	db, err := sql.Open(sqlConfig.Driver, sqlConfig.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	if sqlConfig.Driver == SQLDriverSQLite {
+		//SQLite allows a single writer at a time, so don't let connections fight over the lock
+		db.SetMaxOpenConns(1)
+	} else if sqlConfig.MaxOpenConnections > 0 {
+		db.SetMaxOpenConns(sqlConfig.MaxOpenConnections)
+	}
+
+	s := &SQLStore{db, sqlConfig.Driver, tableName}
+	if err := s.createSchema(context.Background()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create SQL schema: %s", err)
+	}
+
+	return s, nil
+}
+
+func (s *SQLStore) createSchema(ctx context.Context) error {
+	idType := "TEXT"
+	if s.driver == SQLDriverMySQL { //MySQL cannot index TEXT columns without a prefix length
+		idType = fmt.Sprintf("VARBINARY(%d)", MaxIDLength)
+	}
+
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	id %s NOT NULL PRIMARY KEY,
+	current_version INTEGER NOT NULL,
+	versions TEXT NOT NULL,
+	revision INTEGER NOT NULL
+)`, s.tableName, idType))
+	return err
+}
+
+// GetEncryptedDataKeys retrieves every version of the encrypted data keys for the given id
+func (s *SQLStore) GetEncryptedDataKeys(ctx context.Context, id string) (*EncryptedDataKeys, error) {
+	encryptedDataKeys, _, err := s.get(ctx, id)
+	return encryptedDataKeys, err
+}
+
+// get returns the encrypted data keys of id along with their revision
+func (s *SQLStore) get(ctx context.Context, id string) (*EncryptedDataKeys, int64, error) {
+	var versions string
+	var revision int64
+	query := s.query("SELECT versions, revision FROM %s WHERE id = ?")
+	err := s.db.QueryRowContext(ctx, query, id).Scan(&versions, &revision)
+	if err == sql.ErrNoRows {
+		return nil, 0, nil
+	}
+
+	if err != nil {
+		logger.Print(err)
+		return nil, 0, newStoreError(ctx, err)
+	}
+
+	encryptedDataKeys, err := unmarshalJSONItem([]byte(versions))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return encryptedDataKeys, revision, nil
+}
+
+// GetEncryptedDataKeysBatch retrieves every version of the encrypted data keys for each of the given ids
+func (s *SQLStore) GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]*EncryptedDataKeys, error) {
+	encryptedDataKeysByID := make(map[string]*EncryptedDataKeys)
+	if len(ids) == 0 {
+		return encryptedDataKeysByID, nil
+	}
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	query := s.query("SELECT id, versions FROM %s WHERE id IN (" + placeholders + ")")
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		logger.Print(err)
+		return nil, newStoreError(ctx, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, versions string
+		if err := rows.Scan(&id, &versions); err != nil {
+			return nil, newStoreError(ctx, err)
+		}
+
+		encryptedDataKeys, err := unmarshalJSONItem([]byte(versions))
+		if err != nil {
+			return nil, err
+		}
+
+		encryptedDataKeysByID[id] = encryptedDataKeys
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.Print(err)
+		return nil, newStoreError(ctx, err)
+	}
+
+	return encryptedDataKeysByID, nil
+}
+
+// SetEncryptedDataKeysConditionally inserts the encrypted data keys for the given id as its first version.
+// The insert is skipped on a primary key conflict, in which case an IDAlreadyExistsStoreError is returned.
+// MySQL reports the conflict as an error, since the rows it counts as affected depend on the clientFoundRows setting.
+func (s *SQLStore) SetEncryptedDataKeysConditionally(ctx context.Context, id string, keys map[string]string, incomplete bool, metadata DataKeyMetadata) error {
+	versions, err := marshalJSONItem(newEncryptedDataKeys(keys, incomplete, metadata))
+	if err != nil {
+		return err
+	}
+
+	insert := "INSERT INTO %s (id, current_version, versions, revision) VALUES (?, 1, ?, 1)"
+	if s.driver != SQLDriverMySQL {
+		insert += " ON CONFLICT (id) DO NOTHING"
+	}
+
+	result, err := s.db.ExecContext(ctx, s.query(insert), id, string(versions))
+	if err != nil {
+		if isMySQLDuplicateEntryError(err) {
+			return IDAlreadyExistsStoreError{ID: id}
+		}
+
+		logger.Print(err)
+		return newStoreError(ctx, err)
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return newStoreError(ctx, err)
+	}
+
+	if inserted == 0 {
+		return IDAlreadyExistsStoreError{ID: id}
+	}
+
+	return nil
+}
+
+// AddEncryptedDataKeysVersionConditionally adds the encrypted data keys for the given id as a new version
+// and makes it the current version, only if the current version of id is still version-1
+func (s *SQLStore) AddEncryptedDataKeysVersionConditionally(ctx context.Context, id string, version int, keys map[string]string, incomplete bool, metadata DataKeyMetadata) error {
+	return s.updateConditionally(ctx, id, func(encryptedDataKeys *EncryptedDataKeys) error {
+		return addEncryptedDataKeysVersion(encryptedDataKeys, id, version, keys, incomplete, metadata)
+	})
+}
+
+// UpdateEncryptedDataKeysConditionally sets the encrypted data keys of the regions in keys for the given version of id,
+// only if the current encrypted data key of each of those regions still matches the one in previousKeys
+func (s *SQLStore) UpdateEncryptedDataKeysConditionally(ctx context.Context, id string, version int, previousKeys map[string]string, keys map[string]string, keyIDs map[string]string, complete bool) error {
+	return s.updateConditionally(ctx, id, func(encryptedDataKeys *EncryptedDataKeys) error {
+		return updateEncryptedDataKeysVersion(encryptedDataKeys, id, version, previousKeys, keys, keyIDs, complete)
+	})
+}
+
+// updateConditionally reads id, lets update change it and writes it back,
+// only if its revision did not change in between
+func (s *SQLStore) updateConditionally(ctx context.Context, id string, update func(*EncryptedDataKeys) error) error {
+	encryptedDataKeys, revision, err := s.get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := update(encryptedDataKeys); err != nil {
+		return err
+	}
+
+	versions, err := marshalJSONItem(encryptedDataKeys)
+	if err != nil {
+		return err
+	}
+
+	query := s.query("UPDATE %s SET current_version = ?, versions = ?, revision = revision + 1 WHERE id = ? AND revision = ?")
+	result, err := s.db.ExecContext(ctx, query, encryptedDataKeys.CurrentVersion, string(versions), id, revision)
+	if err != nil {
+		logger.Print(err)
+		return newStoreError(ctx, err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return newStoreError(ctx, err)
+	}
+
+	if updated == 0 {
+		return ConditionalUpdateFailedStoreError{ID: id}
+	}
+
+	return nil
+}
+
+// ListIDs returns up to limit ids stored after the given cursor, along with the cursor to continue from.
+// Ids are listed in the order of the primary key and the cursor is the last id returned.
+func (s *SQLStore) ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	query := "SELECT id FROM %s WHERE id > ? ORDER BY id"
+	if limit > 0 {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.query(query), cursor)
+	if err != nil {
+		logger.Print(err)
+		return nil, "", newStoreError(ctx, err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, "", newStoreError(ctx, err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.Print(err)
+		return nil, "", newStoreError(ctx, err)
+	}
+
+	if limit <= 0 || len(ids) < limit {
+		return ids, "", nil
+	}
+
+	return ids, ids[len(ids)-1], nil
+}
+
+// DeleteEncryptedDataKeys removes every version of the encrypted data keys for the given id
+func (s *SQLStore) DeleteEncryptedDataKeys(ctx context.Context, id string) error {
+	result, err := s.db.ExecContext(ctx, s.query("DELETE FROM %s WHERE id = ?"), id)
+	if err != nil {
+		logger.Print(err)
+		return newStoreError(ctx, err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return newStoreError(ctx, err)
+	}
+
+	if deleted == 0 {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	return nil
+}
+
+// query fills in the table name and rewrites the ? placeholders for the driver in use
+func (s *SQLStore) query(format string) string {
+	query := fmt.Sprintf(format, s.tableName)
+	if s.driver != SQLDriverPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+func isMySQLDuplicateEntryError(err error) bool {
+	merr, ok := err.(*mysql.MySQLError)
+	return ok && merr.Number == mysqlDuplicateEntryError
+}
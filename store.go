@@ -2,18 +2,351 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	// StoreTypeDynamoDB keeps the encrypted data keys in a DynamoDB table
+	StoreTypeDynamoDB = "dynamodb"
+
+	// StoreTypeRedis keeps the encrypted data keys in Redis
+	StoreTypeRedis = "redis"
+
+	// StoreTypeSQL keeps the encrypted data keys in a PostgreSQL, MySQL or SQLite database
+	StoreTypeSQL = "sql"
+
+	// StoreTypeBolt keeps the encrypted data keys in an embedded bbolt database file
+	StoreTypeBolt = "bolt"
+
+	// StoreTypeObject keeps the encrypted data keys as objects in an S3-compatible bucket or a local directory
+	StoreTypeObject = "object"
+
+	// StoreTypeMemory keeps the encrypted data keys in memory, for local development and tests
+	StoreTypeMemory = "memory"
 )
 
-// Store - abstract definition of a key/value store for KMS-related data
+// Store - abstract definition of a key/value store for KMS-related data.
+// A store that fails because ctx was cancelled or expired returns a CancelledError.
+// RunStoreConformanceTests checks that an implementation behaves as described here.
 type Store interface {
-	// GetEncryptedDataKeys retrieves the encrypted data keys for the given id
-	GetEncryptedDataKeys(ctx context.Context, id string) (map[string]string, error)
+	// GetEncryptedDataKeys retrieves every version of the encrypted data keys for the given id.
+	// If the id does not exist in the store, nil is returned.
+	GetEncryptedDataKeys(ctx context.Context, id string) (*EncryptedDataKeys, error)
 
-	// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id
+	// GetEncryptedDataKeysBatch retrieves every version of the encrypted data keys for each of the given ids.
+	// Ids that do not exist in the store are left out of the returned map.
+	GetEncryptedDataKeysBatch(ctx context.Context, ids []string) (map[string]*EncryptedDataKeys, error)
+
+	// SetEncryptedDataKeysConditionally sets the encrypted data keys for the given id as its first version
 	// only if id does not exist in the store already.
 	// If the id already exists, an IDAlreadyExistsStoreError error is returned.
-	SetEncryptedDataKeysConditionally(ctx context.Context, id string, keys map[string]string) error
+	// If incomplete is true, the version is marked as missing the encrypted data key of
+	// at least one region, so it can be completed later. metadata is kept along with the version.
+	SetEncryptedDataKeysConditionally(ctx context.Context, id string, keys map[string]string, incomplete bool, metadata DataKeyMetadata) error
+
+	// AddEncryptedDataKeysVersionConditionally adds the encrypted data keys for the given id as a new version
+	// and makes it the current version, only if the current version of id is still version-1.
+	// If the id does not exist, an IDNotFoundStoreError error is returned.
+	// If the current version has changed meanwhile, a ConditionalUpdateFailedStoreError error is returned.
+	AddEncryptedDataKeysVersionConditionally(ctx context.Context, id string, version int, keys map[string]string, incomplete bool, metadata DataKeyMetadata) error
+
+	// UpdateEncryptedDataKeysConditionally sets the encrypted data keys of the regions in keys for the given version of id,
+	// only if the current encrypted data key of each of those regions still matches the one in previousKeys
+	// (a region missing from previousKeys must still be missing in the store).
+	// keyIDs are the KMS keys the data keys in keys were encrypted with, and replace the ones of those regions
+	// in the metadata of the version. If complete is true, the incomplete mark of the version is cleared.
+	// If the condition is not met, a ConditionalUpdateFailedStoreError error is returned.
+	UpdateEncryptedDataKeysConditionally(ctx context.Context, id string, version int, previousKeys map[string]string, keys map[string]string, keyIDs map[string]string, complete bool) error
+
+	// ListIDs returns up to limit ids stored after the given cursor, along with the cursor to continue from.
+	// An empty cursor starts from the beginning of the store, and an empty returned cursor means every id was listed.
+	// The order of the ids is up to the store, but it is stable across calls.
+	ListIDs(ctx context.Context, cursor string, limit int) ([]string, string, error)
+
+	// DeleteEncryptedDataKeys removes every version of the encrypted data keys for the given id.
+	// If the id does not exist in the store, an IDNotFoundStoreError error is returned.
+	DeleteEncryptedDataKeys(ctx context.Context, id string) error
+}
+
+// NewStore creates the Store selected by the store type in the given configuration,
+// mirrored to a second store if a mirror type is configured and cached in memory if caching is enabled
+func NewStore(config *Configuration) (Store, error) {
+	store, err := newStoreOfType(config.Store.Type, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Store.MirrorType != "" {
+		secondary, err := newStoreOfType(config.Store.MirrorType, config)
+		if err != nil {
+			return nil, err
+		}
+
+		mirrorStore := NewMirrorStore(store, secondary)
+		if config.Store.ReconcileIntervalInMinutes > 0 {
+			mirrorStore.StartReconciler(time.Duration(config.Store.ReconcileIntervalInMinutes) * time.Minute)
+		}
+		store = mirrorStore
+	}
+
+	if config.Cache.ExpirationInMinutes > 0 {
+		store = NewCachingStore(store, config.Cache)
+	}
+
+	return store, nil
+}
+
+func newStoreOfType(storeType string, config *Configuration) (Store, error) {
+	switch storeType {
+	case StoreTypeDynamoDB:
+		store, err := NewDynamoDBStore(config.DynamoDB)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case StoreTypeRedis:
+		store, err := NewRedisStore(config.Redis)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case StoreTypeSQL:
+		store, err := NewSQLStore(config.SQL)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case StoreTypeBolt:
+		store, err := NewBoltStore(config.Bolt)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case StoreTypeObject:
+		store, err := NewObjectStore(config.ObjectStore)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case StoreTypeMemory:
+		logger.Warnln("using an in-memory store; data keys will be lost when the server stops")
+		return NewMemoryStore(), nil
+	}
+
+	return nil, fmt.Errorf("unknown store type %q", storeType)
+}
+
+// the formats of stored items
+const (
+	// LegacyItemFormatVersion is the format of items written before key metadata was kept;
+	// their versions have no metadata
+	LegacyItemFormatVersion = 1
+
+	// CurrentItemFormatVersion is the format every item is written in, which keeps the metadata of each version
+	CurrentItemFormatVersion = 2
+)
+
+// EncryptedDataKeys - every version of the data key of an id, encrypted in each region
+type EncryptedDataKeys struct {
+	// FormatVersion is the format the item was stored in (see the ItemFormatVersion constants)
+	FormatVersion int
+
+	// CurrentVersion is the version of the data key used for new data
+	CurrentVersion int
+
+	// Versions maps each version to its encrypted data keys
+	Versions map[int]EncryptedDataKeysVersion
+}
+
+// EncryptedDataKeysVersion - one version of the data key of an id, encrypted in each region
+type EncryptedDataKeysVersion struct {
+	// Keys maps each region to the data key encrypted in that region
+	Keys map[string]string
+
+	// Incomplete is true if the data key has not been encrypted in every region yet
+	Incomplete bool
+
+	// Metadata is empty for versions stored in the legacy item format
+	Metadata DataKeyMetadata
+}
+
+// DataKeyMetadata - how and when a version of a data key was created
+type DataKeyMetadata struct {
+	CreatedAt      time.Time
+	KeySizeInBytes int
+
+	// KMSKeyIDs maps each region to the KMS key the data key is encrypted with in that region
+	KMSKeyIDs map[string]string
+}
+
+// newEncryptedDataKeys returns the encrypted data keys of a new id, whose first version is keys
+func newEncryptedDataKeys(keys map[string]string, incomplete bool, metadata DataKeyMetadata) *EncryptedDataKeys {
+	return &EncryptedDataKeys{
+		FormatVersion:  CurrentItemFormatVersion,
+		CurrentVersion: 1,
+		Versions: map[int]EncryptedDataKeysVersion{
+			1: {Keys: keys, Incomplete: incomplete, Metadata: metadata},
+		},
+	}
+}
+
+// addEncryptedDataKeysVersion adds keys as a new version of the encrypted data keys of id, following the
+// rules of AddEncryptedDataKeysVersionConditionally, for stores that check the condition themselves
+func addEncryptedDataKeysVersion(encryptedDataKeys *EncryptedDataKeys, id string, version int, keys map[string]string, incomplete bool, metadata DataKeyMetadata) error {
+	if encryptedDataKeys == nil {
+		return IDNotFoundStoreError{ID: id}
+	}
+
+	if encryptedDataKeys.CurrentVersion != version-1 {
+		return ConditionalUpdateFailedStoreError{ID: id}
+	}
+
+	encryptedDataKeys.Versions[version] = EncryptedDataKeysVersion{Keys: keys, Incomplete: incomplete, Metadata: metadata}
+	encryptedDataKeys.CurrentVersion = version
+	encryptedDataKeys.FormatVersion = CurrentItemFormatVersion
+	return nil
+}
+
+// updateEncryptedDataKeysVersion sets the keys of some regions in a version of the encrypted data keys of id, following
+// the rules of UpdateEncryptedDataKeysConditionally, for stores that check the condition themselves.
+// encryptedDataKeys is left unchanged if the condition is not met.
+func updateEncryptedDataKeysVersion(encryptedDataKeys *EncryptedDataKeys, id string, version int, previousKeys map[string]string, keys map[string]string, keyIDs map[string]string, complete bool) error {
+	if encryptedDataKeys == nil {
+		return ConditionalUpdateFailedStoreError{ID: id}
+	}
+
+	encryptedDataKeysVersion, ok := encryptedDataKeys.Versions[version]
+	if !ok {
+		return ConditionalUpdateFailedStoreError{ID: id}
+	}
+
+	for region := range keys {
+		previousKey, expected := previousKeys[region]
+		currentKey, exists := encryptedDataKeysVersion.Keys[region]
+		if expected != exists || previousKey != currentKey {
+			return ConditionalUpdateFailedStoreError{ID: id}
+		}
+	}
+
+	updatedKeys := make(map[string]string)
+	for region, key := range encryptedDataKeysVersion.Keys {
+		updatedKeys[region] = key
+	}
+	for region, key := range keys {
+		updatedKeys[region] = key
+	}
+
+	metadata := encryptedDataKeysVersion.Metadata
+	if len(keyIDs) > 0 {
+		updatedKeyIDs := make(map[string]string)
+		for region, keyID := range metadata.KMSKeyIDs {
+			updatedKeyIDs[region] = keyID
+		}
+		for region, keyID := range keyIDs {
+			updatedKeyIDs[region] = keyID
+		}
+		metadata.KMSKeyIDs = updatedKeyIDs
+	}
+
+	encryptedDataKeys.Versions[version] = EncryptedDataKeysVersion{
+		Keys:       updatedKeys,
+		Incomplete: encryptedDataKeysVersion.Incomplete && !complete,
+		Metadata:   metadata,
+	}
+	encryptedDataKeys.FormatVersion = CurrentItemFormatVersion
+	return nil
+}
+
+// jsonItem - JSON representation of EncryptedDataKeys, for stores that keep each id as a single value.
+// Items in the legacy format have no format version and no metadata in their versions.
+type jsonItem struct {
+	// ID is only kept by stores whose keys do not name the id
+	ID             string                     `json:"id,omitempty"`
+	FormatVersion  int                        `json:"format_version,omitempty"`
+	CurrentVersion int                        `json:"current_version"`
+	Versions       map[string]jsonItemVersion `json:"versions"`
+}
+
+type jsonItemVersion struct {
+	Keys           map[string]string `json:"keys"`
+	Incomplete     bool              `json:"incomplete,omitempty"`
+	CreatedAt      *time.Time        `json:"created_at,omitempty"`
+	KeySizeInBytes int               `json:"key_size_in_bytes,omitempty"`
+	KMSKeyIDs      map[string]string `json:"kms_key_ids,omitempty"`
+}
+
+func marshalJSONItem(encryptedDataKeys *EncryptedDataKeys) ([]byte, error) {
+	return json.Marshal(newJSONItem(encryptedDataKeys))
+}
+
+// newJSONItem always uses the current format, which upgrades legacy items whenever they are written
+func newJSONItem(encryptedDataKeys *EncryptedDataKeys) jsonItem {
+	item := jsonItem{
+		FormatVersion:  CurrentItemFormatVersion,
+		CurrentVersion: encryptedDataKeys.CurrentVersion,
+		Versions:       make(map[string]jsonItemVersion),
+	}
+
+	for version, encryptedDataKeysVersion := range encryptedDataKeys.Versions {
+		itemVersion := jsonItemVersion{
+			Keys:           encryptedDataKeysVersion.Keys,
+			Incomplete:     encryptedDataKeysVersion.Incomplete,
+			KeySizeInBytes: encryptedDataKeysVersion.Metadata.KeySizeInBytes,
+			KMSKeyIDs:      encryptedDataKeysVersion.Metadata.KMSKeyIDs,
+		}
+
+		if !encryptedDataKeysVersion.Metadata.CreatedAt.IsZero() {
+			createdAt := encryptedDataKeysVersion.Metadata.CreatedAt
+			itemVersion.CreatedAt = &createdAt
+		}
+
+		item.Versions[strconv.Itoa(version)] = itemVersion
+	}
+
+	return item
+}
+
+func unmarshalJSONItem(value []byte) (*EncryptedDataKeys, error) {
+	item := jsonItem{}
+	if err := json.Unmarshal(value, &item); err != nil {
+		return nil, err
+	}
+
+	formatVersion := item.FormatVersion
+	if formatVersion == 0 {
+		formatVersion = LegacyItemFormatVersion
+	}
+
+	encryptedDataKeys := &EncryptedDataKeys{
+		FormatVersion:  formatVersion,
+		CurrentVersion: item.CurrentVersion,
+		Versions:       make(map[int]EncryptedDataKeysVersion),
+	}
+
+	for versionKey, version := range item.Versions {
+		versionNumber, err := strconv.Atoi(versionKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q in stored value", versionKey)
+		}
+
+		if version.Keys == nil {
+			version.Keys = make(map[string]string)
+		}
+
+		metadata := DataKeyMetadata{KeySizeInBytes: version.KeySizeInBytes, KMSKeyIDs: version.KMSKeyIDs}
+		if version.CreatedAt != nil {
+			metadata.CreatedAt = *version.CreatedAt
+		}
+
+		encryptedDataKeys.Versions[versionNumber] = EncryptedDataKeysVersion{version.Keys, version.Incomplete, metadata}
+	}
+
+	return encryptedDataKeys, nil
 }
 
 // IDAlreadyExistsStoreError represents an error type that SetEncryptedDataKeysConditionally
@@ -25,3 +358,24 @@ type IDAlreadyExistsStoreError struct {
 func (e IDAlreadyExistsStoreError) Error() string {
 	return fmt.Sprintf("id %q already exists in the store", e.ID)
 }
+
+// IDNotFoundStoreError represents an error type that DeleteEncryptedDataKeys and AddEncryptedDataKeysVersionConditionally
+// return when the id being changed does not exist in the store.
+// Decrypt returns it as well when the id of a ciphertext has no data key.
+type IDNotFoundStoreError struct {
+	ID string
+}
+
+func (e IDNotFoundStoreError) Error() string {
+	return fmt.Sprintf("id %q does not exist in the store", e.ID)
+}
+
+// ConditionalUpdateFailedStoreError represents an error type that UpdateEncryptedDataKeysConditionally and
+// AddEncryptedDataKeysVersionConditionally return when the stored encrypted data keys for the id no longer match the expected values
+type ConditionalUpdateFailedStoreError struct {
+	ID string
+}
+
+func (e ConditionalUpdateFailedStoreError) Error() string {
+	return fmt.Sprintf("encrypted data keys for id %q were changed or removed in the store", e.ID)
+}
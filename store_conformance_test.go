@@ -0,0 +1,632 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// StoreFactory returns a new Store for a conformance test, along with a function that releases it.
+// The store may already hold other ids, e.g. a shared DynamoDB table, since every test uses ids of its own.
+type StoreFactory func(t *testing.T) (Store, func())
+
+// RunStoreConformanceTests checks that a Store implementation behaves the way the Store interface describes,
+// and the way RKMS relies on: conditional writes that let exactly one concurrent writer win, the error types
+// RKMS tells apart, listing and deletion. Every backend should pass it, e.g.:
+//
+//	func TestMyStoreConformance(t *testing.T) {
+//		RunStoreConformanceTests(t, func(t *testing.T) (Store, func()) {
+//			return NewMyStore(...), func() {}
+//		})
+//	}
+func RunStoreConformanceTests(t *testing.T, newStore StoreFactory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, store Store, id func(string) string)
+	}{
+		{"GetMissing", testStoreGetMissing},
+		{"SetThenGet", testStoreSetThenGet},
+		{"SetExisting", testStoreSetExisting},
+		{"ConcurrentSets", testStoreConcurrentSets},
+		{"AddVersion", testStoreAddVersion},
+		{"ConcurrentAdds", testStoreConcurrentAdds},
+		{"Update", testStoreUpdate},
+		{"ListIDs", testStoreListIDs},
+		{"Delete", testStoreDelete},
+		{"CancelledContext", testStoreCancelledContext},
+	}
+
+	//ids are unique to each run, so stores that keep data between runs can be tested too
+	run := time.Now().UnixNano()
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			store, release := newStore(t)
+			defer release()
+
+			id := func(name string) string {
+				return fmt.Sprintf("conformance-%d-%s-%s", run, test.name, name)
+			}
+			test.test(t, store, id)
+		})
+	}
+}
+
+var conformanceMetadata = DataKeyMetadata{
+	CreatedAt:      time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	KeySizeInBytes: 32,
+	KMSKeyIDs:      map[string]string{"region-0": "key-0", "region-1": "key-1"},
+}
+
+func testStoreGetMissing(t *testing.T, store Store, id func(string) string) {
+	ctx := context.Background()
+
+	encryptedDataKeys, err := store.GetEncryptedDataKeys(ctx, id("missing"))
+	if err != nil || encryptedDataKeys != nil {
+		t.Fatalf("expected nil for a missing id, got: %+v, err=%v", encryptedDataKeys, err)
+	}
+
+	batch, err := store.GetEncryptedDataKeysBatch(ctx, []string{id("missing"), id("also-missing")})
+	if err != nil || len(batch) != 0 {
+		t.Fatalf("expected an empty batch for missing ids, got: %+v, err=%v", batch, err)
+	}
+}
+
+func testStoreSetThenGet(t *testing.T, store Store, id func(string) string) {
+	ctx := context.Background()
+	keys := map[string]string{"region-0": "ciphertext-0", "region-1": "ciphertext-1"}
+
+	if err := store.SetEncryptedDataKeysConditionally(ctx, id("a"), keys, true, conformanceMetadata); err != nil {
+		t.Fatalf("failed to set encrypted data keys: %s", err)
+	}
+
+	//the store must not keep a reference to the caller's map
+	keys["region-0"] = "changed"
+
+	encryptedDataKeys, err := store.GetEncryptedDataKeys(ctx, id("a"))
+	if err != nil || encryptedDataKeys == nil {
+		t.Fatalf("failed to get encrypted data keys: %+v, err=%v", encryptedDataKeys, err)
+	}
+
+	if encryptedDataKeys.CurrentVersion != 1 || len(encryptedDataKeys.Versions) != 1 || encryptedDataKeys.FormatVersion != CurrentItemFormatVersion {
+		t.Fatalf("unexpected encrypted data keys: %+v", encryptedDataKeys)
+	}
+
+	version := encryptedDataKeys.Versions[1]
+	if !version.Incomplete || len(version.Keys) != 2 || version.Keys["region-0"] != "ciphertext-0" || version.Keys["region-1"] != "ciphertext-1" {
+		t.Fatalf("unexpected version 1: %+v", version)
+	}
+
+	metadata := version.Metadata
+	if !metadata.CreatedAt.Equal(conformanceMetadata.CreatedAt) || metadata.KeySizeInBytes != 32 || metadata.KMSKeyIDs["region-1"] != "key-1" {
+		t.Fatalf("unexpected metadata of version 1: %+v", metadata)
+	}
+
+	batch, err := store.GetEncryptedDataKeysBatch(ctx, []string{id("a"), id("missing")})
+	if err != nil || len(batch) != 1 || batch[id("a")] == nil || batch[id("a")].Versions[1].Keys["region-0"] != "ciphertext-0" {
+		t.Fatalf("unexpected batch result: %+v, err=%v", batch, err)
+	}
+}
+
+func testStoreSetExisting(t *testing.T, store Store, id func(string) string) {
+	ctx := context.Background()
+
+	if err := store.SetEncryptedDataKeysConditionally(ctx, id("a"), map[string]string{"region-0": "first"}, false, DataKeyMetadata{}); err != nil {
+		t.Fatalf("failed to set encrypted data keys: %s", err)
+	}
+
+	err := store.SetEncryptedDataKeysConditionally(ctx, id("a"), map[string]string{"region-0": "second"}, false, DataKeyMetadata{})
+	if _, ok := err.(IDAlreadyExistsStoreError); !ok {
+		t.Fatalf("expected an IDAlreadyExistsStoreError, got: %T %v", err, err)
+	}
+
+	encryptedDataKeys, err := store.GetEncryptedDataKeys(ctx, id("a"))
+	if err != nil || encryptedDataKeys.Versions[1].Keys["region-0"] != "first" {
+		t.Fatalf("expected the first write to be kept, got: %+v, err=%v", encryptedDataKeys, err)
+	}
+}
+
+func testStoreConcurrentSets(t *testing.T, store Store, id func(string) string) {
+	ctx := context.Background()
+	errs := runConcurrently(10, func(i int) error {
+		keys := map[string]string{"region-0": fmt.Sprintf("ciphertext-%d", i)}
+		return store.SetEncryptedDataKeysConditionally(ctx, id("a"), keys, false, DataKeyMetadata{})
+	})
+
+	winner := -1
+	for i, err := range errs {
+		if err == nil {
+			if winner >= 0 {
+				t.Fatalf("writers %d and %d both won", winner, i)
+			}
+			winner = i
+			continue
+		}
+
+		if _, ok := err.(IDAlreadyExistsStoreError); !ok {
+			t.Fatalf("expected an IDAlreadyExistsStoreError for writer %d, got: %T %v", i, err, err)
+		}
+	}
+
+	if winner < 0 {
+		t.Fatal("no writer won")
+	}
+
+	encryptedDataKeys, err := store.GetEncryptedDataKeys(ctx, id("a"))
+	if err != nil || encryptedDataKeys.Versions[1].Keys["region-0"] != fmt.Sprintf("ciphertext-%d", winner) {
+		t.Fatalf("expected the keys of writer %d, got: %+v, err=%v", winner, encryptedDataKeys, err)
+	}
+}
+
+func testStoreAddVersion(t *testing.T, store Store, id func(string) string) {
+	ctx := context.Background()
+
+	err := store.AddEncryptedDataKeysVersionConditionally(ctx, id("missing"), 2, map[string]string{"region-0": "v2"}, false, DataKeyMetadata{})
+	if _, ok := err.(IDNotFoundStoreError); !ok {
+		t.Fatalf("expected an IDNotFoundStoreError, got: %T %v", err, err)
+	}
+
+	if err := store.SetEncryptedDataKeysConditionally(ctx, id("a"), map[string]string{"region-0": "v1"}, false, DataKeyMetadata{}); err != nil {
+		t.Fatalf("failed to set encrypted data keys: %s", err)
+	}
+
+	if err := store.AddEncryptedDataKeysVersionConditionally(ctx, id("a"), 2, map[string]string{"region-0": "v2"}, true, conformanceMetadata); err != nil {
+		t.Fatalf("failed to add version 2: %s", err)
+	}
+
+	for _, version := range []int{2, 4} {
+		err := store.AddEncryptedDataKeysVersionConditionally(ctx, id("a"), version, map[string]string{"region-0": "other"}, false, DataKeyMetadata{})
+		if _, ok := err.(ConditionalUpdateFailedStoreError); !ok {
+			t.Fatalf("expected a ConditionalUpdateFailedStoreError adding version %d, got: %T %v", version, err, err)
+		}
+	}
+
+	encryptedDataKeys, err := store.GetEncryptedDataKeys(ctx, id("a"))
+	if err != nil || encryptedDataKeys.CurrentVersion != 2 || len(encryptedDataKeys.Versions) != 2 {
+		t.Fatalf("unexpected encrypted data keys: %+v, err=%v", encryptedDataKeys, err)
+	}
+
+	version1, version2 := encryptedDataKeys.Versions[1], encryptedDataKeys.Versions[2]
+	if version1.Keys["region-0"] != "v1" || version2.Keys["region-0"] != "v2" || !version2.Incomplete || version2.Metadata.KeySizeInBytes != 32 {
+		t.Fatalf("unexpected versions: %+v", encryptedDataKeys.Versions)
+	}
+}
+
+func testStoreConcurrentAdds(t *testing.T, store Store, id func(string) string) {
+	ctx := context.Background()
+	if err := store.SetEncryptedDataKeysConditionally(ctx, id("a"), map[string]string{"region-0": "v1"}, false, DataKeyMetadata{}); err != nil {
+		t.Fatalf("failed to set encrypted data keys: %s", err)
+	}
+
+	errs := runConcurrently(10, func(i int) error {
+		keys := map[string]string{"region-0": fmt.Sprintf("v2-%d", i)}
+		return store.AddEncryptedDataKeysVersionConditionally(ctx, id("a"), 2, keys, false, DataKeyMetadata{})
+	})
+
+	winner := -1
+	for i, err := range errs {
+		if err == nil {
+			if winner >= 0 {
+				t.Fatalf("writers %d and %d both won", winner, i)
+			}
+			winner = i
+			continue
+		}
+
+		if _, ok := err.(ConditionalUpdateFailedStoreError); !ok {
+			t.Fatalf("expected a ConditionalUpdateFailedStoreError for writer %d, got: %T %v", i, err, err)
+		}
+	}
+
+	if winner < 0 {
+		t.Fatal("no writer won")
+	}
+
+	encryptedDataKeys, err := store.GetEncryptedDataKeys(ctx, id("a"))
+	if err != nil || encryptedDataKeys.CurrentVersion != 2 || encryptedDataKeys.Versions[2].Keys["region-0"] != fmt.Sprintf("v2-%d", winner) {
+		t.Fatalf("expected version 2 of writer %d, got: %+v, err=%v", winner, encryptedDataKeys, err)
+	}
+}
+
+func testStoreUpdate(t *testing.T, store Store, id func(string) string) {
+	ctx := context.Background()
+
+	err := store.UpdateEncryptedDataKeysConditionally(ctx, id("missing"), 1, map[string]string{}, map[string]string{"region-1": "repaired"}, nil, true)
+	if _, ok := err.(ConditionalUpdateFailedStoreError); !ok {
+		t.Fatalf("expected a ConditionalUpdateFailedStoreError for a missing id, got: %T %v", err, err)
+	}
+
+	keys := map[string]string{"region-0": "ciphertext-0"}
+	if err := store.SetEncryptedDataKeysConditionally(ctx, id("a"), keys, true, conformanceMetadata); err != nil {
+		t.Fatalf("failed to set encrypted data keys: %s", err)
+	}
+
+	failedUpdates := []struct {
+		version      int
+		previousKeys map[string]string
+		keys         map[string]string
+	}{
+		{2, map[string]string{}, map[string]string{"region-1": "repaired"}},                           //missing version
+		{1, map[string]string{"region-0": "stale"}, map[string]string{"region-0": "repaired"}},        //changed key
+		{1, map[string]string{}, map[string]string{"region-0": "repaired"}},                           //key expected to be missing
+		{1, map[string]string{"region-1": "ciphertext-1"}, map[string]string{"region-1": "repaired"}}, //key expected to exist
+	}
+
+	for i, update := range failedUpdates {
+		err := store.UpdateEncryptedDataKeysConditionally(ctx, id("a"), update.version, update.previousKeys, update.keys, nil, true)
+		if _, ok := err.(ConditionalUpdateFailedStoreError); !ok {
+			t.Fatalf("expected a ConditionalUpdateFailedStoreError for update %d, got: %T %v", i, err, err)
+		}
+	}
+
+	err = store.UpdateEncryptedDataKeysConditionally(ctx, id("a"), 1, map[string]string{}, map[string]string{"region-2": "ciphertext-2"}, map[string]string{"region-2": "key-2"}, false)
+	if err != nil {
+		t.Fatalf("failed to add a region: %s", err)
+	}
+
+	err = store.UpdateEncryptedDataKeysConditionally(ctx, id("a"), 1, keys, map[string]string{"region-0": "rewrapped"}, map[string]string{"region-0": "new-key-0"}, true)
+	if err != nil {
+		t.Fatalf("failed to replace a region: %s", err)
+	}
+
+	encryptedDataKeys, err := store.GetEncryptedDataKeys(ctx, id("a"))
+	if err != nil {
+		t.Fatalf("failed to get encrypted data keys: %s", err)
+	}
+
+	version := encryptedDataKeys.Versions[1]
+	if version.Incomplete || len(version.Keys) != 2 || version.Keys["region-0"] != "rewrapped" || version.Keys["region-2"] != "ciphertext-2" {
+		t.Fatalf("unexpected version 1 after updates: %+v", version)
+	}
+
+	keyIDs := version.Metadata.KMSKeyIDs
+	if keyIDs["region-0"] != "new-key-0" || keyIDs["region-1"] != "key-1" || keyIDs["region-2"] != "key-2" {
+		t.Fatalf("unexpected KMS key ids after updates: %v", keyIDs)
+	}
+}
+
+func testStoreListIDs(t *testing.T, store Store, id func(string) string) {
+	ctx := context.Background()
+
+	var ids []string
+	for i := 0; i < 23; i++ {
+		ids = append(ids, id(fmt.Sprintf("%02d", i)))
+		if err := store.SetEncryptedDataKeysConditionally(ctx, ids[i], map[string]string{"region-0": "ciphertext"}, false, DataKeyMetadata{}); err != nil {
+			t.Fatalf("failed to set encrypted data keys: %s", err)
+		}
+	}
+
+	if err := store.DeleteEncryptedDataKeys(ctx, ids[5]); err != nil {
+		t.Fatalf("failed to delete encrypted data keys: %s", err)
+	}
+
+	//the store may hold other ids too, so only the ones of this test are checked
+	wanted := make(map[string]bool)
+	for i, id := range ids {
+		wanted[id] = i != 5
+	}
+
+	listed := make(map[string]int)
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 10000 {
+			t.Fatal("listing ids did not end")
+		}
+
+		page, nextCursor, err := store.ListIDs(ctx, cursor, 7)
+		if err != nil {
+			t.Fatalf("failed to list ids: %s", err)
+		}
+
+		if len(page) > 7 {
+			t.Fatalf("expected at most 7 ids in a page, got %d", len(page))
+		}
+
+		for _, id := range page {
+			listed[id]++
+		}
+
+		if cursor = nextCursor; cursor == "" {
+			break
+		}
+	}
+
+	for id, exists := range wanted {
+		//stores built on incremental scans, like Redis, may list an id more than once
+		if exists && listed[id] == 0 {
+			t.Fatalf("expected id %q to be listed", id)
+		}
+
+		if !exists && listed[id] != 0 {
+			t.Fatalf("expected deleted id %q not to be listed", id)
+		}
+	}
+}
+
+func testStoreDelete(t *testing.T, store Store, id func(string) string) {
+	ctx := context.Background()
+
+	err := store.DeleteEncryptedDataKeys(ctx, id("missing"))
+	if _, ok := err.(IDNotFoundStoreError); !ok {
+		t.Fatalf("expected an IDNotFoundStoreError, got: %T %v", err, err)
+	}
+
+	if err := store.SetEncryptedDataKeysConditionally(ctx, id("a"), map[string]string{"region-0": "first"}, false, DataKeyMetadata{}); err != nil {
+		t.Fatalf("failed to set encrypted data keys: %s", err)
+	}
+
+	if err := store.DeleteEncryptedDataKeys(ctx, id("a")); err != nil {
+		t.Fatalf("failed to delete encrypted data keys: %s", err)
+	}
+
+	encryptedDataKeys, err := store.GetEncryptedDataKeys(ctx, id("a"))
+	if err != nil || encryptedDataKeys != nil {
+		t.Fatalf("expected nil after deleting, got: %+v, err=%v", encryptedDataKeys, err)
+	}
+
+	err = store.DeleteEncryptedDataKeys(ctx, id("a"))
+	if _, ok := err.(IDNotFoundStoreError); !ok {
+		t.Fatalf("expected an IDNotFoundStoreError deleting twice, got: %T %v", err, err)
+	}
+
+	//a deleted id starts over from version 1
+	if err := store.SetEncryptedDataKeysConditionally(ctx, id("a"), map[string]string{"region-0": "second"}, false, DataKeyMetadata{}); err != nil {
+		t.Fatalf("failed to set encrypted data keys after deleting: %s", err)
+	}
+
+	encryptedDataKeys, err = store.GetEncryptedDataKeys(ctx, id("a"))
+	if err != nil || encryptedDataKeys.CurrentVersion != 1 || encryptedDataKeys.Versions[1].Keys["region-0"] != "second" {
+		t.Fatalf("unexpected encrypted data keys after deleting: %+v, err=%v", encryptedDataKeys, err)
+	}
+}
+
+// testStoreCancelledContext checks that a store either ignores a cancelled context or fails with a CancelledError,
+// so RKMS does not report a cancelled request as an unavailable store, and never mistakes it for a missing id
+func testStoreCancelledContext(t *testing.T, store Store, id func(string) string) {
+	if err := store.SetEncryptedDataKeysConditionally(context.Background(), id("a"), map[string]string{"region-0": "ciphertext"}, false, DataKeyMetadata{}); err != nil {
+		t.Fatalf("failed to set encrypted data keys: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	checkErr := func(operation string, err error) {
+		if _, ok := err.(CancelledError); err != nil && !ok {
+			t.Fatalf("expected %s to succeed or fail with a CancelledError, got: %T %v", operation, err, err)
+		}
+	}
+
+	encryptedDataKeys, err := store.GetEncryptedDataKeys(ctx, id("a"))
+	checkErr("get", err)
+	if err == nil && encryptedDataKeys == nil {
+		t.Fatal("expected an existing id not to be reported missing with a cancelled context")
+	}
+
+	batch, err := store.GetEncryptedDataKeysBatch(ctx, []string{id("a")})
+	checkErr("batch get", err)
+	if err == nil && batch[id("a")] == nil {
+		t.Fatal("expected an existing id not to be left out of a batch with a cancelled context")
+	}
+
+	_, _, err = store.ListIDs(ctx, "", 10)
+	checkErr("list", err)
+
+	err = store.SetEncryptedDataKeysConditionally(ctx, id("b"), map[string]string{"region-0": "ciphertext"}, false, DataKeyMetadata{})
+	checkErr("set", err)
+
+	err = store.AddEncryptedDataKeysVersionConditionally(ctx, id("a"), 2, map[string]string{"region-0": "ciphertext"}, false, DataKeyMetadata{})
+	checkErr("add version", err)
+}
+
+// RunStoreCancellationTests checks that a store that does not ignore cancelled contexts fails every operation
+// with a CancelledError once its context is cancelled, without reading or writing anything
+func RunStoreCancellationTests(t *testing.T, newStore StoreFactory) {
+	store, release := newStore(t)
+	defer release()
+
+	id := fmt.Sprintf("cancellation-%d", time.Now().UnixNano())
+	keys := map[string]string{"region-0": "ciphertext"}
+	if err := store.SetEncryptedDataKeysConditionally(context.Background(), id, keys, false, DataKeyMetadata{}); err != nil {
+		t.Fatalf("failed to set encrypted data keys: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	checkErr := func(operation string, err error) {
+		if _, ok := err.(CancelledError); !ok {
+			t.Fatalf("expected %s to fail with a CancelledError, got: %T %v", operation, err, err)
+		}
+	}
+
+	_, err := store.GetEncryptedDataKeys(ctx, id)
+	checkErr("get", err)
+
+	_, err = store.GetEncryptedDataKeysBatch(ctx, []string{id})
+	checkErr("batch get", err)
+
+	_, _, err = store.ListIDs(ctx, "", 10)
+	checkErr("list", err)
+
+	checkErr("set", store.SetEncryptedDataKeysConditionally(ctx, id+"-new", keys, false, DataKeyMetadata{}))
+	checkErr("add version", store.AddEncryptedDataKeysVersionConditionally(ctx, id, 2, keys, false, DataKeyMetadata{}))
+	checkErr("update", store.UpdateEncryptedDataKeysConditionally(ctx, id, 1, keys, map[string]string{"region-0": "other"}, nil, true))
+	checkErr("delete", store.DeleteEncryptedDataKeys(ctx, id))
+
+	encryptedDataKeys, err := store.GetEncryptedDataKeys(context.Background(), id)
+	if err != nil || encryptedDataKeys == nil || encryptedDataKeys.CurrentVersion != 1 || encryptedDataKeys.Versions[1].Keys["region-0"] != "ciphertext" {
+		t.Fatalf("expected cancelled writes not to change the store, got: %+v, err=%v", encryptedDataKeys, err)
+	}
+}
+
+// runConcurrently calls write n times at once and returns the error of each call
+func runConcurrently(n int, write func(i int) error) []error {
+	errs := make([]error, n)
+	start := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs[i] = write(i)
+		}(i)
+	}
+
+	close(start)
+	wg.Wait()
+	return errs
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	RunStoreConformanceTests(t, func(t *testing.T) (Store, func()) {
+		return NewMemoryStore(), func() {}
+	})
+}
+
+func TestBoltStoreConformance(t *testing.T) {
+	newStore := func(t *testing.T) (Store, func()) {
+		dir := newTempDir(t)
+		store, err := NewBoltStore(BoltConfig{Path: filepath.Join(dir, "rkms.db")})
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("failed to open bbolt database: %s", err)
+		}
+
+		return store, func() {
+			store.Close()
+			os.RemoveAll(dir)
+		}
+	}
+
+	RunStoreConformanceTests(t, newStore)
+	RunStoreCancellationTests(t, newStore)
+}
+
+func TestSQLStoreSQLiteConformance(t *testing.T) {
+	RunStoreConformanceTests(t, func(t *testing.T) (Store, func()) {
+		dir := newTempDir(t)
+		store, err := NewSQLStore(SQLConfig{Driver: SQLDriverSQLite, DSN: filepath.Join(dir, "rkms.db")})
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Skipf("SQLite is not available: %s", err)
+		}
+
+		return store, func() { os.RemoveAll(dir) }
+	})
+}
+
+func TestObjectStoreDirectoryConformance(t *testing.T) {
+	RunStoreConformanceTests(t, func(t *testing.T) (Store, func()) {
+		dir := newTempDir(t)
+		store, err := NewObjectStore(ObjectStoreConfig{Backend: ObjectStorageDirectory, Directory: dir})
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("failed to create object store: %s", err)
+		}
+
+		return store, func() { os.RemoveAll(dir) }
+	})
+}
+
+// TestObjectStoreS3Conformance runs against the bucket RKMS_TEST_S3_BUCKET at RKMS_TEST_S3_ENDPOINT, e.g. a local MinIO
+func TestObjectStoreS3Conformance(t *testing.T) {
+	endpoint := os.Getenv("RKMS_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("RKMS_TEST_S3_ENDPOINT is not set")
+	}
+
+	RunStoreConformanceTests(t, func(t *testing.T) (Store, func()) {
+		store, err := NewObjectStore(ObjectStoreConfig{
+			Backend:        ObjectStorageS3,
+			Bucket:         os.Getenv("RKMS_TEST_S3_BUCKET"),
+			Prefix:         fmt.Sprintf("conformance-%d/", time.Now().UnixNano()),
+			Region:         "us-east-1",
+			Endpoint:       endpoint,
+			ForcePathStyle: true,
+		})
+		if err != nil {
+			t.Fatalf("failed to create object store: %s", err)
+		}
+
+		return store, func() {}
+	})
+}
+
+func TestCachingStoreConformance(t *testing.T) {
+	RunStoreConformanceTests(t, func(t *testing.T) (Store, func()) {
+		cacheConfig := CacheConfig{ExpirationInMinutes: 5, NegativeExpirationInSeconds: 60, MaxEntries: 10}
+		return NewCachingStore(NewMemoryStore(), cacheConfig), func() {}
+	})
+}
+
+func TestMirrorStoreConformance(t *testing.T) {
+	RunStoreConformanceTests(t, func(t *testing.T) (Store, func()) {
+		return NewMirrorStore(NewMemoryStore(), NewMemoryStore()), func() {}
+	})
+}
+
+// TestRedisStoreConformance runs against the Redis server at RKMS_TEST_REDIS_ADDR, e.g. a local redis-server
+func TestRedisStoreConformance(t *testing.T) {
+	addr := os.Getenv("RKMS_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("RKMS_TEST_REDIS_ADDR is not set")
+	}
+
+	RunStoreConformanceTests(t, func(t *testing.T) (Store, func()) {
+		store, err := NewRedisStore(RedisConfig{Addresses: []string{addr}, KeyPrefix: fmt.Sprintf("rkms-test-%d:", time.Now().UnixNano())})
+		if err != nil {
+			t.Fatalf("failed to connect to Redis: %s", err)
+		}
+
+		return store, func() {}
+	})
+}
+
+// TestDynamoDBStoreConformance runs against the existing table RKMS_TEST_DYNAMODB_TABLE,
+// in DynamoDB Local if RKMS_TEST_DYNAMODB_ENDPOINT is set
+func TestDynamoDBStoreConformance(t *testing.T) {
+	tableName := os.Getenv("RKMS_TEST_DYNAMODB_TABLE")
+	if tableName == "" {
+		t.Skip("RKMS_TEST_DYNAMODB_TABLE is not set")
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	awsConfig := &aws.Config{Region: aws.String(region)}
+	if endpoint := os.Getenv("RKMS_TEST_DYNAMODB_ENDPOINT"); endpoint != "" {
+		awsConfig.Endpoint = aws.String(endpoint)
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	RunStoreConformanceTests(t, func(t *testing.T) (Store, func()) {
+		replica := dynamoDBReplica{region, dynamodb.New(sess)}
+		return &DynamoDBStore{tableName: aws.String(tableName), replicas: []dynamoDBReplica{replica}}, func() {}
+	})
+}
+
+func newTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rkms")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
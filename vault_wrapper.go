@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultVaultTimeoutInSeconds is how long a request to Vault may take when no timeout is configured
+const DefaultVaultTimeoutInSeconds = 10
+
+// the ways a Vault backend can authenticate
+const (
+	VaultAuthToken   = "token"
+	VaultAuthAppRole = "approle"
+)
+
+// vaultTokenRenewalMargin is how long before its lease ends an AppRole token is replaced by logging in again
+const vaultTokenRenewalMargin = 30 * time.Second
+
+// vaultCiphertextPattern matches the version prefix of a Transit ciphertext, e.g. "vault:v3:"
+var vaultCiphertextPattern = regexp.MustCompile(`^vault:v([0-9]+):`)
+
+// VaultError represents an error type that is returned when Vault rejects a request
+type VaultError struct {
+	StatusCode int
+	Errors     []string
+}
+
+func (e VaultError) Error() string {
+	return fmt.Sprintf("vault responded with status %d: %s", e.StatusCode, strings.Join(e.Errors, "; "))
+}
+
+// isKeyNotFound reports whether Vault rejected a request because the Transit key does not exist,
+// which does not make the ciphertext corrupted
+func (e VaultError) isKeyNotFound() bool {
+	for _, message := range e.Errors {
+		if strings.Contains(message, "not found") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// VaultKeyWrapper - KeyWrapper implementation for a key of the Transit secrets engine of HashiCorp Vault.
+// Data keys are wrapped as Transit ciphertexts ("vault:v<version>:..."), and the key id of a ciphertext
+// names the Transit key and the version of it that encrypted the data key.
+type VaultKeyWrapper struct {
+	client    *http.Client
+	address   string
+	namespace string
+	mount     string
+	keyName   string
+
+	authMethod   string
+	roleID       string
+	secretID     string
+	appRoleMount string
+
+	mutex          sync.Mutex
+	token          string
+	tokenExpiresAt time.Time //zero if the token does not expire or is not known to
+}
+
+type vaultResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Auth   *vaultAuth      `json:"auth"`
+	Errors []string        `json:"errors"`
+}
+
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+}
+
+type vaultTransitData struct {
+	Plaintext     string `json:"plaintext"`
+	Ciphertext    string `json:"ciphertext"`
+	KeyVersion    int    `json:"key_version"`
+	LatestVersion int    `json:"latest_version"`
+}
+
+// newVaultKeyWrapper creates a new VaultKeyWrapper instance for the Transit key of the given backend
+func newVaultKeyWrapper(backendConfig WrappingBackendConfig) (*VaultKeyWrapper, error) {
+	tlsConfig := &tls.Config{}
+	if backendConfig.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(backendConfig.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", backendConfig.TLSCAFile)
+		}
+	}
+
+	timeout := backendConfig.TimeoutInSeconds
+	if timeout <= 0 {
+		timeout = DefaultVaultTimeoutInSeconds
+	}
+
+	w := &VaultKeyWrapper{
+		client: &http.Client{
+			Timeout:   time.Duration(timeout) * time.Second,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+		},
+		address:      strings.TrimRight(backendConfig.Address, "/"),
+		namespace:    strings.Trim(backendConfig.Namespace, "/"),
+		mount:        strings.Trim(backendConfig.Mount, "/"),
+		keyName:      backendConfig.KeyName,
+		authMethod:   backendConfig.AuthMethod,
+		roleID:       backendConfig.RoleID,
+		secretID:     backendConfig.SecretID,
+		appRoleMount: strings.Trim(backendConfig.AppRoleMount, "/"),
+	}
+
+	if w.mount == "" {
+		w.mount = "transit"
+	}
+
+	if w.authMethod == "" {
+		w.authMethod = VaultAuthToken
+	}
+
+	if w.appRoleMount == "" {
+		w.appRoleMount = "approle"
+	}
+
+	switch w.authMethod {
+	case VaultAuthToken:
+		w.token = backendConfig.Token
+		if w.token == "" {
+			w.token = os.Getenv("VAULT_TOKEN")
+		}
+		if w.token == "" {
+			return nil, fmt.Errorf("key-wrapping backend %s needs a Vault token", backendConfig.Name)
+		}
+	case VaultAuthAppRole:
+		if w.roleID == "" || w.secretID == "" {
+			return nil, fmt.Errorf("key-wrapping backend %s needs a role_id and a secret_id", backendConfig.Name)
+		}
+	default:
+		return nil, fmt.Errorf("unknown Vault auth method %q of key-wrapping backend %s", w.authMethod, backendConfig.Name)
+	}
+
+	return w, nil
+}
+
+// GenerateDataKey generates a data key with the datakey endpoint of Transit
+func (w *VaultKeyWrapper) GenerateDataKey(ctx context.Context, sizeInBytes int) ([]byte, []byte, string, error) {
+	data, err := w.transit(ctx, "datakey/plaintext", map[string]interface{}{"bits": sizeInBytes * 8})
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(data.Plaintext)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("vault returned a data key that is not base64 encoded")
+	}
+
+	return plaintext, []byte(data.Ciphertext), w.keyID(data.KeyVersion), nil
+}
+
+// WrapKey encrypts the given data key with the encrypt endpoint of Transit
+func (w *VaultKeyWrapper) WrapKey(ctx context.Context, plaintext []byte) ([]byte, string, error) {
+	data, err := w.transit(ctx, "encrypt", map[string]interface{}{"plaintext": base64.StdEncoding.EncodeToString(plaintext)})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return []byte(data.Ciphertext), w.keyID(data.KeyVersion), nil
+}
+
+// UnwrapKey decrypts the given data key with the decrypt endpoint of Transit
+func (w *VaultKeyWrapper) UnwrapKey(ctx context.Context, ciphertext []byte) ([]byte, string, error) {
+	version, err := vaultCiphertextVersion(ciphertext)
+	if err != nil {
+		return nil, "", err
+	}
+
+	data, err := w.transit(ctx, "decrypt", map[string]interface{}{"ciphertext": string(ciphertext)})
+	if err != nil {
+		//Transit rejects ciphertexts it cannot authenticate as bad requests
+		if vaultErr, ok := err.(VaultError); ok && vaultErr.StatusCode == http.StatusBadRequest && !vaultErr.isKeyNotFound() {
+			return nil, "", CorruptedWrappedKeyError{err}
+		}
+		return nil, "", err
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(data.Plaintext)
+	if err != nil {
+		return nil, "", fmt.Errorf("vault returned a data key that is not base64 encoded")
+	}
+
+	return plaintext, w.keyID(version), nil
+}
+
+// CurrentKeyID returns the id of the latest version of the Transit key, which new data keys are wrapped with
+func (w *VaultKeyWrapper) CurrentKeyID(ctx context.Context) (string, error) {
+	data := vaultTransitData{}
+	if err := w.request(ctx, http.MethodGet, path.Join(w.mount, "keys", w.keyName), nil, &data); err != nil {
+		return "", fmt.Errorf("failed to read Transit key %s: %s", w.keyName, err)
+	}
+
+	return w.keyID(data.LatestVersion), nil
+}
+
+// RewrapKey re-encrypts the given data key under the given version of the Transit key within Vault
+func (w *VaultKeyWrapper) RewrapKey(ctx context.Context, ciphertext []byte, keyID string) ([]byte, error) {
+	version, err := strconv.Atoi(strings.TrimPrefix(keyID, w.keyIDPrefix()))
+	if err != nil || !strings.HasPrefix(keyID, w.keyIDPrefix()) {
+		return nil, fmt.Errorf("%s is not a version of Transit key %s", keyID, w.keyName)
+	}
+
+	data, err := w.transit(ctx, "rewrap", map[string]interface{}{"ciphertext": string(ciphertext), "key_version": version})
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(data.Ciphertext), nil
+}
+
+// keyID returns the id of the given version of the Transit key, which includes the namespace and mount it is in
+func (w *VaultKeyWrapper) keyID(version int) string {
+	return w.keyIDPrefix() + strconv.Itoa(version)
+}
+
+func (w *VaultKeyWrapper) keyIDPrefix() string {
+	return fmt.Sprintf("vault:%s:v", path.Join(w.namespace, w.mount, "keys", w.keyName))
+}
+
+// vaultCiphertextVersion returns the version of the Transit key a ciphertext was encrypted with
+func vaultCiphertextVersion(ciphertext []byte) (int, error) {
+	match := vaultCiphertextPattern.FindSubmatch(ciphertext)
+	if match == nil {
+		return 0, CorruptedWrappedKeyError{fmt.Errorf("not a Vault Transit ciphertext")}
+	}
+
+	return strconv.Atoi(string(match[1]))
+}
+
+// transit calls the given endpoint of the Transit key
+func (w *VaultKeyWrapper) transit(ctx context.Context, endpoint string, body interface{}) (vaultTransitData, error) {
+	data := vaultTransitData{}
+	err := w.request(ctx, http.MethodPost, path.Join(w.mount, endpoint, w.keyName), body, &data)
+	return data, err
+}
+
+// request calls the Vault API with the current token, logging in again once if an AppRole token was rejected
+func (w *VaultKeyWrapper) request(ctx context.Context, method string, apiPath string, body interface{}, data interface{}) error {
+	for attempt := 0; ; attempt++ {
+		token, err := w.currentToken(ctx)
+		if err != nil {
+			return err
+		}
+
+		response, err := w.do(ctx, method, apiPath, token, body)
+		if vaultErr, ok := err.(VaultError); ok && vaultErr.StatusCode == http.StatusForbidden && w.authMethod == VaultAuthAppRole && attempt == 0 {
+			w.expireToken(token)
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(response.Data, data)
+	}
+}
+
+// currentToken returns the token to call Vault with, logging in with AppRole if there is none or it is about to expire
+func (w *VaultKeyWrapper) currentToken(ctx context.Context) (string, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.authMethod != VaultAuthAppRole {
+		return w.token, nil
+	}
+
+	if w.token != "" && (w.tokenExpiresAt.IsZero() || time.Now().Before(w.tokenExpiresAt)) {
+		return w.token, nil
+	}
+
+	login := map[string]string{"role_id": w.roleID, "secret_id": w.secretID}
+	response, err := w.do(ctx, http.MethodPost, path.Join("auth", w.appRoleMount, "login"), "", login)
+	if err != nil {
+		return "", fmt.Errorf("failed to log in to Vault with AppRole: %s", err)
+	}
+
+	if response.Auth == nil || response.Auth.ClientToken == "" {
+		return "", fmt.Errorf("failed to log in to Vault with AppRole: no token was returned")
+	}
+
+	w.token = response.Auth.ClientToken
+	w.tokenExpiresAt = time.Time{}
+	if response.Auth.LeaseDuration > 0 {
+		w.tokenExpiresAt = time.Now().Add(time.Duration(response.Auth.LeaseDuration)*time.Second - vaultTokenRenewalMargin)
+	}
+
+	return w.token, nil
+}
+
+// expireToken makes the next request log in again, unless another request already replaced the given token
+func (w *VaultKeyWrapper) expireToken(token string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.token == token {
+		w.token = ""
+	}
+}
+
+func (w *VaultKeyWrapper) do(ctx context.Context, method string, apiPath string, token string, body interface{}) (*vaultResponse, error) {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+
+	request, err := http.NewRequest(method, w.address+"/v1/"+apiPath, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		request.Header.Set("X-Vault-Token", token)
+	}
+	if w.namespace != "" {
+		request.Header.Set("X-Vault-Namespace", w.namespace)
+	}
+
+	httpResponse, err := w.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	response := &vaultResponse{}
+	if err := json.NewDecoder(httpResponse.Body).Decode(response); err != nil && httpResponse.StatusCode < 300 {
+		return nil, fmt.Errorf("failed to read Vault response: %s", err)
+	}
+
+	if httpResponse.StatusCode >= 300 {
+		err := VaultError{httpResponse.StatusCode, response.Errors}
+		if httpResponse.StatusCode == http.StatusTooManyRequests {
+			return nil, ThrottledError{err}
+		}
+		return nil, err
+	}
+
+	return response, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// referenceWebhookServer is a reference implementation of the JSON contract WebhookKeyWrapper calls
+// (see its doc comment), for tests and for anyone writing a key service RKMS can use as a region.
+// Data keys are wrapped with a LocalKeyWrapper, and it serves:
+//
+//	POST /generate, POST /wrap and POST /unwrap
+//
+// Setting failures makes the next calls fail with that status before anything is done.
+type referenceWebhookServer struct {
+	wrapper *LocalKeyWrapper
+
+	mutex    sync.Mutex
+	failures []int
+	calls    map[string]int
+}
+
+func newReferenceWebhookServer(wrapper *LocalKeyWrapper) *referenceWebhookServer {
+	return &referenceWebhookServer{wrapper: wrapper, calls: make(map[string]int)}
+}
+
+// failNext makes the next calls fail with the given statuses, in order
+func (s *referenceWebhookServer) failNext(statuses ...int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures = append(s.failures, statuses...)
+}
+
+// callCount returns how many times the given path was called
+func (s *referenceWebhookServer) callCount(path string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.calls[path]
+}
+
+func (s *referenceWebhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.calls[r.URL.Path]++
+	failure := 0
+	if len(s.failures) > 0 {
+		failure, s.failures = s.failures[0], s.failures[1:]
+	}
+	s.mutex.Unlock()
+
+	if failure != 0 {
+		s.respond(w, failure, webhookResponse{Error: http.StatusText(failure)})
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		s.respond(w, http.StatusMethodNotAllowed, webhookResponse{Error: "only POST is supported"})
+		return
+	}
+
+	request := webhookRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		s.respond(w, http.StatusBadRequest, webhookResponse{Error: err.Error()})
+		return
+	}
+
+	ctx := context.Background()
+	response := webhookResponse{}
+	var err error
+	switch r.URL.Path {
+	case "/generate":
+		if request.SizeInBytes <= 0 || request.SizeInBytes > 1024 {
+			s.respond(w, http.StatusBadRequest, webhookResponse{Error: "size_in_bytes must be between 1 and 1024"})
+			return
+		}
+		response.Plaintext, response.Ciphertext, response.KeyID, err = s.wrapper.GenerateDataKey(ctx, request.SizeInBytes)
+	case "/wrap":
+		if len(request.Plaintext) == 0 {
+			s.respond(w, http.StatusBadRequest, webhookResponse{Error: "plaintext is missing"})
+			return
+		}
+		response.Ciphertext, response.KeyID, err = s.wrapper.WrapKey(ctx, request.Plaintext)
+	case "/unwrap":
+		response.Plaintext, response.KeyID, err = s.wrapper.UnwrapKey(ctx, request.Ciphertext)
+		if _, ok := err.(CorruptedWrappedKeyError); ok {
+			s.respond(w, http.StatusUnprocessableEntity, webhookResponse{Error: err.Error()})
+			return
+		}
+	default:
+		s.respond(w, http.StatusNotFound, webhookResponse{Error: "unknown operation"})
+		return
+	}
+
+	if err != nil {
+		s.respond(w, http.StatusInternalServerError, webhookResponse{Error: err.Error()})
+		return
+	}
+
+	s.respond(w, http.StatusOK, response)
+}
+
+func (s *referenceWebhookServer) respond(w http.ResponseWriter, statusCode int, response webhookResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
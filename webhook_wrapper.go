@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// DefaultWebhookTimeoutInSeconds is how long a single call to a webhook may take when no timeout is configured
+const DefaultWebhookTimeoutInSeconds = 5
+
+// DefaultWebhookMaxAttempts is how many times a call to a webhook is tried when max_attempts is not configured
+const DefaultWebhookMaxAttempts = 3
+
+// DefaultWebhookRetryBackoffInMilliseconds is how long the first retry of a call to a webhook waits; every following one waits twice as long
+const DefaultWebhookRetryBackoffInMilliseconds = 100
+
+// maxWebhookResponseSize is the size of a webhook response RKMS reads at most
+const maxWebhookResponseSize = 1 << 20
+
+// WebhookError represents an error type that is returned when a webhook responds with a status other than 200
+type WebhookError struct {
+	URL        string
+	StatusCode int
+	Message    string
+}
+
+func (e WebhookError) Error() string {
+	return fmt.Sprintf("%s responded with status %d: %s", e.URL, e.StatusCode, e.Message)
+}
+
+// isRetryable reports whether calling the webhook again may succeed
+func (e WebhookError) isRetryable() bool {
+	return e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// WebhookKeyWrapper - KeyWrapper implementation that calls an external key service over HTTP(S).
+// Every operation is a POST of a JSON object to its own URL:
+//
+//	generate: {"size_in_bytes": 32}      -> {"plaintext": "<base64>", "ciphertext": "<base64>", "key_id": "..."}
+//	wrap:     {"plaintext": "<base64>"}  -> {"ciphertext": "<base64>", "key_id": "..."}
+//	unwrap:   {"ciphertext": "<base64>"} -> {"plaintext": "<base64>", "key_id": "..."}
+//
+// Errors are any other status than 200, with an optional {"error": "..."} body. The unwrap URL responds with
+// 422 Unprocessable Entity when it rejects the ciphertext itself. Calls that failed to connect or got a
+// 408, 429 or 5xx status are retried with exponential backoff.
+type WebhookKeyWrapper struct {
+	client      *http.Client
+	generateURL string //empty if data keys are generated by RKMS and wrapped with the wrap URL
+	wrapURL     string
+	unwrapURL   string
+
+	maxAttempts  int
+	retryBackoff time.Duration
+
+	// defaultKeyID is the key id reported for responses without one
+	defaultKeyID string
+}
+
+type webhookRequest struct {
+	SizeInBytes int    `json:"size_in_bytes,omitempty"`
+	Plaintext   []byte `json:"plaintext,omitempty"`
+	Ciphertext  []byte `json:"ciphertext,omitempty"`
+}
+
+type webhookResponse struct {
+	Plaintext  []byte `json:"plaintext"`
+	Ciphertext []byte `json:"ciphertext"`
+	KeyID      string `json:"key_id"`
+	Error      string `json:"error"`
+}
+
+// newWebhookKeyWrapper creates a new WebhookKeyWrapper instance for the URLs of the given backend
+func newWebhookKeyWrapper(backendConfig WrappingBackendConfig) (*WebhookKeyWrapper, error) {
+	tlsConfig := &tls.Config{}
+	if backendConfig.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(backendConfig.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", backendConfig.TLSCAFile)
+		}
+	}
+
+	if backendConfig.TLSCertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(backendConfig.TLSCertFile, backendConfig.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate of key-wrapping backend %s: %s", backendConfig.Name, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	timeout := backendConfig.TimeoutInSeconds
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeoutInSeconds
+	}
+
+	maxAttempts := backendConfig.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultWebhookMaxAttempts
+	}
+
+	retryBackoff := backendConfig.RetryBackoffInMilliseconds
+	if retryBackoff <= 0 {
+		retryBackoff = DefaultWebhookRetryBackoffInMilliseconds
+	}
+
+	return &WebhookKeyWrapper{
+		client: &http.Client{
+			Timeout:   time.Duration(timeout) * time.Second,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+		},
+		generateURL:  backendConfig.GenerateURL,
+		wrapURL:      backendConfig.WrapURL,
+		unwrapURL:    backendConfig.UnwrapURL,
+		maxAttempts:  maxAttempts,
+		retryBackoff: time.Duration(retryBackoff) * time.Millisecond,
+		defaultKeyID: "webhook:" + backendConfig.Name,
+	}, nil
+}
+
+// GenerateDataKey generates a data key with the generate URL, or generates one in process
+// and wraps it with the wrap URL if there is no generate URL
+func (w *WebhookKeyWrapper) GenerateDataKey(ctx context.Context, sizeInBytes int) ([]byte, []byte, string, error) {
+	if w.generateURL == "" {
+		plaintext := make([]byte, sizeInBytes)
+		if _, err := rand.Read(plaintext); err != nil {
+			return nil, nil, "", err
+		}
+
+		ciphertext, keyID, err := w.WrapKey(ctx, plaintext)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		return plaintext, ciphertext, keyID, nil
+	}
+
+	response, err := w.call(ctx, w.generateURL, webhookRequest{SizeInBytes: sizeInBytes})
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if len(response.Plaintext) != sizeInBytes || len(response.Ciphertext) == 0 {
+		return nil, nil, "", fmt.Errorf("%s returned a data key of %d bytes instead of %d", w.generateURL, len(response.Plaintext), sizeInBytes)
+	}
+
+	return response.Plaintext, response.Ciphertext, w.keyID(response), nil
+}
+
+// WrapKey encrypts the given data key with the wrap URL
+func (w *WebhookKeyWrapper) WrapKey(ctx context.Context, plaintext []byte) ([]byte, string, error) {
+	response, err := w.call(ctx, w.wrapURL, webhookRequest{Plaintext: plaintext})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(response.Ciphertext) == 0 {
+		return nil, "", fmt.Errorf("%s returned no ciphertext", w.wrapURL)
+	}
+
+	return response.Ciphertext, w.keyID(response), nil
+}
+
+// UnwrapKey decrypts the given data key with the unwrap URL
+func (w *WebhookKeyWrapper) UnwrapKey(ctx context.Context, ciphertext []byte) ([]byte, string, error) {
+	response, err := w.call(ctx, w.unwrapURL, webhookRequest{Ciphertext: ciphertext})
+	if err != nil {
+		if webhookErr, ok := err.(WebhookError); ok && webhookErr.StatusCode == http.StatusUnprocessableEntity {
+			return nil, "", CorruptedWrappedKeyError{err}
+		}
+		return nil, "", err
+	}
+
+	if len(response.Plaintext) == 0 {
+		return nil, "", fmt.Errorf("%s returned no data key", w.unwrapURL)
+	}
+
+	return response.Plaintext, w.keyID(response), nil
+}
+
+func (w *WebhookKeyWrapper) keyID(response *webhookResponse) string {
+	if response.KeyID != "" {
+		return response.KeyID
+	}
+
+	return w.defaultKeyID
+}
+
+// call posts the given request to url, retrying with exponential backoff while the failure may be temporary
+func (w *WebhookKeyWrapper) call(ctx context.Context, url string, body webhookRequest) (*webhookResponse, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		response, err := w.post(ctx, url, b)
+		if err == nil {
+			return response, nil
+		}
+
+		webhookErr, isWebhookErr := err.(WebhookError)
+		if ctx.Err() != nil {
+			return nil, CancelledError{ctx.Err()}
+		}
+
+		if attempt == w.maxAttempts || (isWebhookErr && !webhookErr.isRetryable()) {
+			if isWebhookErr && webhookErr.StatusCode == http.StatusTooManyRequests {
+				return nil, ThrottledError{err}
+			}
+			return nil, err
+		}
+
+		backoff := w.retryBackoff << uint(attempt-1)
+		logger.Debugf("call to %s failed (attempt %d of %d), retrying in %s: %s", url, attempt, w.maxAttempts, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, CancelledError{ctx.Err()}
+		}
+	}
+}
+
+func (w *WebhookKeyWrapper) post(ctx context.Context, url string, body []byte) (*webhookResponse, error) {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json")
+
+	httpResponse, err := w.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	response := &webhookResponse{}
+	decodeErr := json.NewDecoder(io.LimitReader(httpResponse.Body, maxWebhookResponseSize)).Decode(response)
+
+	if httpResponse.StatusCode != http.StatusOK {
+		message := response.Error
+		if message == "" {
+			message = http.StatusText(httpResponse.StatusCode)
+		}
+		return nil, WebhookError{url, httpResponse.StatusCode, message}
+	}
+
+	if decodeErr != nil {
+		return nil, fmt.Errorf("failed to read the response of %s: %s", url, decodeErr)
+	}
+
+	return response, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// the kinds of key-wrapping backends RKMS supports
+const (
+	WrappingBackendAWSKMS  = "aws-kms"
+	WrappingBackendLocal   = "local"
+	WrappingBackendVault   = "vault"
+	WrappingBackendPKCS11  = "pkcs11"
+	WrappingBackendWebhook = "webhook"
+)
+
+// KeyWrapper - a key-wrapping backend that data keys are encrypted (wrapped) with.
+// Every key id a KeyWrapper reports identifies the master key it used, e.g. the key ARN for AWS KMS.
+type KeyWrapper interface {
+	// GenerateDataKey returns a new random data key of the given size, both in plaintext and wrapped
+	GenerateDataKey(ctx context.Context, sizeInBytes int) (plaintext []byte, ciphertext []byte, keyID string, err error)
+
+	// WrapKey encrypts the given data key
+	WrapKey(ctx context.Context, plaintext []byte) (ciphertext []byte, keyID string, err error)
+
+	// UnwrapKey decrypts a data key wrapped by this backend, and returns a CorruptedWrappedKeyError
+	// if the backend rejected the ciphertext itself
+	UnwrapKey(ctx context.Context, ciphertext []byte) (plaintext []byte, keyID string, err error)
+}
+
+// RewrappingKeyWrapper - a KeyWrapper that can re-wrap data keys under its current master key by itself.
+// Backends that don't implement it are skipped by RewrapDataKeys.
+type RewrappingKeyWrapper interface {
+	KeyWrapper
+
+	// CurrentKeyID returns the id of the master key new data keys are wrapped with
+	CurrentKeyID(ctx context.Context) (string, error)
+
+	// RewrapKey re-encrypts a data key wrapped by this backend under the master key with the given id
+	RewrapKey(ctx context.Context, ciphertext []byte, keyID string) ([]byte, error)
+}
+
+// CorruptedWrappedKeyError represents an error type that is returned when a backend rejects a wrapped key
+// as invalid, as opposed to being unavailable
+type CorruptedWrappedKeyError struct {
+	Err error
+}
+
+func (e CorruptedWrappedKeyError) Error() string {
+	return fmt.Sprintf("wrapped key is corrupted: %s", e.Err)
+}
+
+// newKeyWrapper creates the key-wrapping backend described by the given config
+func newKeyWrapper(backendConfig WrappingBackendConfig) (KeyWrapper, error) {
+	switch backendConfig.Type {
+	case WrappingBackendAWSKMS:
+		return newAWSKMSWrapper(backendConfig)
+	case WrappingBackendLocal:
+		return newLocalKeyWrapper(backendConfig)
+	case WrappingBackendVault:
+		return newVaultKeyWrapper(backendConfig)
+	case WrappingBackendPKCS11:
+		return newPKCS11KeyWrapper(backendConfig)
+	case WrappingBackendWebhook:
+		return newWebhookKeyWrapper(backendConfig)
+	}
+
+	return nil, fmt.Errorf("unsupported type %q of key-wrapping backend %s", backendConfig.Type, backendConfig.Name)
+}
+
+// newKeyWrappers creates every configured key-wrapping backend, keyed by backend name
+func newKeyWrappers(backendConfigs []WrappingBackendConfig) (map[string]KeyWrapper, error) {
+	wrappers := make(map[string]KeyWrapper)
+	for _, backendConfig := range backendConfigs {
+		wrapper, err := newKeyWrapper(backendConfig)
+		if err != nil {
+			return nil, err
+		}
+		wrappers[backendConfig.Name] = wrapper
+	}
+
+	return wrappers, nil
+}
+
+// AWSKMSWrapper - KeyWrapper implementation for a key of AWS KMS in a single region
+type AWSKMSWrapper struct {
+	client kmsiface.KMSAPI
+	keyID  *string
+}
+
+func newAWSKMSWrapper(backendConfig WrappingBackendConfig) (*AWSKMSWrapper, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(backendConfig.Region),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &AWSKMSWrapper{kms.New(sess), aws.String(backendConfig.KeyID)}, nil
+}
+
+// GenerateDataKey generates a data key with KMS
+func (w *AWSKMSWrapper) GenerateDataKey(ctx context.Context, sizeInBytes int) ([]byte, []byte, string, error) {
+	input := &kms.GenerateDataKeyInput{
+		KeyId:         w.keyID,
+		NumberOfBytes: aws.Int64(int64(sizeInBytes)),
+	}
+
+	result, err := w.client.GenerateDataKeyWithContext(ctx, input)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	return result.Plaintext, result.CiphertextBlob, w.reportedKeyID(result.KeyId), nil
+}
+
+// WrapKey encrypts the given data key with KMS
+func (w *AWSKMSWrapper) WrapKey(ctx context.Context, plaintext []byte) ([]byte, string, error) {
+	input := &kms.EncryptInput{
+		KeyId:     w.keyID,
+		Plaintext: plaintext,
+	}
+
+	result, err := w.client.EncryptWithContext(ctx, input)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return result.CiphertextBlob, w.reportedKeyID(result.KeyId), nil
+}
+
+// UnwrapKey decrypts the given data key with KMS
+func (w *AWSKMSWrapper) UnwrapKey(ctx context.Context, ciphertext []byte) ([]byte, string, error) {
+	input := &kms.DecryptInput{
+		CiphertextBlob: ciphertext,
+	}
+
+	result, err := w.client.DecryptWithContext(ctx, input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == kms.ErrCodeInvalidCiphertextException {
+			return nil, "", CorruptedWrappedKeyError{err}
+		}
+		return nil, "", err
+	}
+
+	return result.Plaintext, aws.StringValue(result.KeyId), nil
+}
+
+// CurrentKeyID resolves the configured key id, which may be an alias, to its key ARN,
+// which is what KMS reports as the key a ciphertext was encrypted under
+func (w *AWSKMSWrapper) CurrentKeyID(ctx context.Context) (string, error) {
+	input := &kms.DescribeKeyInput{
+		KeyId: w.keyID,
+	}
+
+	result, err := w.client.DescribeKeyWithContext(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("failed to describe key %s: %s", aws.StringValue(w.keyID), err)
+	}
+
+	return aws.StringValue(result.KeyMetadata.Arn), nil
+}
+
+// RewrapKey re-encrypts the given data key under keyID within KMS
+func (w *AWSKMSWrapper) RewrapKey(ctx context.Context, ciphertext []byte, keyID string) ([]byte, error) {
+	input := &kms.ReEncryptInput{
+		CiphertextBlob:   ciphertext,
+		DestinationKeyId: aws.String(keyID),
+	}
+
+	result, err := w.client.ReEncryptWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.CiphertextBlob, nil
+}
+
+// reportedKeyID returns the key id KMS reported using, which is the key ARN,
+// or the configured key id if KMS did not report one
+func (w *AWSKMSWrapper) reportedKeyID(keyID *string) string {
+	if keyID != nil && *keyID != "" {
+		return *keyID
+	}
+
+	return aws.StringValue(w.keyID)
+}